@@ -16,6 +16,8 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -31,21 +33,73 @@ func assertNoError(err error) {
 func main() {
 
 	var required []piazza.ServiceName
-	required = []piazza.ServiceName{piazza.PzElasticSearch}
+	if !pzmetrics.InMemoryStorage() {
+		required = []piazza.ServiceName{piazza.PzElasticSearch}
+	}
 	sys, err := piazza.NewSystemConfig(piazza.PzMetrics, required)
 	assertNoError(err)
 
-	metricIndex, err := elasticsearch.NewIndex(sys, "metricstest$", pzmetrics.MetricIndexSettings)
+	service := &pzmetrics.Service{}
+
+	if pzmetrics.InMemoryStorage() {
+		log.Printf("Using in-memory storage")
+		err = service.InitInMemory(sys)
+		assertNoError(err)
+	} else {
+		metricIndex, err := elasticsearch.NewIndex(sys, "metricstest$", pzmetrics.MetricIndexSettings)
+		assertNoError(err)
+		//log.Printf("New index: %s", metricIndex.IndexName())
+
+		dataIndex, err := elasticsearch.NewIndex(sys, "datastest$", pzmetrics.DataIndexSettings)
+		assertNoError(err)
+		//log.Printf("New index: %s", dataIndex.IndexName())
+
+		err = service.Init(sys, metricIndex, dataIndex)
+		assertNoError(err)
+
+		rollupIndex, err := elasticsearch.NewIndex(sys, "rollupstest$", pzmetrics.RollupIndexSettings)
+		assertNoError(err)
+
+		err = service.InitRollups(rollupIndex)
+		assertNoError(err)
+	}
+
+	service.SetAutoCreateMetrics(pzmetrics.AutoCreateMetrics())
+
+	// alert rules are evaluated every $PZ_METRICS_ALERT_INTERVAL, default 1m
+	alertInterval := pzmetrics.DefaultAlertInterval
+	if s := os.Getenv("PZ_METRICS_ALERT_INTERVAL"); s != "" {
+		alertInterval, err = time.ParseDuration(s)
+		assertNoError(err)
+	}
+	err = service.StartAlerts(alertInterval)
 	assertNoError(err)
-	//log.Printf("New index: %s", metricIndex.IndexName())
+	defer service.StopAlerts()
 
-	dataIndex, err := elasticsearch.NewIndex(sys, "datastest$", pzmetrics.DataIndexSettings)
+	// Data older than $PZ_METRICS_RETENTION (e.g. "30d"; default forever),
+	// or the metric's own retention, is purged every
+	// $PZ_METRICS_RETENTION_INTERVAL, default 1h
+	err = service.SetDefaultRetention(os.Getenv("PZ_METRICS_RETENTION"))
 	assertNoError(err)
-	//log.Printf("New index: %s", dataIndex.IndexName())
+	retentionInterval := pzmetrics.DefaultRetentionInterval
+	if s := os.Getenv("PZ_METRICS_RETENTION_INTERVAL"); s != "" {
+		retentionInterval, err = time.ParseDuration(s)
+		assertNoError(err)
+	}
+	err = service.StartRetention(retentionInterval)
+	assertNoError(err)
+	defer service.StopRetention()
 
-	service := &pzmetrics.Service{}
-	err = service.Init(sys, metricIndex, dataIndex)
+	// the hourly and daily rollups are brought up to date every
+	// $PZ_METRICS_ROLLUP_INTERVAL, default 10m
+	rollupInterval := pzmetrics.DefaultRollupInterval
+	if s := os.Getenv("PZ_METRICS_ROLLUP_INTERVAL"); s != "" {
+		rollupInterval, err = time.ParseDuration(s)
+		assertNoError(err)
+	}
+	err = service.StartRollups(rollupInterval)
 	assertNoError(err)
+	defer service.StopRollups()
 
 	server := &pzmetrics.Server{}
 	server.Init(service)
@@ -60,6 +114,19 @@ func main() {
 	done, err := genericServer.Start()
 	assertNoError(err)
 
+	// to also take StatsD over UDP, set $PZ_METRICS_STATSD_ADDRESS, e.g. to ":8125"
+	if address := os.Getenv("PZ_METRICS_STATSD_ADDRESS"); address != "" {
+		flushInterval := 10 * time.Second
+		if s := os.Getenv("PZ_METRICS_STATSD_FLUSH"); s != "" {
+			flushInterval, err = time.ParseDuration(s)
+			assertNoError(err)
+		}
+
+		statsd, err := pzmetrics.NewStatsdListener(service, address, flushInterval)
+		assertNoError(err)
+		defer statsd.Close()
+	}
+
 	//client, err := pzmetrics.NewClient(sys)
 	//assertNoError(err)
 
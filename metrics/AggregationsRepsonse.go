@@ -14,7 +14,11 @@
 
 package metrics
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
 
 type StdDeviationBounds struct {
 	Lower float64 `json:"lower"`
@@ -50,22 +54,65 @@ func (d *StatsReport) String() string {
 		d.StdDeviationBounds.Lower, d.StdDeviationBounds.Upper)
 }
 
+// aggregate returns one of the statistics by name: avg, sum, min, max or
+// count. It returns false for any other name.
+func (d *StatsReport) aggregate(name string) (float64, bool) {
+	switch name {
+	case "avg":
+		return d.Avg, true
+	case "sum":
+		return d.Sum, true
+	case "min":
+		return d.Min, true
+	case "max":
+		return d.Max, true
+	case "count":
+		return float64(d.Count), true
+	}
+	return 0.0, false
+}
+
+// PercsReport has the percentiles, keyed by percent as ES does, e.g. "99.9"
+// or "50.0", and the percentile ranks asked for: the percent of the data at
+// or below each value, keyed the same way by the value.
 type PercsReport struct {
 	Values map[string]float64 `json:"values"`
+	Ranks  map[string]float64 `json:"ranks,omitempty"`
+}
+
+// sortedPercsKeys returns the keys of the percentiles or ranks in numeric
+// order, with the number each is for
+func sortedPercsKeys(values map[string]float64) ([]string, []float64) {
+	byNumber := map[float64]string{}
+	numbers := []float64{}
+	for k := range values {
+		n, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			continue
+		}
+		byNumber[n] = k
+		numbers = append(numbers, n)
+	}
+	sort.Float64s(numbers)
+
+	keys := make([]string, len(numbers))
+	for i, n := range numbers {
+		keys[i] = byNumber[n]
+	}
+	return keys, numbers
 }
 
 func (d *PercsReport) String() string {
-	s := `  1%%: %f
-  5%%: %f
-  25%%: %f
-  50%%: %f
-  75%%: %f
-  95%%: %f
-  99%%: %f
-`
-	return fmt.Sprintf(s, d.Values["1.0"], d.Values["5.0"],
-		d.Values["25.0"], d.Values["50.0"], d.Values["75.0"],
-		d.Values["95.0"], d.Values["99.0"])
+	s := ""
+	keys, percents := sortedPercsKeys(d.Values)
+	for i, k := range keys {
+		s += fmt.Sprintf("  %s%%: %f\n", strconv.FormatFloat(percents[i], 'f', -1, 64), d.Values[k])
+	}
+	keys, values := sortedPercsKeys(d.Ranks)
+	for i, k := range keys {
+		s += fmt.Sprintf("  rank of %s: %f%%\n", strconv.FormatFloat(values[i], 'f', -1, 64), d.Ranks[k])
+	}
+	return s
 }
 
 type BucketStats struct {
@@ -81,11 +128,45 @@ func (b *BucketStats) String() string {
 	return fmt.Sprintf(s, b.Count, b.Min, b.Max, b.Avg)
 }
 
+// aggregate returns one of the statistics by name, as for a StatsReport
+func (b *BucketStats) aggregate(name string) (float64, bool) {
+	switch name {
+	case "avg":
+		return b.Avg, true
+	case "sum":
+		return b.Sum, true
+	case "min":
+		return b.Min, true
+	case "max":
+		return b.Max, true
+	case "count":
+		return float64(b.Count), true
+	}
+	return 0.0, false
+}
+
+// RateReport is for counter metrics: how much the counter went up, and how
+// fast. Resets is how many times the counter went back down.
+type RateReport struct {
+	Increase  float64 `json:"increase"`
+	PerSecond float64 `json:"per_second"`
+	Resets    int64   `json:"resets"`
+}
+
+func (r *RateReport) String() string {
+	s := `  Increase: %f
+  PerSecond: %f
+  Resets: %d
+`
+	return fmt.Sprintf(s, r.Increase, r.PerSecond, r.Resets)
+}
+
 type DateBucket struct {
 	Key         float64     `json:"key"`
 	KeyAsString string      `json:"key_as_string"`
 	BucketStats BucketStats `json:"bucket_stats"`
 	DocCount    int         `json:"doc_count"`
+	Rate        *RateReport `json:"rate,omitempty"` // counters only
 }
 
 type ValueBucket struct {
@@ -104,7 +185,12 @@ func (b *DateBucket) String() string {
 	s := `      Key: %s
       Count: %d
       Stats: %s`
-	return fmt.Sprintf(s, b.KeyAsString, b.DocCount, b.BucketStats.String())
+	s = fmt.Sprintf(s, b.KeyAsString, b.DocCount, b.BucketStats.String())
+	if b.Rate != nil {
+		s += fmt.Sprintf("\n      Rate: increase: %f, per_second: %f, resets: %d",
+			b.Rate.Increase, b.Rate.PerSecond, b.Rate.Resets)
+	}
+	return s
 }
 
 type ByValueBucket []ValueBucket
@@ -147,17 +233,79 @@ func (d *ValueHistReport) String() string {
 }
 
 type FullReport struct {
+	Type            MetricType      `json:"type,omitempty"`
+	Tier            RollupTier      `json:"tier,omitempty"`        // what the report was made from
+	RateReport      *RateReport     `json:"rate_report,omitempty"` // counters only
 	StatsReport     StatsReport     `json:"stats_report"`
 	PercsReport     PercsReport     `json:"percs_report"`
 	DateHistReport  DateHistReport  `json:"date_hist_report"`
 	ValueHistReport ValueHistReport `json:"value_hist_report"`
+
+	// the percentile ranks, as ES returns them; moved into the PercsReport
+	// by takeRanks
+	RanksReport *PercsReport `json:"ranks_report,omitempty"`
 }
 
+// takeRanks moves the percentile ranks from ES into the PercsReport
+func (d *FullReport) takeRanks() {
+	if d.RanksReport != nil {
+		d.PercsReport.Ranks = d.RanksReport.Values
+		d.RanksReport = nil
+	}
+}
+
+// String leads with what matters most for the type of metric: the rate of
+// a counter, the percentiles of a timer or histogram.
 func (d *FullReport) String() string {
-	return fmt.Sprintf("STATISTICS:\n%s\nPERCENTILES:\n%s\nDATE-HISTOGRAM:\n%s\nVALUE-HISTOGRAM:\n%s\n",
-		d.StatsReport.String(), d.PercsReport.String(),
+	stats := fmt.Sprintf("STATISTICS:\n%s\n", d.StatsReport.String())
+	percs := fmt.Sprintf("PERCENTILES:\n%s\n", d.PercsReport.String())
+	hists := fmt.Sprintf("DATE-HISTOGRAM:\n%s\nVALUE-HISTOGRAM:\n%s\n",
 		d.DateHistReport.String(),
 		d.ValueHistReport.String())
+
+	// rollups have no distribution
+	if d.Tier != "" && d.Tier != RollupTierRaw {
+		percs = ""
+		hists = fmt.Sprintf("DATE-HISTOGRAM:\n%s\n", d.DateHistReport.String())
+	}
+
+	switch d.Type {
+	case MetricTypeCounter:
+		rate := ""
+		if d.RateReport != nil {
+			rate = fmt.Sprintf("RATE:\n%s\n", d.RateReport.String())
+		}
+		return rate + stats + percs + hists
+	case MetricTypeHistogram, MetricTypeTimer:
+		return percs + stats + hists
+	}
+	return stats + percs + hists
+}
+
+type LabelReport struct {
+	Value  string     `json:"value"`
+	Report FullReport `json:"report"`
+}
+
+type ByLabelValue []LabelReport
+
+func (a ByLabelValue) Len() int           { return len(a) }
+func (a ByLabelValue) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByLabelValue) Less(i, j int) bool { return a[i].Value < a[j].Value }
+
+// GroupedReport has one FullReport for each value of the GroupBy label.
+type GroupedReport struct {
+	GroupBy string        `json:"groupBy"`
+	Tier    RollupTier    `json:"tier,omitempty"` // what the reports were made from
+	Groups  []LabelReport `json:"groups"`
+}
+
+func (d *GroupedReport) String() string {
+	s := ""
+	for _, g := range d.Groups {
+		s += fmt.Sprintf("=== %s: %s ===\n%s", d.GroupBy, g.Value, g.Report.String())
+	}
+	return s
 }
 
 type Aggregations struct {
@@ -177,3 +325,21 @@ type AggsResponse struct {
 	Error        *ErrorResponse `json:"error"`
 	Aggregations Aggregations   `json:"aggregations"`
 }
+
+type GroupBucket struct {
+	Key string `json:"key"`
+	FullReport
+}
+
+type GroupedAggregations struct {
+	FullReport struct {
+		Groups struct {
+			Buckets []GroupBucket `json:"buckets"`
+		} `json:"groups"`
+	} `json:"full_report"`
+}
+
+type GroupedAggsResponse struct {
+	Error        *ErrorResponse      `json:"error"`
+	Aggregations GroupedAggregations `json:"aggregations"`
+}
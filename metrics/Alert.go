@@ -0,0 +1,303 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+type AlertState string
+
+const (
+	AlertStateInactive AlertState = "inactive" // condition not met
+	AlertStatePending  AlertState = "pending"  // condition met, but not yet for long enough
+	AlertStateFiring   AlertState = "firing"   // condition met for long enough
+	AlertStateResolved AlertState = "resolved" // was firing, condition no longer met
+)
+
+// AlertRule is a condition on the recent data of a metric, e.g. "the avg
+// over the last 5m is > 200". The service evaluates every rule on a
+// schedule, and keeps the outcome in the state fields.
+type AlertRule struct {
+	ID         piazza.Ident      `json:"id"`
+	Name       string            `json:"name"`
+	MetricID   piazza.Ident      `json:"metricId"`
+	Aggregate  string            `json:"aggregate"`  // avg, sum, min, max or count
+	Window     string            `json:"window"`     // e.g. "5m"
+	Comparison string            `json:"comparison"` // >, >=, <, <=, == or !=
+	Threshold  float64           `json:"threshold"`
+	For        string            `json:"for,omitempty"`    // how long to be pending before firing
+	Labels     map[string]string `json:"labels,omitempty"` // only use data with these labels
+	CreatedOn  time.Time         `json:"createdOn"`
+
+	// set by the service
+	State       AlertState `json:"state"`
+	StateSince  time.Time  `json:"stateSince"`
+	Value       *float64   `json:"value,omitempty"` // the aggregate, as of the last evaluation
+	EvaluatedOn time.Time  `json:"evaluatedOn,omitempty"`
+}
+
+// AlertEvent records a change in the state of an AlertRule.
+type AlertEvent struct {
+	ID        piazza.Ident `json:"id"`
+	AlertID   piazza.Ident `json:"alertId"`
+	From      AlertState   `json:"from"`
+	To        AlertState   `json:"to"`
+	Value     *float64     `json:"value,omitempty"`
+	CreatedOn time.Time    `json:"createdOn"`
+}
+
+// the default of $PZ_METRICS_ALERT_INTERVAL
+const DefaultAlertInterval = time.Minute
+
+//---------------------------------------------------------------------
+
+var alertComparisons = map[string]func(float64, float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// checkAlertRule returns an error if the rule's definition isn't usable
+func checkAlertRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return errors.New("alert has no name")
+	}
+	if rule.MetricID == piazza.NoIdent {
+		return errors.New("alert has no metricId")
+	}
+	if _, ok := (&StatsReport{}).aggregate(rule.Aggregate); !ok {
+		return fmt.Errorf("invalid aggregate: \"%s\"", rule.Aggregate)
+	}
+	window, err := time.ParseDuration(rule.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("invalid window: \"%s\"", rule.Window)
+	}
+	if _, ok := alertComparisons[rule.Comparison]; !ok {
+		return fmt.Errorf("invalid comparison: \"%s\"", rule.Comparison)
+	}
+	if rule.For != "" {
+		d, err := time.ParseDuration(rule.For)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid for: \"%s\"", rule.For)
+		}
+	}
+	return checkLabels(rule.Labels)
+}
+
+// nextAlertStates returns the states the rule goes through, given whether
+// its condition is now met: none, if it stays as it is. A rule that has
+// been pending long enough fires in the same evaluation.
+func nextAlertStates(rule *AlertRule, met bool, now time.Time) []AlertState {
+	if !met {
+		switch rule.State {
+		case AlertStatePending:
+			return []AlertState{AlertStateInactive}
+		case AlertStateFiring:
+			return []AlertState{AlertStateResolved}
+		}
+		return nil
+	}
+
+	// the definition has already been checked
+	var hold time.Duration
+	if rule.For != "" {
+		hold, _ = time.ParseDuration(rule.For)
+	}
+
+	switch rule.State {
+	case AlertStatePending:
+		if now.Sub(rule.StateSince) >= hold {
+			return []AlertState{AlertStateFiring}
+		}
+		return nil
+	case AlertStateFiring:
+		return nil
+	}
+	if hold == 0 {
+		return []AlertState{AlertStatePending, AlertStateFiring}
+	}
+	return []AlertState{AlertStatePending}
+}
+
+//---------------------------------------------------------------------
+
+// alertEvaluator evaluates all the alert rules every interval, until stopped
+type alertEvaluator struct {
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// StartAlerts starts evaluating the alert rules every interval, in the
+// background.
+func (service *Service) StartAlerts(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("StartAlerts: invalid interval: %s", interval)
+	}
+	if service.alerts != nil {
+		return errors.New("StartAlerts: already started")
+	}
+
+	evaluator := &alertEvaluator{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	service.alerts = evaluator
+
+	go func() {
+		defer close(evaluator.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				err := service.evaluateAlerts(now)
+				if err != nil {
+					log.Printf("Alerts: %s", err.Error())
+				}
+			case <-evaluator.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopAlerts stops the evaluating started by StartAlerts, waiting for any
+// evaluation underway to finish.
+func (service *Service) StopAlerts() {
+	if service.alerts == nil {
+		return
+	}
+	close(service.alerts.done)
+	<-service.alerts.stopped
+	service.alerts = nil
+}
+
+// allAlerts returns every AlertRule, reading them a page at a time
+func (service *Service) allAlerts() ([]AlertRule, error) {
+	const perPage = 1000
+
+	all := []AlertRule{}
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{
+			Page:    page,
+			PerPage: perPage,
+			SortBy:  "createdOn",
+			Order:   piazza.PaginationOrderAscending,
+		}
+		rules, _, err := service.alertDB.GetAll(format)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rules...)
+		if len(rules) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// evaluateAlerts evaluates every rule as of now. A rule that can't be
+// evaluated doesn't stop the others from being; the first error is returned.
+func (service *Service) evaluateAlerts(now time.Time) error {
+	rules, err := service.allAlerts()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, rule := range rules {
+		err = service.evaluateAlert(rule.ID, now)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// evaluateAlert runs the rule's query, moves it to its next states, and
+// records an event for each state change, notifying the channels of it.
+// Rules are re-read under the lock, so that this never undoes a concurrent
+// update or delete.
+func (service *Service) evaluateAlert(id piazza.Ident, now time.Time) error {
+	service.alertMutex.Lock()
+	defer service.alertMutex.Unlock()
+
+	rule, found, err := service.alertDB.GetOne(id)
+	if !found {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	window, _ := time.ParseDuration(rule.Window)
+	req := &ReportRequest{Start: now.Add(-window), End: now, Labels: rule.Labels}
+	stats, err := service.dataDB.GetSummary(rule.MetricID, req)
+	if err != nil {
+		return fmt.Errorf("alert %s: %s", id.String(), err)
+	}
+
+	// with no data, there is nothing to compare, except for a count
+	met := false
+	rule.Value = nil
+	if stats.Count > 0 || rule.Aggregate == "count" {
+		value, _ := stats.aggregate(rule.Aggregate)
+		rule.Value = &value
+		met = alertComparisons[rule.Comparison](value, rule.Threshold)
+	}
+	rule.EvaluatedOn = now
+
+	for _, state := range nextAlertStates(rule, met, now) {
+		eventID, err := service.newIdent()
+		if err != nil {
+			return err
+		}
+		event := &AlertEvent{
+			ID:        eventID,
+			AlertID:   id,
+			From:      rule.State,
+			To:        state,
+			Value:     rule.Value,
+			CreatedOn: now,
+		}
+		err = service.alertDB.PostEvent(event)
+		if err != nil {
+			return err
+		}
+		log.Printf("Alert %s (%s): %s -> %s", rule.Name, id.String(), event.From, event.To)
+
+		rule.State = state
+		rule.StateSince = now
+
+		err = service.notify(rule, event)
+		if err != nil {
+			log.Printf("Alert %s: unable to notify: %s", id.String(), err.Error())
+		}
+	}
+
+	return service.alertDB.PutData(rule, id)
+}
@@ -0,0 +1,356 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// IAlertDB is the storage interface for AlertRules, their AlertEvents, and
+// the NotificationChannels told about them.
+// AlertDB is the Elasticsearch-backed implementation; MemAlertDB keeps
+// everything in memory.
+type IAlertDB interface {
+	PostData(rule *AlertRule, id piazza.Ident) (piazza.Ident, error)
+	PutData(rule *AlertRule, id piazza.Ident) error
+	GetAll(format *piazza.JsonPagination) ([]AlertRule, int64, error)
+	GetOne(id piazza.Ident) (*AlertRule, bool, error)
+	DeleteByID(id piazza.Ident) (bool, error)
+	PostEvent(event *AlertEvent) error
+	GetEvents(alertID piazza.Ident, format *piazza.JsonPagination) ([]AlertEvent, int64, error)
+	PostChannel(channel *NotificationChannel) error
+	GetChannels(format *piazza.JsonPagination) ([]NotificationChannel, int64, error)
+	GetChannel(id piazza.Ident) (*NotificationChannel, bool, error)
+	DeleteChannel(id piazza.Ident) (bool, error)
+}
+
+// AlertDB keeps the rules, events and channels as more types in the metric
+// index.
+type AlertDB struct {
+	*ResourceDB
+	mapping        string
+	eventMapping   string
+	channelMapping string
+}
+
+const AlertDBMapping string = "Alert"
+const AlertEventDBMapping string = "AlertEvent"
+const NotificationChannelDBMapping string = "NotificationChannel"
+
+const alertMapping = `{
+	"Alert":{
+		"properties": {
+			"name": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"metricId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"state": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdOn": {
+				"type": "date"
+			}
+		}
+	}
+}`
+
+const alertEventMapping = `{
+	"AlertEvent":{
+		"properties": {
+			"alertId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"from": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"to": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdOn": {
+				"type": "date"
+			}
+		}
+	}
+}`
+
+const notificationChannelMapping = `{
+	"NotificationChannel":{
+		"properties": {
+			"name": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"url": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdOn": {
+				"type": "date"
+			}
+		}
+	}
+}`
+
+// NewAlertDB uses the metric index, which must already exist.
+func NewAlertDB(service *Service, esi elasticsearch.IIndex) (*AlertDB, error) {
+	mappings := map[string]string{
+		AlertDBMapping:               alertMapping,
+		AlertEventDBMapping:          alertEventMapping,
+		NotificationChannelDBMapping: notificationChannelMapping,
+	}
+	for typ, mapping := range mappings {
+		ok, err := esi.TypeExists(typ)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		err = esi.SetMapping(typ, piazza.JsonString(mapping))
+		if err != nil {
+			log.Printf("NewAlertDB: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	rdb := &ResourceDB{service: service, Esi: esi}
+	db := &AlertDB{
+		ResourceDB:     rdb,
+		mapping:        AlertDBMapping,
+		eventMapping:   AlertEventDBMapping,
+		channelMapping: NotificationChannelDBMapping,
+	}
+	return db, nil
+}
+
+func (db *AlertDB) PostData(rule *AlertRule, id piazza.Ident) (piazza.Ident, error) {
+	indexResult, err := db.Esi.PostData(db.mapping, id.String(), rule)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("AlertDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return piazza.NoIdent, LoggedError("AlertDB.PostData failed: not created")
+	}
+
+	return id, nil
+}
+
+func (db *AlertDB) PutData(rule *AlertRule, id piazza.Ident) error {
+	_, err := db.Esi.PutData(db.mapping, id.String(), rule)
+	if err != nil {
+		return LoggedError("AlertDB.PutData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *AlertDB) GetAll(format *piazza.JsonPagination) ([]AlertRule, int64, error) {
+	rules := []AlertRule{}
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return rules, 0, err
+	}
+	if !exists {
+		return rules, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("AlertDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("AlertDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var rule AlertRule
+			err := json.Unmarshal(*hit.Source, &rule)
+			if err != nil {
+				return nil, 0, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, searchResult.TotalHits(), nil
+}
+
+func (db *AlertDB) GetOne(id piazza.Ident) (*AlertRule, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("AlertDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("AlertDB.GetOne failed: %s no getResult", id.String())
+	}
+	if !getResult.Found {
+		return nil, false, fmt.Errorf("AlertDB.GetOne failed: %s not found", id.String())
+	}
+
+	var rule AlertRule
+	err = json.Unmarshal(*getResult.Source, &rule)
+	if err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &rule, getResult.Found, nil
+}
+
+func (db *AlertDB) DeleteByID(id piazza.Ident) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return false, fmt.Errorf("AlertDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("AlertDB.DeleteById failed: no deleteResult")
+	}
+	if !deleteResult.Found {
+		return false, fmt.Errorf("AlertDB.DeleteById failed: not found")
+	}
+
+	return true, nil
+}
+
+func (db *AlertDB) PostEvent(event *AlertEvent) error {
+	_, err := db.Esi.PostData(db.eventMapping, event.ID.String(), event)
+	if err != nil {
+		return LoggedError("AlertDB.PostEvent failed: %s", err)
+	}
+	return nil
+}
+
+func (db *AlertDB) GetEvents(alertID piazza.Ident, format *piazza.JsonPagination) ([]AlertEvent, int64, error) {
+	events := []AlertEvent{}
+	exists, err := db.Esi.TypeExists(db.eventMapping)
+	if err != nil {
+		return events, 0, err
+	}
+	if !exists {
+		return events, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByTermQuery(db.eventMapping, "alertId", alertID.String(), format)
+	if err != nil {
+		return nil, 0, LoggedError("AlertDB.GetEvents failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("AlertDB.GetEvents failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var event AlertEvent
+			err := json.Unmarshal(*hit.Source, &event)
+			if err != nil {
+				return nil, 0, err
+			}
+			events = append(events, event)
+		}
+	}
+
+	return events, searchResult.TotalHits(), nil
+}
+
+func (db *AlertDB) PostChannel(channel *NotificationChannel) error {
+	indexResult, err := db.Esi.PostData(db.channelMapping, channel.ID.String(), channel)
+	if err != nil {
+		return LoggedError("AlertDB.PostChannel failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("AlertDB.PostChannel failed: not created")
+	}
+	return nil
+}
+
+func (db *AlertDB) GetChannels(format *piazza.JsonPagination) ([]NotificationChannel, int64, error) {
+	channels := []NotificationChannel{}
+	exists, err := db.Esi.TypeExists(db.channelMapping)
+	if err != nil {
+		return channels, 0, err
+	}
+	if !exists {
+		return channels, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.channelMapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("AlertDB.GetChannels failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("AlertDB.GetChannels failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var channel NotificationChannel
+			err := json.Unmarshal(*hit.Source, &channel)
+			if err != nil {
+				return nil, 0, err
+			}
+			channels = append(channels, channel)
+		}
+	}
+
+	return channels, searchResult.TotalHits(), nil
+}
+
+func (db *AlertDB) GetChannel(id piazza.Ident) (*NotificationChannel, bool, error) {
+	getResult, err := db.Esi.GetByID(db.channelMapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("AlertDB.GetChannel failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("AlertDB.GetChannel failed: %s no getResult", id.String())
+	}
+	if !getResult.Found {
+		return nil, false, fmt.Errorf("AlertDB.GetChannel failed: %s not found", id.String())
+	}
+
+	var channel NotificationChannel
+	err = json.Unmarshal(*getResult.Source, &channel)
+	if err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &channel, getResult.Found, nil
+}
+
+func (db *AlertDB) DeleteChannel(id piazza.Ident) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.channelMapping, string(id))
+	if err != nil {
+		return false, fmt.Errorf("AlertDB.DeleteChannel failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("AlertDB.DeleteChannel failed: no deleteResult")
+	}
+	if !deleteResult.Found {
+		return false, fmt.Errorf("AlertDB.DeleteChannel failed: not found")
+	}
+
+	return true, nil
+}
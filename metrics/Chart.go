@@ -0,0 +1,461 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Rendering of reports as SVG charts, for pages and mail that can only show
+// an image: a line or area chart of the date histogram, over a bar chart of
+// the value histogram. A report made from rollups has no value histogram,
+// so its chart is only the first.
+
+const SvgContentType = "image/svg+xml"
+
+type ChartStyle string
+
+const (
+	ChartStyleLine ChartStyle = "line"
+	ChartStyleArea ChartStyle = "area"
+)
+
+type ChartTheme string
+
+const (
+	ChartThemeLight ChartTheme = "light"
+	ChartThemeDark  ChartTheme = "dark"
+)
+
+const (
+	chartDefaultWidth  = 800
+	chartDefaultHeight = 400
+	chartMinSize       = 300
+	chartMaxSize       = 4000
+)
+
+// ChartRequest asks for a chart of a report. Value is the statistic of each
+// date histogram bucket that is plotted: avg, sum, min, max or count.
+type ChartRequest struct {
+	ReportRequest
+	Width  int
+	Height int
+	Theme  ChartTheme
+	Style  ChartStyle
+	Value  string
+}
+
+type chartColors struct {
+	background string
+	text       string
+	grid       string
+	line       string
+	fill       string
+	bar        string
+}
+
+var chartThemes = map[ChartTheme]*chartColors{
+	ChartThemeLight: {
+		background: "#ffffff",
+		text:       "#333333",
+		grid:       "#dddddd",
+		line:       "#1f77b4",
+		fill:       "#aec7e8",
+		bar:        "#ff7f0e",
+	},
+	ChartThemeDark: {
+		background: "#1e1e1e",
+		text:       "#d4d4d4",
+		grid:       "#444444",
+		line:       "#4fc3f7",
+		fill:       "#01579b",
+		bar:        "#ffb74d",
+	},
+}
+
+// checkChartRequest fills in the defaults of the request, and returns an
+// error if any of its chart settings are bad
+func checkChartRequest(req *ChartRequest) error {
+	if req.Width == 0 {
+		req.Width = chartDefaultWidth
+	}
+	if req.Height == 0 {
+		req.Height = chartDefaultHeight
+	}
+	if req.Theme == "" {
+		req.Theme = ChartThemeLight
+	}
+	if req.Style == "" {
+		req.Style = ChartStyleLine
+	}
+	if req.Value == "" {
+		req.Value = "avg"
+	}
+
+	if req.Width < chartMinSize || req.Width > chartMaxSize {
+		return fmt.Errorf("invalid width: %d", req.Width)
+	}
+	if req.Height < chartMinSize || req.Height > chartMaxSize {
+		return fmt.Errorf("invalid height: %d", req.Height)
+	}
+	if chartThemes[req.Theme] == nil {
+		return fmt.Errorf("invalid theme: %s", req.Theme)
+	}
+	if req.Style != ChartStyleLine && req.Style != ChartStyleArea {
+		return fmt.Errorf("invalid style: %s", req.Style)
+	}
+	if _, ok := (&BucketStats{}).aggregate(req.Value); !ok {
+		return fmt.Errorf("invalid value: %s", req.Value)
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+// the most ticks an axis may have
+const maxChartTicks = 100
+
+// niceTicks returns the values, at a round step, for about n ticks of an
+// axis from lo to hi, and how many decimals they need
+func niceTicks(lo, hi float64, n int) ([]float64, int) {
+	span := hi - lo
+	if span <= 0 {
+		span = math.Abs(lo)
+		if span == 0 {
+			span = 1
+		}
+	}
+	rough := span / float64(n)
+	mag := math.Pow(10, math.Floor(math.Log10(rough)))
+	step := mag * 10
+	for _, m := range []float64{1, 2, 5} {
+		if rough <= m*mag {
+			step = m * mag
+			break
+		}
+	}
+
+	// a step too small to add to lo, e.g. for timestamps in nanoseconds,
+	// would never get to hi
+	if step < math.Abs(lo)*1e-15 {
+		return []float64{lo, math.Max(hi, lo+math.Abs(lo)*1e-15)}, 0
+	}
+
+	first := math.Floor(lo/step) * step
+	// enough ticks to get to hi, as the last one is the top of the axis
+	count := int(math.Ceil((hi-first)/step-1e-9)) + 1
+	if count < 2 {
+		count = 2
+	}
+	if count > maxChartTicks {
+		count = maxChartTicks
+	}
+	ticks := make([]float64, count)
+	for i := range ticks {
+		ticks[i] = first + float64(i)*step
+	}
+	return ticks, int(math.Max(0, -math.Floor(math.Log10(step))))
+}
+
+// the steps between time ticks, and how their labels are written
+var chartTimeSteps = []struct {
+	step   time.Duration
+	format string
+}{
+	{time.Second, "15:04:05"},
+	{5 * time.Second, "15:04:05"},
+	{15 * time.Second, "15:04:05"},
+	{time.Minute, "15:04"},
+	{5 * time.Minute, "15:04"},
+	{15 * time.Minute, "15:04"},
+	{time.Hour, "15:04"},
+	{3 * time.Hour, "Jan 2 15:04"},
+	{6 * time.Hour, "Jan 2 15:04"},
+	{12 * time.Hour, "Jan 2 15:04"},
+	{24 * time.Hour, "Jan 2"},
+	{7 * 24 * time.Hour, "Jan 2"},
+	{30 * 24 * time.Hour, "Jan 2006"},
+	{365 * 24 * time.Hour, "2006"},
+}
+
+// timeTicks returns about n round times from start to end, in UTC, and the
+// layout for their labels
+func timeTicks(start, end time.Time, n int) ([]time.Time, string) {
+	span := end.Sub(start)
+	i := 0
+	for i < len(chartTimeSteps)-1 && span/chartTimeSteps[i].step > time.Duration(n) {
+		i++
+	}
+	step := chartTimeSteps[i].step
+
+	ticks := []time.Time{}
+	t := start.UTC().Truncate(step)
+	if t.Before(start) {
+		t = t.Add(step)
+	}
+	for ; !t.After(end); t = t.Add(step) {
+		ticks = append(ticks, t)
+	}
+	return ticks, chartTimeSteps[i].format
+}
+
+//---------------------------------------------------------------------
+
+// svgChart is an SVG document being written
+type svgChart struct {
+	buf    bytes.Buffer
+	colors *chartColors
+}
+
+func (svg *svgChart) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&svg.buf, format, args...)
+}
+
+func (svg *svgChart) text(x, y float64, anchor string, s string) {
+	svg.printf(`<text x="%.1f" y="%.1f" text-anchor="%s" fill="%s">%s</text>`+"\n",
+		x, y, anchor, svg.colors.text, html.EscapeString(s))
+}
+
+// chartPanel is the plotting area of one chart, and the ranges of values
+// its axes show
+type chartPanel struct {
+	x, y, w, h    float64
+	xMin, xMax    float64
+	yMin, yMax    float64
+	yTicks        []float64
+	yTickDecimals int
+}
+
+func (p *chartPanel) px(v float64) float64 {
+	if p.xMax == p.xMin {
+		return p.x + p.w/2
+	}
+	return p.x + (v-p.xMin)/(p.xMax-p.xMin)*p.w
+}
+
+func (p *chartPanel) py(v float64) float64 {
+	return p.y + p.h - (v-p.yMin)/(p.yMax-p.yMin)*p.h
+}
+
+// newChartPanel makes a panel in the box, leaving room for the title and
+// the axis labels, with a y axis that shows all the values
+func newChartPanel(x, y, w, h float64, values []float64, withZero bool) *chartPanel {
+	p := &chartPanel{x: x + 60, y: y + 30, w: w - 80, h: h - 70}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	if len(values) == 0 {
+		lo, hi = 0, 1
+	}
+	if withZero {
+		lo = math.Min(lo, 0)
+		hi = math.Max(hi, 0)
+	}
+	p.yTicks, p.yTickDecimals = niceTicks(lo, hi, 5)
+	p.yMin = p.yTicks[0]
+	p.yMax = p.yTicks[len(p.yTicks)-1]
+	return p
+}
+
+// frame draws the title, the y axis with its grid lines and label, and the
+// x axis label
+func (svg *svgChart) frame(p *chartPanel, title string, xLabel string, yLabel string) {
+	svg.text(p.x+p.w/2, p.y-12, "middle", title)
+
+	for _, v := range p.yTicks {
+		y := p.py(v)
+		svg.printf(`<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n",
+			p.x, y, p.x+p.w, y, svg.colors.grid)
+		svg.text(p.x-6, y+4, "end", strconv.FormatFloat(v, 'f', p.yTickDecimals, 64))
+	}
+	svg.printf(`<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n",
+		p.x, p.y+p.h, p.x+p.w, p.y+p.h, svg.colors.text)
+
+	svg.text(p.x+p.w/2, p.y+p.h+34, "middle", xLabel)
+	svg.printf(`<text transform="translate(%.1f,%.1f) rotate(-90)" text-anchor="middle" fill="%s">%s</text>`+"\n",
+		p.x-46, p.y+p.h/2, svg.colors.text, html.EscapeString(yLabel))
+}
+
+func (svg *svgChart) noData(p *chartPanel) {
+	svg.text(p.x+p.w/2, p.y+p.h/2, "middle", "no data")
+}
+
+// timeChart draws the date histogram, as a line or an area; buckets with
+// no data break the line
+func (svg *svgChart) timeChart(x, y, w, h float64, metric *Metric, report *FullReport, req *ChartRequest) {
+	buckets := report.DateHistReport.Buckets
+
+	values := []float64{}
+	for i := range buckets {
+		if v, ok := chartBucketValue(&buckets[i].BucketStats, req.Value); ok {
+			values = append(values, v)
+		}
+	}
+	p := newChartPanel(x, y, w, h, values, req.Style == ChartStyleArea || req.Value == "count")
+
+	start, end := req.Start, req.End
+	if len(buckets) > 0 {
+		first := time.Unix(0, int64(buckets[0].Key)*int64(time.Millisecond))
+		last := time.Unix(0, int64(buckets[len(buckets)-1].Key)*int64(time.Millisecond))
+		if first.Before(start) {
+			start = first
+		}
+		if last.After(end) {
+			end = last
+		}
+	}
+	p.xMin = float64(start.UnixNano() / int64(time.Millisecond))
+	p.xMax = float64(end.UnixNano() / int64(time.Millisecond))
+
+	title := fmt.Sprintf("%s: %s per %s", metric.Name, req.Value, req.DateInterval)
+	svg.frame(p, title, "time (UTC)", chartUnits(metric, req.Value))
+
+	ticks, layout := timeTicks(start, end, int(p.w/100))
+	for _, t := range ticks {
+		px := p.px(float64(t.UnixNano() / int64(time.Millisecond)))
+		svg.printf(`<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n",
+			px, p.y+p.h, px, p.y+p.h+4, svg.colors.text)
+		svg.text(px, p.y+p.h+16, "middle", t.Format(layout))
+	}
+
+	if len(values) == 0 {
+		svg.noData(p)
+		return
+	}
+
+	// split into runs of buckets that have data
+	runs := [][][2]float64{}
+	run := [][2]float64{}
+	for i := range buckets {
+		v, ok := chartBucketValue(&buckets[i].BucketStats, req.Value)
+		if !ok {
+			if len(run) > 0 {
+				runs = append(runs, run)
+				run = [][2]float64{}
+			}
+			continue
+		}
+		run = append(run, [2]float64{p.px(buckets[i].Key), p.py(v)})
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+
+	for _, run := range runs {
+		if len(run) == 1 {
+			svg.printf(`<circle cx="%.1f" cy="%.1f" r="2.5" fill="%s"/>`+"\n", run[0][0], run[0][1], svg.colors.line)
+			continue
+		}
+		path := bytes.Buffer{}
+		for i, pt := range run {
+			cmd := "L"
+			if i == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f ", cmd, pt[0], pt[1])
+		}
+		if req.Style == ChartStyleArea {
+			base := p.py(math.Max(p.yMin, math.Min(0, p.yMax)))
+			svg.printf(`<path d="%sL%.1f %.1f L%.1f %.1f Z" fill="%s" stroke="none"/>`+"\n",
+				path.String(), run[len(run)-1][0], base, run[0][0], base, svg.colors.fill)
+		}
+		svg.printf(`<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n",
+			path.String(), svg.colors.line)
+	}
+}
+
+// valueChart draws the value histogram, as a bar for each bucket
+func (svg *svgChart) valueChart(x, y, w, h float64, metric *Metric, report *FullReport, req *ChartRequest) {
+	buckets := report.ValueHistReport.Buckets
+
+	counts := []float64{}
+	for i := range buckets {
+		counts = append(counts, float64(buckets[i].BucketStats.Count))
+	}
+	p := newChartPanel(x, y, w, h, counts, true)
+	p.xMin = 0
+	p.xMax = float64(len(buckets))
+
+	title := fmt.Sprintf("%s: values per %s", metric.Name, req.ValueInterval)
+	units := string(metric.Units)
+	if units == "" {
+		units = "value"
+	}
+	svg.frame(p, title, units, "count")
+
+	if len(buckets) == 0 {
+		svg.noData(p)
+		return
+	}
+
+	// label at most one bucket per 60 pixels
+	every := int(math.Ceil(float64(len(buckets)) * 60 / p.w))
+	width := p.w / float64(len(buckets))
+	for i := range buckets {
+		bx := p.px(float64(i))
+		top := p.py(counts[i])
+		svg.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n",
+			bx+width*0.1, top, width*0.8, p.py(0)-top, svg.colors.bar)
+		if i%every == 0 {
+			svg.text(bx+width/2, p.y+p.h+16, "middle", strconv.FormatFloat(buckets[i].Key, 'g', 6, 64))
+		}
+	}
+}
+
+// chartBucketValue is the statistic of the bucket that is plotted; it is
+// false for a bucket with no data, unless the statistic is the count
+func chartBucketValue(b *BucketStats, name string) (float64, bool) {
+	if b.Count == 0 && name != "count" {
+		return 0, false
+	}
+	return b.aggregate(name)
+}
+
+// chartUnits labels the y axis of the date histogram
+func chartUnits(metric *Metric, value string) string {
+	if value == "count" || metric.Units == "" {
+		return value
+	}
+	return string(metric.Units)
+}
+
+// renderChart returns the SVG chart of the report on the metric
+func renderChart(metric *Metric, report *FullReport, req *ChartRequest) string {
+	svg := &svgChart{colors: chartThemes[req.Theme]}
+	w, h := float64(req.Width), float64(req.Height)
+
+	svg.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" `+
+		`font-family="sans-serif" font-size="11">`+"\n", req.Width, req.Height, req.Width, req.Height)
+	svg.printf(`<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svg.colors.background)
+
+	if report.Tier == RollupTierRaw || report.Tier == "" {
+		top := math.Floor(h * 0.6)
+		svg.timeChart(0, 0, w, top, metric, report, req)
+		svg.valueChart(0, top, w, h-top, metric, report, req)
+	} else {
+		svg.timeChart(0, 0, w, h, metric, report, req)
+	}
+
+	svg.printf("</svg>\n")
+	return svg.buf.String()
+}
@@ -15,7 +15,16 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/gocommon"
 )
@@ -95,23 +104,6 @@ func (c *Client) getObject(endpoint string, out interface{}) error {
 	return err
 }
 
-func (c *Client) getObject2(endpoint string, input interface{}, out interface{}) error {
-
-	h := piazza.Http{BaseUrl: c.url}
-
-	resp := h.PzGet2(endpoint, input)
-	if resp.IsError() {
-		return resp.ToError()
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return resp.ToError()
-	}
-
-	err := resp.ExtractData(out)
-	return err
-}
-
 func (c *Client) postObject(obj interface{}, endpoint string, out interface{}) error {
 	h := piazza.Http{BaseUrl: c.url}
 	resp := h.PzPost(endpoint, obj)
@@ -188,17 +180,151 @@ func (c *Client) GetAllMetrics() (*[]Metric, error) {
 	return out, err
 }
 
+// SearchMetrics returns one page of the Metrics matching the query. A nil
+// format gets the service's default paging. The returned pagination has the
+// total number of matching Metrics.
+func (c *Client) SearchMetrics(q *MetricQuery, format *piazza.JsonPagination) ([]Metric, *piazza.JsonPagination, error) {
+	query := url.Values{}
+	if q.Name != "" {
+		query.Set("name", q.Name)
+	}
+	if q.Namespace != "" {
+		query.Set("namespace", q.Namespace)
+	}
+	if q.Units != "" {
+		query.Set("units", string(q.Units))
+	}
+	if q.Type != "" {
+		query.Set("type", string(q.Type))
+	}
+	if len(q.Labels) > 0 {
+		labels := []string{}
+		for k, v := range q.Labels {
+			labels = append(labels, k+":"+v)
+		}
+		query.Set("label", strings.Join(labels, ","))
+	}
+	if q.Text != "" {
+		query.Set("text", q.Text)
+	}
+	if format != nil {
+		query.Set("page", strconv.Itoa(format.Page))
+		query.Set("perPage", strconv.Itoa(format.PerPage))
+		if format.SortBy != "" {
+			query.Set("sortBy", format.SortBy)
+		}
+		if format.Order != "" {
+			query.Set("order", string(format.Order))
+		}
+	}
+
+	endpoint := "/metric"
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	h := piazza.Http{BaseUrl: c.url}
+	resp := h.PzGet(endpoint)
+	if resp.IsError() {
+		return nil, nil, resp.ToError()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, resp.ToError()
+	}
+
+	metrics := []Metric{}
+	err := resp.ExtractData(&metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metrics, resp.Pagination, nil
+}
+
 func (c *Client) GetMetric(id piazza.Ident) (*Metric, error) {
 	out := &Metric{}
 	err := c.getObject("/metric/"+id.String(), out)
 	return out, err
 }
 
+// GetMetricByName returns the Metric with the name, in the namespace ("" for
+// none).
+func (c *Client) GetMetricByName(namespace string, name string) (*Metric, error) {
+	endpoint := "/metricname/" + url.PathEscape(name)
+	if namespace != "" {
+		endpoint += "?namespace=" + url.QueryEscape(namespace)
+	}
+	out := &Metric{}
+	err := c.getObject(endpoint, out)
+	return out, err
+}
+
+// GetOrCreateMetric returns the Metric with the name, and namespace, of the
+// given one, creating it from the given one if there is none. Instrumented
+// services can call it at every startup.
+func (c *Client) GetOrCreateMetric(metric *Metric) (*Metric, error) {
+	out, err := c.GetMetricByName(metric.Namespace, metric.Name)
+	if err == nil {
+		return out, nil
+	}
+
+	out, err = c.PostMetric(metric)
+	if err == nil {
+		return out, nil
+	}
+
+	// someone else may have just created it
+	return c.GetMetricByName(metric.Namespace, metric.Name)
+}
+
+// UpdateMetric replaces the definition of the Metric, keeping its ID.
+func (c *Client) UpdateMetric(id piazza.Ident, metric *Metric) (*Metric, error) {
+	out := &Metric{}
+	err := c.putObject(metric, "/metric/"+id.String(), out)
+	return out, err
+}
+
+// PatchMetric changes just the fields of the Metric set in the patch.
+func (c *Client) PatchMetric(id piazza.Ident, patch *MetricPatch) (*Metric, error) {
+	h := piazza.Http{BaseUrl: c.url}
+	resp := h.PzPatch("/metric/"+id.String(), patch)
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.ToError()
+	}
+
+	out := &Metric{}
+	err := resp.ExtractData(out)
+	return out, err
+}
+
 func (c *Client) DeleteMetric(id piazza.Ident) error {
 	err := c.deleteObject("/metric/" + id.String())
 	return err
 }
 
+// DeleteMetricCascade deletes the metric and all its data. If there is a lot
+// of data it is deleted in the background, and the returned Job can be polled
+// with GetJob; otherwise the returned Job is nil.
+func (c *Client) DeleteMetricCascade(id piazza.Ident) (*Job, error) {
+	h := piazza.Http{BaseUrl: c.url}
+	resp := h.PzDelete("/metric/" + id.String() + "?cascade=true")
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	if resp.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, resp.ToError()
+	}
+
+	job := &Job{}
+	err := resp.ExtractData(job)
+	return job, err
+}
+
 //---------------------------------------------------------------------
 
 func (c *Client) PostData(data *Data) (*Data, error) {
@@ -207,12 +333,81 @@ func (c *Client) PostData(data *Data) (*Data, error) {
 	return out, err
 }
 
+func (c *Client) PostDataBatch(datas []Data) (*DataBatchResult, error) {
+	out, _, err := c.postDataBatch(datas)
+	return out, err
+}
+
+// postDataBatch is PostDataBatch, but also returns the status code of the
+// response, so that a Reporter can tell a rejected batch from a failed send.
+func (c *Client) postDataBatch(datas []Data) (*DataBatchResult, int, error) {
+	out := &DataBatchResult{}
+
+	h := piazza.Http{BaseUrl: c.url}
+	resp := h.PzPost("/data/batch", datas)
+	if resp.IsError() {
+		return out, resp.StatusCode, resp.ToError()
+	}
+
+	if resp.StatusCode != http.StatusCreated &&
+		resp.StatusCode != http.StatusOK {
+		return out, resp.StatusCode, resp.ToError()
+	}
+
+	err := resp.ExtractData(out)
+	return out, resp.StatusCode, err
+}
+
 func (c *Client) GetData(id piazza.Ident) (*Data, error) {
 	out := &Data{}
 	err := c.getObject("/data/"+id.String(), out)
 	return out, err
 }
 
+// GetDataRange returns one page of the metric's Data with timestamps in
+// [start, end), sorted by timestamp. A zero start or end leaves that end of
+// the range open. A nil format gets the service's default paging. The
+// returned pagination has the total number of Data in the range.
+func (c *Client) GetDataRange(id piazza.Ident, start time.Time, end time.Time,
+	format *piazza.JsonPagination) ([]Data, *piazza.JsonPagination, error) {
+
+	query := url.Values{}
+	if !start.IsZero() {
+		query.Set("start", start.Format(time.RFC3339Nano))
+	}
+	if !end.IsZero() {
+		query.Set("end", end.Format(time.RFC3339Nano))
+	}
+	if format != nil {
+		query.Set("page", strconv.Itoa(format.Page))
+		query.Set("perPage", strconv.Itoa(format.PerPage))
+		if format.Order != "" {
+			query.Set("order", string(format.Order))
+		}
+	}
+
+	endpoint := "/metric/" + id.String() + "/data"
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	h := piazza.Http{BaseUrl: c.url}
+	resp := h.PzGet(endpoint)
+	if resp.IsError() {
+		return nil, nil, resp.ToError()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, resp.ToError()
+	}
+
+	datas := []Data{}
+	err := resp.ExtractData(&datas)
+	if err != nil {
+		return nil, nil, err
+	}
+	return datas, resp.Pagination, nil
+}
+
 func (c *Client) DeleteData(id piazza.Ident) error {
 	err := c.deleteObject("/data/" + id.String())
 	return err
@@ -220,9 +415,207 @@ func (c *Client) DeleteData(id piazza.Ident) error {
 
 //---------------------------------------------------------------------
 
+func (c *Client) PostAlert(rule *AlertRule) (*AlertRule, error) {
+	out := &AlertRule{}
+	err := c.postObject(rule, "/alert", out)
+	return out, err
+}
+
+func (c *Client) GetAllAlerts() (*[]AlertRule, error) {
+	out := &[]AlertRule{}
+	err := c.getObject("/alert", out)
+	return out, err
+}
+
+func (c *Client) GetAlert(id piazza.Ident) (*AlertRule, error) {
+	out := &AlertRule{}
+	err := c.getObject("/alert/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) PutAlert(id piazza.Ident, rule *AlertRule) (*AlertRule, error) {
+	out := &AlertRule{}
+	err := c.putObject(rule, "/alert/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) DeleteAlert(id piazza.Ident) error {
+	err := c.deleteObject("/alert/" + id.String())
+	return err
+}
+
+// GetAlertHistory returns the state changes of the alert rule.
+func (c *Client) GetAlertHistory(id piazza.Ident) (*[]AlertEvent, error) {
+	out := &[]AlertEvent{}
+	err := c.getObject("/alert/"+id.String()+"/history", out)
+	return out, err
+}
+
+//---------------------------------------------------------------------
+
+func (c *Client) PostChannel(channel *NotificationChannel) (*NotificationChannel, error) {
+	out := &NotificationChannel{}
+	err := c.postObject(channel, "/channel", out)
+	return out, err
+}
+
+func (c *Client) GetAllChannels() (*[]NotificationChannel, error) {
+	out := &[]NotificationChannel{}
+	err := c.getObject("/channel", out)
+	return out, err
+}
+
+func (c *Client) GetChannel(id piazza.Ident) (*NotificationChannel, error) {
+	out := &NotificationChannel{}
+	err := c.getObject("/channel/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) DeleteChannel(id piazza.Ident) error {
+	err := c.deleteObject("/channel/" + id.String())
+	return err
+}
+
+// GetChannelDeliveries returns the log of webhooks sent to the channel,
+// newest first.
+func (c *Client) GetChannelDeliveries(id piazza.Ident) (*[]WebhookDelivery, error) {
+	out := &[]WebhookDelivery{}
+	err := c.getObject("/channel/"+id.String()+"/deliveries", out)
+	return out, err
+}
+
+//---------------------------------------------------------------------
+
+func (c *Client) PostDashboard(dashboard *Dashboard) (*Dashboard, error) {
+	out := &Dashboard{}
+	err := c.postObject(dashboard, "/dashboard", out)
+	return out, err
+}
+
+func (c *Client) GetAllDashboards() (*[]Dashboard, error) {
+	out := &[]Dashboard{}
+	err := c.getObject("/dashboard", out)
+	return out, err
+}
+
+func (c *Client) GetDashboard(id piazza.Ident) (*Dashboard, error) {
+	out := &Dashboard{}
+	err := c.getObject("/dashboard/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) PutDashboard(id piazza.Ident, dashboard *Dashboard) (*Dashboard, error) {
+	out := &Dashboard{}
+	err := c.putObject(dashboard, "/dashboard/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) DeleteDashboard(id piazza.Ident) error {
+	err := c.deleteObject("/dashboard/" + id.String())
+	return err
+}
+
+//---------------------------------------------------------------------
+
+func (c *Client) GetJob(id piazza.Ident) (*Job, error) {
+	out := &Job{}
+	err := c.getObject("/job/"+id.String(), out)
+	return out, err
+}
+
+//---------------------------------------------------------------------
+
+func (c *Client) GetRetention() (*RetentionStatus, error) {
+	out := &RetentionStatus{}
+	err := c.getObject("/retention", out)
+	return out, err
+}
+
+// PurgeExpired deletes the expired Data now, instead of waiting for the
+// service's next run.
+func (c *Client) PurgeExpired() (*RetentionRun, error) {
+	out := &RetentionRun{}
+	err := c.postObject(nil, "/retention/purge", out)
+	return out, err
+}
+
+//---------------------------------------------------------------------
+
 func (c *Client) GetReport(id piazza.Ident, req *ReportRequest) (*FullReport, error) {
 	out := &FullReport{}
-	err := c.getObject2("/report/"+id.String(), req, out)
-	//log.Printf("stats2: %#v", out)
+	err := c.postObject(req, "/report/"+id.String(), out)
+	return out, err
+}
+
+// DownloadReportCsv writes the report, as CSV, to w.
+func (c *Client) DownloadReportCsv(id piazza.Ident, req *ReportRequest, w io.Writer) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", c.url+"/report/"+id.String()+"?format=csv", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", piazza.ContentTypeJSON)
+	httpReq.Header.Set("Accept", CsvContentType)
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		jresp := &piazza.JsonResponse{}
+		err = json.NewDecoder(resp.Body).Decode(jresp)
+		if err != nil {
+			return fmt.Errorf("report %s: %s", id, resp.Status)
+		}
+		jresp.StatusCode = resp.StatusCode
+		return jresp.ToError()
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// CompareMetrics returns a report on each of the metrics of the request,
+// with their date histograms aligned.
+func (c *Client) CompareMetrics(req *CompareRequest) (*Comparison, error) {
+	out := &Comparison{}
+	err := c.postObject(req, "/compare", out)
+	return out, err
+}
+
+// GetSeries returns the metric's data downsampled to one value per step.
+func (c *Client) GetSeries(id piazza.Ident, req *SeriesRequest) (*Series, error) {
+	query := url.Values{}
+	query.Set("start", req.Start.Format(time.RFC3339))
+	query.Set("end", req.End.Format(time.RFC3339))
+	query.Set("step", req.Step)
+	if req.Aggregator != "" {
+		query.Set("aggregator", req.Aggregator)
+	}
+	if req.Fill != "" {
+		query.Set("fill", string(req.Fill))
+	}
+	if req.Tier != "" {
+		query.Set("tier", string(req.Tier))
+	}
+
+	out := &Series{}
+	err := c.getObject("/series/"+id.String()+"?"+query.Encode(), out)
+	return out, err
+}
+
+// GetGroupedReport returns one report per value of the req.GroupBy label.
+func (c *Client) GetGroupedReport(id piazza.Ident, req *ReportRequest) (*GroupedReport, error) {
+	if req.GroupBy == "" {
+		return nil, errors.New("GetGroupedReport: no GroupBy label")
+	}
+	out := &GroupedReport{}
+	err := c.postObject(req, "/report/"+id.String(), out)
 	return out, err
 }
@@ -15,7 +15,15 @@
 package metrics
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,13 +40,15 @@ func sleep() {
 type LoggerTester struct {
 	suite.Suite
 
-	sys    *piazza.SystemConfig
-	client *Client
+	sys     *piazza.SystemConfig
+	client  *Client
+	service *Service
 
 	genericServer *piazza.GenericServer
 
 	metricIndex *elasticsearch.Index
 	dataIndex   *elasticsearch.Index
+	rollupIndex *elasticsearch.Index
 }
 
 func (suite *LoggerTester) SetupSuite() {}
@@ -50,24 +60,40 @@ func (suite *LoggerTester) setupFixture() {
 	assert := assert.New(t)
 
 	var required []piazza.ServiceName
-	required = []piazza.ServiceName{piazza.PzElasticSearch}
+	if !InMemoryStorage() {
+		required = []piazza.ServiceName{piazza.PzElasticSearch}
+	}
 	sys, err := piazza.NewSystemConfig(piazza.PzMetrics, required)
 	assert.NoError(err)
 	suite.sys = sys
 
-	metricIndex, err := elasticsearch.NewIndex(sys, "metricstest$", MetricIndexSettings)
-	assert.NoError(err)
-	suite.metricIndex = metricIndex
-	//log.Printf("New index: %s", metricIndex.IndexName())
+	service := &Service{}
+	suite.service = service
 
-	dataIndex, err := elasticsearch.NewIndex(sys, "datastest$", DataIndexSettings)
-	assert.NoError(err)
-	suite.dataIndex = dataIndex
-	//log.Printf("New index: %s", dataIndex.IndexName())
+	if InMemoryStorage() {
+		err = service.InitInMemory(sys)
+		assert.NoError(err)
+	} else {
+		metricIndex, err := elasticsearch.NewIndex(sys, "metricstest$", MetricIndexSettings)
+		assert.NoError(err)
+		suite.metricIndex = metricIndex
+		//log.Printf("New index: %s", metricIndex.IndexName())
 
-	service := &Service{}
-	err = service.Init(sys, metricIndex, dataIndex)
-	assert.NoError(err)
+		dataIndex, err := elasticsearch.NewIndex(sys, "datastest$", DataIndexSettings)
+		assert.NoError(err)
+		suite.dataIndex = dataIndex
+		//log.Printf("New index: %s", dataIndex.IndexName())
+
+		err = service.Init(sys, metricIndex, dataIndex)
+		assert.NoError(err)
+
+		rollupIndex, err := elasticsearch.NewIndex(sys, "rollupstest$", RollupIndexSettings)
+		assert.NoError(err)
+		suite.rollupIndex = rollupIndex
+
+		err = service.InitRollups(rollupIndex)
+		assert.NoError(err)
+	}
 
 	server := &Server{}
 	server.Init(service)
@@ -96,6 +122,10 @@ func (suite *LoggerTester) teardownFixture() {
 		panic(err)
 	}
 
+	if InMemoryStorage() {
+		return
+	}
+
 	err = suite.metricIndex.Close()
 	if err != nil {
 		panic(err)
@@ -106,6 +136,11 @@ func (suite *LoggerTester) teardownFixture() {
 		panic(err)
 	}
 
+	err = suite.service.dataDB.(*DataDB).DropPartitions()
+	if err != nil {
+		panic(err)
+	}
+
 	err = suite.dataIndex.Close()
 	if err != nil {
 		panic(err)
@@ -115,6 +150,27 @@ func (suite *LoggerTester) teardownFixture() {
 	if err != nil {
 		panic(err)
 	}
+
+	err = suite.rollupIndex.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	err = suite.rollupIndex.Delete()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (suite *LoggerTester) newMetric(name string) piazza.Ident {
+	metric := &Metric{
+		Name:        name,
+		Description: "test metric " + name,
+		Units:       UnitCount,
+	}
+	resp, err := suite.client.PostMetric(metric)
+	assert.NoError(suite.T(), err)
+	return resp.ID
 }
 
 func now() string {
@@ -130,6 +186,10 @@ func (suite *LoggerTester) Test00DirectAccess() {
 	t := suite.T()
 	assert := assert.New(t)
 
+	if InMemoryStorage() {
+		t.Skip("no Elasticsearch when using in-memory storage")
+	}
+
 	suite.setupFixture()
 	defer suite.teardownFixture()
 
@@ -190,6 +250,16 @@ func (suite *LoggerTester) Test02Data() {
 	_, err = client.GetData("badid")
 	assert.Error(err)
 
+	// no metric
+	_, err = client.PostData(&data)
+	assert.Error(err)
+
+	// unknown metric
+	data.MetricID = "badid"
+	_, err = client.PostData(&data)
+	assert.Error(err)
+
+	data.MetricID = suite.newMetric("MyCounterData")
 	resp, err := client.PostData(&data)
 	assert.NoError(err)
 
@@ -314,3 +384,1459 @@ func (suite *LoggerTester) Test03Report() {
 
 	log.Printf("%s", report)
 }
+
+func (suite *LoggerTester) Test04DataBatch() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyCounterBatch")
+
+	datas := []Data{
+		{MetricID: metricID, Value: 1, Timestamp: now()},
+		{MetricID: metricID, Value: 2, Timestamp: "not a time"},
+		{MetricID: metricID, Value: 3, Timestamp: now()},
+		{MetricID: "badid", Value: 4, Timestamp: now()},
+	}
+
+	result, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	assert.Equal(2, result.Created)
+	assert.Equal(2, result.Failed)
+	assert.Len(result.Items, 4)
+	assert.Equal(http.StatusCreated, result.Items[0].StatusCode)
+	assert.NotEqual(http.StatusCreated, result.Items[1].StatusCode)
+	assert.NotEmpty(result.Items[1].Message)
+	assert.Equal(http.StatusCreated, result.Items[2].StatusCode)
+	assert.Equal(http.StatusBadRequest, result.Items[3].StatusCode)
+
+	sleep()
+
+	data, err := client.GetData(result.Items[2].ID)
+	assert.NoError(err)
+	assert.EqualValues(3, data.Value)
+
+	// a Data already stored is not written over
+	data.Value = 30
+	errs, err := suite.service.dataDB.PostDataBatch([]Data{*data})
+	assert.NoError(err)
+	if assert.Len(errs, 1) {
+		assert.Error(errs[0])
+	}
+	data, err = client.GetData(result.Items[2].ID)
+	assert.NoError(err)
+	assert.EqualValues(3, data.Value)
+
+	_, err = client.PostDataBatch([]Data{})
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test05Reporter() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	metricID := suite.newMetric("MyCounterReporter")
+
+	config := &ReporterConfig{BatchSize: 10, FlushInterval: time.Hour}
+	reporter, err := NewReporter(suite.client, config)
+	assert.NoError(err)
+
+	for i := 0; i < 25; i++ {
+		data := Data{MetricID: metricID, Value: float64(i), Timestamp: now()}
+		err = reporter.PostData(&data)
+		assert.NoError(err)
+	}
+
+	err = reporter.Flush()
+	assert.NoError(err)
+	assert.EqualValues(25, reporter.Stats().Sent)
+
+	err = reporter.Close()
+	assert.NoError(err)
+
+	err = reporter.PostData(&Data{Value: 1, Timestamp: now()})
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test06ReporterOverflow() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	// nothing is listening here, so every send fails
+	client, err := NewClient2("http://localhost:1")
+	assert.NoError(err)
+
+	config := &ReporterConfig{
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+		QueueSize:     5,
+		Overflow:      OverflowDropNewest,
+		MaxRetries:    -1,
+	}
+	reporter, err := NewReporter(client, config)
+	assert.NoError(err)
+
+	for i := 0; i < 8; i++ {
+		err = reporter.PostData(&Data{Value: float64(i), Timestamp: now()})
+		assert.NoError(err)
+	}
+	assert.EqualValues(3, reporter.Stats().Dropped)
+
+	err = reporter.Flush()
+	assert.Error(err)
+
+	err = reporter.Close()
+	assert.Error(err)
+	assert.EqualValues(0, reporter.Stats().Sent)
+	assert.EqualValues(8, reporter.Stats().Dropped)
+}
+
+func (suite *LoggerTester) Test07AutoCreateMetric() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	data := Data{
+		MetricID:  "MyAutoCounter",
+		Value:     17,
+		Timestamp: now(),
+	}
+
+	_, err := client.PostData(&data)
+	assert.Error(err)
+
+	suite.service.SetAutoCreateMetrics(true)
+
+	_, err = client.PostData(&data)
+	assert.NoError(err)
+
+	sleep()
+
+	metric, err := client.GetMetric("MyAutoCounter")
+	assert.NoError(err)
+	assert.EqualValues("MyAutoCounter", metric.ID)
+
+	_, err = client.PostData(&data)
+	assert.NoError(err)
+}
+
+func (suite *LoggerTester) Test08CascadeDelete() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	post := func(metricID piazza.Ident, n int) []DataBatchItem {
+		datas := make([]Data, n)
+		for i := range datas {
+			datas[i] = Data{MetricID: metricID, Value: float64(i), Timestamp: now()}
+		}
+		result, err := client.PostDataBatch(datas)
+		assert.NoError(err)
+		assert.Equal(n, result.Created)
+		return result.Items
+	}
+
+	// a few points: deleted right away
+	{
+		metricID := suite.newMetric("MyCounterCascade1")
+		items := post(metricID, 5)
+
+		sleep()
+
+		err := client.DeleteMetric(metricID)
+		assert.Error(err)
+
+		job, err := client.DeleteMetricCascade(metricID)
+		assert.NoError(err)
+		assert.Nil(job)
+
+		sleep()
+
+		_, err = client.GetMetric(metricID)
+		assert.Error(err)
+		_, err = client.GetData(items[0].ID)
+		assert.Error(err)
+	}
+
+	// lots of points: deleted by a job
+	{
+		metricID := suite.newMetric("MyCounterCascade2")
+		items := post(metricID, deleteJobThreshold+500)
+
+		sleep()
+
+		job, err := client.DeleteMetricCascade(metricID)
+		assert.NoError(err)
+		assert.NotNil(job)
+		assert.EqualValues(deleteJobThreshold+500, job.Total)
+
+		for i := 0; i < 30 && job.Status == JobStatusRunning; i++ {
+			sleep()
+			job, err = client.GetJob(job.ID)
+			assert.NoError(err)
+		}
+		assert.Equal(JobStatusSucceeded, job.Status)
+		assert.EqualValues(deleteJobThreshold+500, job.Done)
+
+		sleep()
+
+		_, err = client.GetData(items[0].ID)
+		assert.Error(err)
+	}
+
+	_, err := client.GetJob("badid")
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test09Labels() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyCounterLabels")
+
+	start := time.Now()
+
+	datas := []Data{
+		{MetricID: metricID, Value: 1, Timestamp: now(), Labels: map[string]string{"host": "a", "region": "east"}},
+		{MetricID: metricID, Value: 2, Timestamp: now(), Labels: map[string]string{"host": "a", "region": "west"}},
+		{MetricID: metricID, Value: 3, Timestamp: now(), Labels: map[string]string{"host": "b", "region": "east"}},
+		{MetricID: metricID, Value: 4, Timestamp: now()},
+		{MetricID: metricID, Value: 5, Timestamp: now(), Labels: map[string]string{"bad.name": "x"}},
+	}
+	result, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	assert.Equal(4, result.Created)
+	assert.Equal(http.StatusBadRequest, result.Items[4].StatusCode)
+
+	stop := time.Now()
+	sleep()
+
+	req := &ReportRequest{
+		Start:         start.Add(-1 * time.Second),
+		End:           stop.Add(1 * time.Second),
+		DateInterval:  "1s",
+		ValueInterval: "1",
+	}
+
+	report, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(4, report.StatsReport.Count)
+
+	req.Labels = map[string]string{"host": "a"}
+	report, err = client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(2, report.StatsReport.Count)
+	assert.EqualValues(3, report.StatsReport.Sum)
+
+	req.Labels = map[string]string{"region": "east"}
+	req.GroupBy = "host"
+	req.Tier = RollupTierAuto
+	grouped, err := client.GetGroupedReport(metricID, req)
+	assert.NoError(err)
+	assert.Equal("host", grouped.GroupBy)
+	assert.Equal(RollupTierRaw, grouped.Tier)
+	assert.Len(grouped.Groups, 2)
+	if len(grouped.Groups) == 2 {
+		assert.Equal("a", grouped.Groups[0].Value)
+		assert.EqualValues(1, grouped.Groups[0].Report.StatsReport.Count)
+		assert.Equal("b", grouped.Groups[1].Value)
+		assert.EqualValues(3, grouped.Groups[1].Report.StatsReport.Sum)
+	}
+}
+
+func (suite *LoggerTester) Test10Statsd() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	statsd, err := NewStatsdListener(suite.service, "127.0.0.1:0", time.Hour)
+	assert.NoError(err)
+
+	conn, err := net.Dial("udp", statsd.Address())
+	assert.NoError(err)
+	defer conn.Close()
+
+	start := time.Now()
+
+	_, err = conn.Write([]byte("test.requests:1|c|@0.5\ntest.requests:2|c\ntest.latency:320|ms\nnot a line"))
+	assert.NoError(err)
+	_, err = conn.Write([]byte("test.depth:5|g\ntest.depth:+3|g\ntest.users:alice|s\ntest.users:bob|s"))
+	assert.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+	err = statsd.Close()
+	assert.NoError(err)
+	assert.EqualValues(1, statsd.BadLines())
+
+	stop := time.Now()
+	sleep()
+
+	metric, err := client.GetMetric("statsd:timer:test.latency")
+	assert.NoError(err)
+	assert.Equal("test.latency", metric.Name)
+	assert.Equal(UnitMilliseconds, metric.Units)
+
+	req := &ReportRequest{
+		Start:         start.Add(-1 * time.Second),
+		End:           stop.Add(1 * time.Second),
+		DateInterval:  "1s",
+		ValueInterval: "1",
+	}
+
+	expected := map[piazza.Ident]float64{
+		"statsd:counter:test.requests": 4,
+		"statsd:timer:test.latency":    320,
+		"statsd:gauge:test.depth":      8,
+		"statsd:set:test.users":        2,
+	}
+	for id, sum := range expected {
+		report, err := client.GetReport(id, req)
+		assert.NoError(err)
+		assert.EqualValues(sum, report.StatsReport.Sum, id.String())
+	}
+}
+
+func (suite *LoggerTester) Test11Prometheus() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	metric := &Metric{
+		Name:        "my.latency",
+		Description: "my latency metric",
+		Units:       UnitMilliseconds,
+	}
+	resp, err := suite.client.PostMetric(metric)
+	assert.NoError(err)
+	metricID := resp.ID
+
+	for _, v := range []float64{10, 20, 60} {
+		_, err = suite.client.PostData(&Data{MetricID: metricID, Value: v, Timestamp: now()})
+		assert.NoError(err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sleep()
+
+	get := func(query string) string {
+		resp, err := http.Get(suite.client.url + "/prometheus" + query)
+		assert.NoError(err)
+		defer resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		return string(body)
+	}
+
+	sample := `pzmetrics_my_latency_milliseconds{metric_id="` + metricID.String() + `"} `
+
+	text := get("")
+	assert.Contains(text, "# HELP pzmetrics_my_latency_milliseconds my latency metric\n")
+	assert.Contains(text, "# TYPE pzmetrics_my_latency_milliseconds gauge\n")
+	assert.Contains(text, sample+"60\n")
+
+	text = get("?aggregate=avg&window=1h")
+	assert.Contains(text, sample+"30\n")
+
+	resp2, err := http.Get(suite.client.url + "/prometheus?aggregate=bogus")
+	assert.NoError(err)
+	resp2.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp2.StatusCode)
+}
+
+func (suite *LoggerTester) Test12MetricTypes() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	_, err := client.PostMetric(&Metric{Name: "MyBadType", Type: "bogus"})
+	assert.Error(err)
+
+	resp, err := client.PostMetric(&Metric{Name: "MyGauge"})
+	assert.NoError(err)
+	assert.Equal(MetricTypeGauge, resp.Type)
+
+	resp, err = client.PostMetric(&Metric{Name: "MyCounter", Units: UnitCount, Type: MetricTypeCounter})
+	assert.NoError(err)
+	metricID := resp.ID
+
+	// the counter is reset between the third and fourth points
+	base := time.Now().Add(-1 * time.Minute).Truncate(time.Second)
+	datas := []Data{}
+	for i, v := range []float64{0, 10, 20, 5, 15} {
+		datas = append(datas, Data{
+			MetricID:  metricID,
+			Value:     v,
+			Timestamp: base.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+		})
+	}
+	result, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	assert.Equal(5, result.Created)
+
+	sleep()
+
+	req := &ReportRequest{
+		Start:         base,
+		End:           base.Add(10 * time.Second),
+		DateInterval:  "10s",
+		ValueInterval: "10",
+	}
+	report, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.Equal(MetricTypeCounter, report.Type)
+	assert.NotNil(report.RateReport)
+	if report.RateReport != nil {
+		assert.EqualValues(35, report.RateReport.Increase)
+		assert.EqualValues(1, report.RateReport.Resets)
+		assert.EqualValues(8.75, report.RateReport.PerSecond)
+	}
+	var increase float64
+	for _, bucket := range report.DateHistReport.Buckets {
+		assert.NotNil(bucket.Rate)
+		if bucket.Rate != nil {
+			increase += bucket.Rate.Increase
+		}
+	}
+	assert.EqualValues(35, increase)
+
+	resp, err = client.PostMetric(&Metric{Name: "MyTimer", Units: UnitMilliseconds, Type: MetricTypeTimer})
+	assert.NoError(err)
+	report, err = client.GetReport(resp.ID, req)
+	assert.NoError(err)
+	assert.Equal(MetricTypeTimer, report.Type)
+	assert.Nil(report.RateReport)
+	assert.True(strings.Index(report.String(), "PERCENTILES") < strings.Index(report.String(), "STATISTICS"))
+}
+
+func (suite *LoggerTester) Test13DataRange() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyDataRange")
+
+	base := time.Now().Add(-1 * time.Minute).Truncate(time.Second)
+	datas := []Data{}
+	for i := 0; i < 5; i++ {
+		datas = append(datas, Data{
+			MetricID:  metricID,
+			Value:     float64(i),
+			Timestamp: base.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+		})
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+
+	sleep()
+
+	format := &piazza.JsonPagination{PerPage: 10, Order: piazza.PaginationOrderAscending}
+	got, pagination, err := client.GetDataRange(metricID, base.Add(1*time.Second), base.Add(4*time.Second), format)
+	assert.NoError(err)
+	assert.Equal(3, pagination.Count)
+	assert.Len(got, 3)
+	if len(got) == 3 {
+		assert.EqualValues(1, got[0].Value)
+		assert.EqualValues(3, got[2].Value)
+	}
+
+	format = &piazza.JsonPagination{PerPage: 2, Page: 1, Order: piazza.PaginationOrderDescending}
+	got, pagination, err = client.GetDataRange(metricID, time.Time{}, time.Time{}, format)
+	assert.NoError(err)
+	assert.Equal(5, pagination.Count)
+	assert.Len(got, 2)
+	if len(got) == 2 {
+		assert.EqualValues(2, got[0].Value)
+		assert.EqualValues(1, got[1].Value)
+	}
+
+	_, _, err = client.GetDataRange("nosuchmetric", time.Time{}, time.Time{}, nil)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test14Series() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MySeries")
+
+	// two points in the first 10s step, none in the second, one in the third
+	base := time.Now().Add(-1 * time.Hour).Truncate(time.Minute)
+	datas := []Data{}
+	for i, offset := range []int{1, 2, 25} {
+		datas = append(datas, Data{
+			MetricID:  metricID,
+			Value:     float64(10 * (i + 1)),
+			Timestamp: base.Add(time.Duration(offset) * time.Second).Format(time.RFC3339),
+		})
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+
+	sleep()
+
+	req := &SeriesRequest{Start: base, End: base.Add(30 * time.Second), Step: "10s"}
+	series, err := client.GetSeries(metricID, req)
+	assert.NoError(err)
+	assert.Equal("avg", series.Aggregator)
+	assert.Len(series.Points, 3)
+	if len(series.Points) == 3 {
+		assert.Equal(base.UnixNano()/int64(time.Millisecond), series.Points[0].Timestamp)
+		assert.EqualValues(15, *series.Points[0].Value)
+		assert.Nil(series.Points[1].Value)
+		assert.EqualValues(30, *series.Points[2].Value)
+	}
+
+	req.Aggregator = "last"
+	req.Fill = SeriesFillPrevious
+	series, err = client.GetSeries(metricID, req)
+	assert.NoError(err)
+	if len(series.Points) == 3 {
+		assert.EqualValues(20, *series.Points[0].Value)
+		assert.EqualValues(20, *series.Points[1].Value)
+	}
+
+	req.Aggregator = "count"
+	req.Fill = SeriesFillNull
+	series, err = client.GetSeries(metricID, req)
+	assert.NoError(err)
+	if len(series.Points) == 3 {
+		assert.EqualValues(0, *series.Points[1].Value)
+	}
+
+	req.Aggregator = "p200"
+	_, err = client.GetSeries(metricID, req)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test15Alerts() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyAlerted")
+
+	base := time.Now().Add(-1 * time.Hour).Truncate(time.Minute)
+	_, err := client.PostData(&Data{MetricID: metricID, Value: 300, Timestamp: base.Format(time.RFC3339)})
+	assert.NoError(err)
+
+	sleep()
+
+	_, err = client.PostAlert(&AlertRule{Name: "bad", MetricID: metricID, Aggregate: "median", Window: "5m", Comparison: ">"})
+	assert.Error(err)
+
+	rule, err := client.PostAlert(&AlertRule{
+		Name:       "too high",
+		MetricID:   metricID,
+		Aggregate:  "avg",
+		Window:     "5m",
+		Comparison: ">",
+		Threshold:  200,
+		For:        "2m",
+	})
+	assert.NoError(err)
+	assert.Equal(AlertStateInactive, rule.State)
+
+	sleep()
+
+	// pending at 1m, still pending at 2m, firing at 4m, and resolved at 10m
+	// when the data has gone out of the window
+	for _, minutes := range []int{1, 2} {
+		assert.NoError(suite.service.evaluateAlerts(base.Add(time.Duration(minutes) * time.Minute)))
+		sleep()
+		rule, err = client.GetAlert(rule.ID)
+		assert.NoError(err)
+		assert.Equal(AlertStatePending, rule.State)
+	}
+	assert.NoError(suite.service.evaluateAlerts(base.Add(4 * time.Minute)))
+	sleep()
+	rule, err = client.GetAlert(rule.ID)
+	assert.NoError(err)
+	assert.Equal(AlertStateFiring, rule.State)
+	assert.EqualValues(300, *rule.Value)
+
+	assert.NoError(suite.service.evaluateAlerts(base.Add(10 * time.Minute)))
+	sleep()
+	rule, err = client.GetAlert(rule.ID)
+	assert.NoError(err)
+	assert.Equal(AlertStateResolved, rule.State)
+
+	history, err := client.GetAlertHistory(rule.ID)
+	assert.NoError(err)
+	assert.Len(*history, 3)
+
+	rule.Threshold = 500
+	updated, err := client.PutAlert(rule.ID, rule)
+	assert.NoError(err)
+	assert.EqualValues(500, updated.Threshold)
+	assert.Equal(AlertStateResolved, updated.State)
+
+	assert.NoError(client.DeleteAlert(rule.ID))
+	_, err = client.GetAlert(rule.ID)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test16Webhooks() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	// the receiver fails the first try of each payload
+	payloads := make(chan WebhookPayload, 10)
+	tries := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries++
+		if tries%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		assert.NoError(err)
+		payloads <- payload
+	}))
+	defer receiver.Close()
+
+	assert.NoError(suite.service.SetWebhookConfig(WebhookConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Timeout:        time.Second,
+	}))
+
+	_, err := client.PostChannel(&NotificationChannel{Name: "bad", URL: "ftp://example.com"})
+	assert.Error(err)
+
+	channel, err := client.PostChannel(&NotificationChannel{Name: "hook", URL: receiver.URL})
+	assert.NoError(err)
+
+	metricID := suite.newMetric("MyNotified")
+
+	base := time.Now().Add(-1 * time.Hour).Truncate(time.Minute)
+	_, err = client.PostData(&Data{MetricID: metricID, Value: 300, Timestamp: base.Format(time.RFC3339)})
+	assert.NoError(err)
+
+	rule, err := client.PostAlert(&AlertRule{
+		Name:       "too high",
+		MetricID:   metricID,
+		Aggregate:  "max",
+		Window:     "5m",
+		Comparison: ">",
+		Threshold:  200,
+	})
+	assert.NoError(err)
+
+	sleep()
+
+	// fires at once, as there is no "for", and resolves when the data has
+	// gone out of the window; pending is not sent
+	assert.NoError(suite.service.evaluateAlerts(base.Add(1 * time.Minute)))
+	suite.service.webhooks.wait()
+	firing := <-payloads
+	assert.Equal(AlertStateFiring, firing.State)
+	assert.Equal(rule.ID, firing.Alert.ID)
+	assert.Equal(metricID, firing.Metric.ID)
+	assert.EqualValues(300, *firing.Value)
+
+	sleep()
+
+	assert.NoError(suite.service.evaluateAlerts(base.Add(10 * time.Minute)))
+	suite.service.webhooks.wait()
+	resolved := <-payloads
+	assert.Equal(AlertStateResolved, resolved.State)
+	assert.Nil(resolved.Value)
+
+	deliveries, err := client.GetChannelDeliveries(channel.ID)
+	assert.NoError(err)
+	assert.Len(*deliveries, 2)
+	for _, delivery := range *deliveries {
+		assert.Equal(WebhookDeliverySucceeded, delivery.Status)
+		assert.Len(delivery.Attempts, 2)
+	}
+
+	assert.NoError(client.DeleteChannel(channel.ID))
+	_, err = client.GetChannel(channel.ID)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test17Retention() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	_, err := client.PostMetric(&Metric{Name: "MyBadRetention", Retention: "month"})
+	assert.Error(err)
+
+	kept, err := client.PostMetric(&Metric{Name: "MyRetained", Retention: "2h"})
+	assert.NoError(err)
+	defaulted := suite.newMetric("MyDefaultRetained")
+
+	// one point an hour, for the last 5 hours
+	for h := 0; h < 5; h++ {
+		ts := time.Now().Add(-time.Duration(h)*time.Hour - time.Minute).Format(time.RFC3339)
+		_, err = client.PostData(&Data{MetricID: kept.ID, Value: 1, Timestamp: ts})
+		assert.NoError(err)
+		_, err = client.PostData(&Data{MetricID: defaulted, Value: 1, Timestamp: ts})
+		assert.NoError(err)
+	}
+
+	sleep()
+
+	// with no default, only the metric with its own retention is purged
+	run, err := client.PurgeExpired()
+	assert.NoError(err)
+	assert.Equal(1, run.Metrics)
+	assert.EqualValues(3, run.Deleted)
+
+	assert.NoError(suite.service.SetDefaultRetention("3h"))
+	assert.Error(suite.service.SetDefaultRetention("3 hours"))
+
+	sleep()
+
+	run, err = client.PurgeExpired()
+	assert.NoError(err)
+	assert.Equal(2, run.Metrics)
+	assert.EqualValues(2, run.Deleted)
+
+	status, err := client.GetRetention()
+	assert.NoError(err)
+	assert.Equal("3h", status.Default)
+	assert.EqualValues(5, status.TotalDeleted)
+	assert.Len(status.Runs, 2)
+	assert.EqualValues(2, status.Runs[0].Deleted)
+}
+
+func (suite *LoggerTester) Test18Rollups() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyRolledUp")
+
+	// a point every 10 minutes, for 3 days
+	end := time.Now().Truncate(time.Hour)
+	start := end.Add(-72 * time.Hour)
+	datas := []Data{}
+	for i := 0; i < 72*6; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Minute).Format(time.RFC3339)
+		datas = append(datas, Data{MetricID: metricID, Value: float64(i % 10), Timestamp: ts})
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+
+	sleep()
+
+	assert.NoError(suite.service.rollupAll(end))
+
+	sleep()
+
+	// rollups have no value histogram, so they are only picked when asked
+	req := &ReportRequest{Start: start, End: end, DateInterval: "1d", ValueInterval: "5"}
+	report, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.Equal(RollupTierRaw, report.Tier)
+	assert.NotEmpty(report.ValueHistReport.Buckets)
+
+	req.Tier = RollupTierAuto
+	rolled, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.Equal(RollupTierHour, rolled.Tier)
+
+	req.Tier = RollupTierRaw
+	raw, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.Equal(RollupTierRaw, raw.Tier)
+
+	assert.EqualValues(432, rolled.StatsReport.Count)
+	assert.Equal(raw.StatsReport.Count, rolled.StatsReport.Count)
+	assert.InDelta(raw.StatsReport.Sum, rolled.StatsReport.Sum, 0.001)
+	assert.InDelta(raw.StatsReport.Variance, rolled.StatsReport.Variance, 0.001)
+	assert.Len(rolled.DateHistReport.Buckets, len(raw.DateHistReport.Buckets))
+	assert.Empty(rolled.ValueHistReport.Buckets)
+
+	// rollups can't make buckets smaller than their periods
+	req.Tier = RollupTierHour
+	req.DateInterval = "30m"
+	_, err = client.GetReport(metricID, req)
+	assert.Error(err)
+
+	series, err := client.GetSeries(metricID, &SeriesRequest{Start: start, End: end, Step: "6h", Aggregator: "max"})
+	assert.NoError(err)
+	assert.Equal(RollupTierHour, series.Tier)
+	assert.Len(series.Points, 12)
+	assert.EqualValues(9, *series.Points[0].Value)
+
+	series, err = client.GetSeries(metricID, &SeriesRequest{Start: start, End: end, Step: "6h", Aggregator: "p50"})
+	assert.NoError(err)
+	assert.Equal(RollupTierRaw, series.Tier)
+
+	// Data that come late, to a period long done, are rolled up in the next run
+	_, err = client.PostData(&Data{MetricID: metricID, Value: 100, Timestamp: start.Add(time.Hour).Format(time.RFC3339)})
+	assert.NoError(err)
+
+	sleep()
+
+	assert.NoError(suite.service.rollupAll(end))
+
+	sleep()
+
+	req = &ReportRequest{Start: start, End: end, DateInterval: "1d", ValueInterval: "5", Tier: RollupTierHour}
+	rolled, err = client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(433, rolled.StatsReport.Count)
+}
+
+func (suite *LoggerTester) Test19Partitions() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyPartitioned")
+
+	// one point 100, 70, 40, and 10 days ago, each in a different month
+	today := time.Now()
+	ids := []piazza.Ident{}
+	for _, days := range []int{100, 70, 40, 10} {
+		ts := today.AddDate(0, 0, -days).Format(time.RFC3339)
+		data, err := client.PostData(&Data{MetricID: metricID, Value: float64(days), Timestamp: ts})
+		assert.NoError(err)
+		ids = append(ids, data.ID)
+	}
+
+	sleep()
+
+	// a point is found by ID, whatever its partition
+	data, err := client.GetData(ids[1])
+	assert.NoError(err)
+	assert.EqualValues(70, data.Value)
+
+	req := &ReportRequest{Start: today.AddDate(0, 0, -80), End: today, DateInterval: "week", ValueInterval: "10"}
+	report, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(3, report.StatsReport.Count)
+
+	assert.NoError(client.DeleteData(ids[3]))
+
+	sleep()
+
+	report, err = client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(2, report.StatsReport.Count)
+
+	// with every metric having a retention, old partitions are dropped
+	assert.NoError(suite.service.SetDefaultRetention("50d"))
+	run, err := client.PurgeExpired()
+	assert.NoError(err)
+	assert.EqualValues(2, run.Deleted)
+	if !InMemoryStorage() {
+		assert.NotEmpty(run.Partitions)
+	}
+
+	sleep()
+
+	req.Start = today.AddDate(0, 0, -200)
+	report, err = client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(1, report.StatsReport.Count)
+}
+
+func (suite *LoggerTester) Test20UpdateMetric() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	_, err := client.PostMetric(&Metric{Name: "MyBadUnits", Units: "Furlongs"})
+	assert.Error(err)
+
+	metric, err := client.PostMetric(&Metric{Name: "MyUpdated", Description: "a typp", Units: UnitCount})
+	assert.NoError(err)
+
+	metric.Description = "a typo"
+	metric.Units = UnitSeconds
+	updated, err := client.UpdateMetric(metric.ID, metric)
+	assert.NoError(err)
+	assert.Equal("a typo", updated.Description)
+	assert.Equal(MetricTypeGauge, updated.Type)
+
+	metric.Units = "Furlongs"
+	_, err = client.UpdateMetric(metric.ID, metric)
+	assert.Error(err)
+
+	_, err = client.UpdateMetric("badid", &Metric{Name: "MyMissing"})
+	assert.Error(err)
+
+	retention := "30d"
+	patched, err := client.PatchMetric(metric.ID, &MetricPatch{Retention: &retention})
+	assert.NoError(err)
+	assert.Equal("30d", patched.Retention)
+	assert.Equal("a typo", patched.Description)
+	assert.Equal(UnitSeconds, patched.Units)
+
+	// once there is data, the type is fixed
+	_, err = client.PostData(&Data{MetricID: metric.ID, Value: 1, Timestamp: now()})
+	assert.NoError(err)
+
+	sleep()
+
+	counter := MetricTypeCounter
+	_, err = client.PatchMetric(metric.ID, &MetricPatch{Type: &counter})
+	assert.Error(err)
+
+	got, err := client.GetMetric(metric.ID)
+	assert.NoError(err)
+	assert.Equal(MetricTypeGauge, got.Type)
+	assert.Equal("30d", got.Retention)
+}
+
+func (suite *LoggerTester) Test21MetricNames() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metric, err := client.PostMetric(&Metric{Name: "MyNamed", Units: UnitCount})
+	assert.NoError(err)
+
+	_, err = client.PostMetric(&Metric{Name: "MyNamed"})
+	assert.Error(err)
+	_, err = client.PostMetric(&Metric{Name: "My/Named"})
+	assert.Error(err)
+
+	// the same name in a namespace is a different metric
+	scoped, err := client.PostMetric(&Metric{Name: "MyNamed", Namespace: "myservice"})
+	assert.NoError(err)
+	assert.NotEqual(metric.ID, scoped.ID)
+
+	found, err := client.GetMetricByName("", "MyNamed")
+	assert.NoError(err)
+	assert.Equal(metric.ID, found.ID)
+
+	found, err = client.GetMetricByName("myservice", "MyNamed")
+	assert.NoError(err)
+	assert.Equal(scoped.ID, found.ID)
+
+	_, err = client.GetMetricByName("", "MyUnnamed")
+	assert.Error(err)
+
+	// renaming onto a name in use fails
+	other := suite.newMetric("MyOtherNamed")
+	name := "MyNamed"
+	_, err = client.PatchMetric(other, &MetricPatch{Name: &name})
+	assert.Error(err)
+
+	// renaming lets the old name be used again
+	name = "MyRenamed"
+	_, err = client.PatchMetric(other, &MetricPatch{Name: &name})
+	assert.NoError(err)
+	_, err = client.PostMetric(&Metric{Name: "MyOtherNamed"})
+	assert.NoError(err)
+
+	// a name taken by another service sharing the storage is in use too
+	owner, err := suite.service.metricDB.ClaimName("", "MyClaimed", piazza.Ident("elsewhere"))
+	assert.NoError(err)
+	assert.Equal(piazza.Ident("elsewhere"), owner)
+	_, err = client.PostMetric(&Metric{Name: "MyClaimed"})
+	assert.Error(err)
+
+	got, err := client.GetOrCreateMetric(&Metric{Name: "MyNamed", Namespace: "myservice"})
+	assert.NoError(err)
+	assert.Equal(scoped.ID, got.ID)
+
+	created, err := client.GetOrCreateMetric(&Metric{Name: "MyNew", Namespace: "myservice"})
+	assert.NoError(err)
+	got, err = client.GetOrCreateMetric(&Metric{Name: "MyNew", Namespace: "myservice"})
+	assert.NoError(err)
+	assert.Equal(created.ID, got.ID)
+}
+
+func (suite *LoggerTester) Test22SearchMetrics() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	for _, metric := range []Metric{
+		{Name: "web.latency", Units: UnitMilliseconds, Type: MetricTypeTimer,
+			Description: "Latency of the web tier", Labels: map[string]string{"team": "web"}},
+		{Name: "web.requests", Units: UnitCount, Type: MetricTypeCounter,
+			Description: "Requests served by the web tier", Labels: map[string]string{"team": "web"}},
+		{Name: "db.size", Units: UnitBytes,
+			Description: "Size of the database", Labels: map[string]string{"team": "data"}},
+	} {
+		_, err := client.PostMetric(&metric)
+		assert.NoError(err)
+		// so that each has a different createdOn, in ES's milliseconds
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sleep()
+
+	names := func(q *MetricQuery, format *piazza.JsonPagination) []string {
+		metrics, _, err := client.SearchMetrics(q, format)
+		assert.NoError(err)
+		result := []string{}
+		for _, metric := range metrics {
+			result = append(result, metric.Name)
+		}
+		return result
+	}
+
+	byName := &piazza.JsonPagination{PerPage: 10, SortBy: "name", Order: piazza.PaginationOrderAscending}
+
+	assert.Equal([]string{"web.latency", "web.requests"}, names(&MetricQuery{Name: "web.*"}, byName))
+	assert.Equal([]string{"db.size"}, names(&MetricQuery{Units: UnitBytes}, byName))
+	assert.Equal([]string{"db.size"}, names(&MetricQuery{Type: MetricTypeGauge}, byName))
+	assert.Equal([]string{"web.latency", "web.requests"}, names(&MetricQuery{Labels: map[string]string{"team": "web"}}, byName))
+	assert.Equal([]string{"web.requests"}, names(&MetricQuery{Text: "served web"}, byName))
+
+	byCreation := &piazza.JsonPagination{PerPage: 10, SortBy: "createdOn", Order: piazza.PaginationOrderDescending}
+	assert.Equal([]string{"db.size", "web.requests", "web.latency"}, names(&MetricQuery{}, byCreation))
+
+	_, _, err := client.SearchMetrics(&MetricQuery{Type: "bogus"}, nil)
+	assert.Error(err)
+	_, _, err = client.SearchMetrics(&MetricQuery{}, &piazza.JsonPagination{PerPage: 10, SortBy: "units"})
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test23ReportCsv() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyGaugeCsv")
+
+	start := time.Now()
+	datas := []Data{
+		{MetricID: metricID, Value: 1, Timestamp: now()},
+		{MetricID: metricID, Value: 2, Timestamp: now()},
+		{MetricID: metricID, Value: 3, Timestamp: now()},
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	stop := time.Now()
+	sleep()
+
+	req := &ReportRequest{
+		Start:         start.Add(-1 * time.Second),
+		End:           stop.Add(1 * time.Second),
+		DateInterval:  "1s",
+		ValueInterval: "1",
+	}
+
+	var buf bytes.Buffer
+	err = client.DownloadReportCsv(metricID, req, &buf)
+	assert.NoError(err)
+
+	// stats, percentiles, date histogram, value histogram
+	tables := strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	assert.Len(tables, 4)
+	if len(tables) != 4 {
+		return
+	}
+	assert.Contains(tables[0], "statistic,value\ncount,3\n")
+	assert.True(strings.HasPrefix(tables[1], "percentile,value\n"))
+	assert.True(strings.HasPrefix(tables[2], "timestamp,count,min,max,avg,sum"))
+	assert.Equal("value,count,min,max,avg,sum\n1,1,1,1,1,1\n2,1,2,2,2,2\n3,1,3,3,3,3", tables[3])
+
+	rows := strings.Split(tables[2], "\n")[1:]
+	assert.NotEmpty(rows)
+	for _, row := range rows {
+		_, err = time.Parse(time.RFC3339, strings.Split(row, ",")[0])
+		assert.NoError(err)
+	}
+
+	req.Labels = map[string]string{"bad.name": "x"}
+	err = client.DownloadReportCsv(metricID, req, &buf)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test24ReportChart() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	metric := &Metric{
+		Name:        "my.chart.latency",
+		Description: "my latency metric",
+		Units:       UnitMilliseconds,
+	}
+	resp, err := suite.client.PostMetric(metric)
+	assert.NoError(err)
+	metricID := resp.ID
+
+	start := time.Now()
+	for _, v := range []float64{10, 20, 60} {
+		_, err = suite.client.PostData(&Data{MetricID: metricID, Value: v, Timestamp: now()})
+		assert.NoError(err)
+	}
+	stop := time.Now()
+
+	sleep()
+
+	query := url.Values{}
+	query.Set("start", start.Add(-1*time.Second).Format(time.RFC3339))
+	query.Set("end", stop.Add(1*time.Second).Format(time.RFC3339))
+	query.Set("dateInterval", "1s")
+	query.Set("valueInterval", "10")
+	query.Set("width", "640")
+	query.Set("theme", "dark")
+	query.Set("style", "area")
+
+	get := func(query url.Values) (int, string) {
+		resp, err := http.Get(suite.client.url + "/report/" + metricID.String() + "/chart.svg?" + query.Encode())
+		assert.NoError(err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, svg := get(query)
+	assert.Equal(http.StatusOK, status)
+	assert.True(strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="640" height="400"`))
+	assert.Contains(svg, ">Milliseconds</text>")
+	assert.Contains(svg, `fill="#1e1e1e"`)
+	assert.Contains(svg, "<rect x=")
+
+	query.Set("theme", "bogus")
+	status, _ = get(query)
+	assert.Equal(http.StatusBadRequest, status)
+
+	// values so large that the step between ticks is lost in adding it
+	resp, err = suite.client.PostMetric(&Metric{Name: "my.chart.timestamps", Units: UnitCount})
+	assert.NoError(err)
+	metricID = resp.ID
+	for _, v := range []float64{1e17, 1e17 + 16} {
+		_, err = suite.client.PostData(&Data{MetricID: metricID, Value: v, Timestamp: now()})
+		assert.NoError(err)
+	}
+
+	sleep()
+
+	query.Set("theme", "light")
+	query.Set("end", time.Now().Add(1*time.Second).Format(time.RFC3339))
+	status, _ = get(query)
+	assert.Equal(http.StatusOK, status)
+}
+
+func (suite *LoggerTester) Test25Dashboards() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyDashboarded")
+
+	_, err := client.PostDashboard(&Dashboard{Name: "ops", Panels: []DashboardPanel{{MetricID: "nosuchmetric"}}})
+	assert.Error(err)
+	_, err = client.PostDashboard(&Dashboard{Name: "ops", Range: "month"})
+	assert.Error(err)
+
+	dashboard, err := client.PostDashboard(&Dashboard{
+		Name:   "ops",
+		Panels: []DashboardPanel{{MetricID: metricID, Aggregator: "p95", Width: 6}},
+	})
+	assert.NoError(err)
+	assert.Equal("24h", dashboard.Range)
+
+	sleep()
+
+	dashboards, err := client.GetAllDashboards()
+	assert.NoError(err)
+	assert.Len(*dashboards, 1)
+
+	dashboard.Range = "7d"
+	dashboard.Panels = append(dashboard.Panels, DashboardPanel{MetricID: metricID, Step: "1h"})
+	_, err = client.PutDashboard(dashboard.ID, dashboard)
+	assert.NoError(err)
+
+	sleep()
+
+	got, err := client.GetDashboard(dashboard.ID)
+	assert.NoError(err)
+	assert.Equal("7d", got.Range)
+	assert.Len(got.Panels, 2)
+
+	resp, err := http.Get(suite.client.url + "/ui")
+	assert.NoError(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Contains(string(body), "<title>pz-metrics</title>")
+
+	assert.NoError(client.DeleteDashboard(dashboard.ID))
+	_, err = client.GetDashboard(dashboard.ID)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test26ReportPercentiles() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyGaugePercs")
+
+	start := time.Now()
+	datas := []Data{}
+	for i := 1; i <= 10; i++ {
+		datas = append(datas, Data{MetricID: metricID, Value: float64(i * 100), Timestamp: now()})
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	stop := time.Now()
+	sleep()
+
+	req := &ReportRequest{
+		Start:           start.Add(-1 * time.Second),
+		End:             stop.Add(1 * time.Second),
+		DateInterval:    "1s",
+		ValueInterval:   "100",
+		Percentiles:     []float64{50, 99.9},
+		PercentileRanks: []float64{300, 5000},
+	}
+	report, err := client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.Len(report.PercsReport.Values, 2)
+	assert.Contains(report.PercsReport.Values, "50.0")
+	assert.Contains(report.PercsReport.Values, "99.9")
+	// the memory backend counts the Data at or below, for 30, but ES
+	// interpolates between them
+	assert.InDelta(27.5, report.PercsReport.Ranks["300.0"], 5.0)
+	assert.InDelta(100.0, report.PercsReport.Ranks["5000.0"], 0.001)
+
+	req.Percentiles = []float64{150}
+	_, err = client.GetReport(metricID, req)
+	assert.Error(err)
+
+	req.Percentiles = nil
+	req.Tier = RollupTierHour
+	_, err = client.GetReport(metricID, req)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test27ReportQuery() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	metricID := suite.newMetric("MyGaugeQuery")
+
+	start := time.Now()
+	datas := []Data{
+		{MetricID: metricID, Value: 10, Timestamp: now()},
+		{MetricID: metricID, Value: 20, Timestamp: now()},
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	stop := time.Now()
+	sleep()
+
+	query := url.Values{}
+	query.Set("start", start.Add(-1*time.Second).Format(time.RFC3339))
+	query.Set("end", stop.Add(1*time.Second).Format(time.RFC3339))
+	query.Set("dateInterval", "1s")
+	query.Set("valueInterval", "10")
+
+	get := func(id piazza.Ident, query url.Values) (int, *piazza.JsonResponse) {
+		resp, err := http.Get(suite.client.url + "/report/" + id.String() + "?" + query.Encode())
+		assert.NoError(err)
+		defer resp.Body.Close()
+		jresp := &piazza.JsonResponse{}
+		assert.NoError(json.NewDecoder(resp.Body).Decode(jresp))
+		return resp.StatusCode, jresp
+	}
+
+	status, jresp := get(metricID, query)
+	assert.Equal(http.StatusOK, status)
+	report := &FullReport{}
+	assert.NoError(jresp.ExtractData(report))
+	assert.EqualValues(2, report.StatsReport.Count)
+
+	status, _ = get("nosuchmetric", query)
+	assert.Equal(http.StatusNotFound, status)
+
+	bad := url.Values{}
+	for k, v := range query {
+		bad[k] = v
+	}
+	bad.Set("dateInterval", "fortnight")
+	status, _ = get(metricID, bad)
+	assert.Equal(http.StatusBadRequest, status)
+
+	bad.Set("dateInterval", "1s")
+	bad.Set("valueInterval", "-5")
+	status, _ = get(metricID, bad)
+	assert.Equal(http.StatusBadRequest, status)
+
+	bad.Set("valueInterval", "10")
+	bad.Set("start", query.Get("end"))
+	bad.Set("end", query.Get("start"))
+	status, _ = get(metricID, bad)
+	assert.Equal(http.StatusBadRequest, status)
+
+	// the client POSTs the request
+	req := &ReportRequest{Start: start.Add(-1 * time.Second), End: stop.Add(1 * time.Second),
+		DateInterval: "1s", ValueInterval: "10"}
+	report, err = client.GetReport(metricID, req)
+	assert.NoError(err)
+	assert.EqualValues(30, report.StatsReport.Sum)
+
+	req.Start, req.End = req.End, req.Start
+	_, err = client.GetReport(metricID, req)
+	assert.Error(err)
+}
+
+func (suite *LoggerTester) Test28CompareMetrics() {
+	t := suite.T()
+	assert := assert.New(t)
+
+	suite.setupFixture()
+	defer suite.teardownFixture()
+
+	client := suite.client
+
+	ids := []piazza.Ident{}
+	for _, version := range []string{"1.0", "2.0"} {
+		resp, err := client.PostMetric(&Metric{
+			Name:   "job.latency." + version,
+			Units:  UnitMilliseconds,
+			Labels: map[string]string{"job": "ingest", "version": version},
+		})
+		assert.NoError(err)
+		ids = append(ids, resp.ID)
+	}
+	other := suite.newMetric("MyCount")
+
+	start := time.Now()
+	datas := []Data{
+		{MetricID: ids[0], Value: 100, Timestamp: now()},
+		{MetricID: ids[0], Value: 300, Timestamp: now()},
+		{MetricID: ids[1], Value: 50, Timestamp: now()},
+	}
+	_, err := client.PostDataBatch(datas)
+	assert.NoError(err)
+	stop := time.Now()
+	sleep()
+
+	req := &CompareRequest{
+		ReportRequest: ReportRequest{
+			Start:         start.Add(-1 * time.Second),
+			End:           stop.Add(1 * time.Second),
+			DateInterval:  "1s",
+			ValueInterval: "100",
+		},
+		Selector: map[string]string{"job": "ingest"},
+	}
+	comparison, err := client.CompareMetrics(req)
+	assert.NoError(err)
+	assert.Len(comparison.Metrics, 2)
+	if len(comparison.Metrics) == 2 {
+		assert.Equal(ids[0], comparison.Metrics[0].MetricID)
+		assert.EqualValues(200, comparison.Metrics[0].StatsReport.Avg)
+		assert.EqualValues(50, comparison.Metrics[1].StatsReport.Avg)
+		for _, metric := range comparison.Metrics {
+			assert.Len(metric.Buckets, len(comparison.Timestamps))
+		}
+	}
+
+	req.Selector = nil
+	req.MetricIDs = []piazza.Ident{ids[1], other}
+	_, err = client.CompareMetrics(req)
+	assert.Error(err)
+
+	req.AllowMixedUnits = true
+	comparison, err = client.CompareMetrics(req)
+	assert.NoError(err)
+	assert.Len(comparison.Metrics, 2)
+
+	req.MetricIDs = []piazza.Ident{ids[0], "nosuchmetric"}
+	_, err = client.CompareMetrics(req)
+	assert.Error(err)
+}
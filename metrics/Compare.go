@@ -0,0 +1,144 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// CompareRequest asks for a report on each of several metrics, over the
+// same range and with the same buckets, so they can be compared: e.g. the
+// latency of a job across versions of a service. The metrics are given by
+// their IDs, or by a selector of labels they must all have.
+type CompareRequest struct {
+	ReportRequest
+
+	MetricIDs []piazza.Ident    `json:"metricIds,omitempty"`
+	Selector  map[string]string `json:"selector,omitempty"` // the Metrics' labels, not the Data's
+
+	// metrics with different units can't usually be compared, so they are
+	// refused unless this is set
+	AllowMixedUnits bool `json:"allowMixedUnits,omitempty"`
+}
+
+// Comparison is returned from POST /compare. Every metric has one bucket
+// for each of the timestamps, empty if it has no data then.
+type Comparison struct {
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+	DateInterval string           `json:"dateInterval"`
+	Timestamps   []int64          `json:"timestamps"` // the start of each bucket, in milliseconds since the epoch
+	Metrics      []ComparedMetric `json:"metrics"`
+}
+
+// ComparedMetric is the report on one metric of a Comparison.
+type ComparedMetric struct {
+	MetricID    piazza.Ident `json:"metricId"`
+	Name        string       `json:"name"`
+	Units       Units        `json:"units"`
+	Type        MetricType   `json:"type"`
+	Tier        RollupTier   `json:"tier"`                  // what the report was made from
+	RateReport  *RateReport  `json:"rate_report,omitempty"` // counters only
+	StatsReport StatsReport  `json:"stats_report"`
+	PercsReport PercsReport  `json:"percs_report"`
+	Buckets     []DateBucket `json:"buckets"`
+}
+
+// the most metrics a comparison may have
+const maxCompareMetrics = 20
+
+func checkCompareRequest(req *CompareRequest) error {
+	if len(req.MetricIDs) == 0 && len(req.Selector) == 0 {
+		return errors.New("no metricIds or selector given")
+	}
+	if len(req.MetricIDs) > 0 && len(req.Selector) > 0 {
+		return errors.New("metricIds and selector can't both be given")
+	}
+	if len(req.MetricIDs) > maxCompareMetrics {
+		return fmt.Errorf("too many metrics: more than %d", maxCompareMetrics)
+	}
+	seen := map[piazza.Ident]bool{}
+	for _, id := range req.MetricIDs {
+		if seen[id] {
+			return fmt.Errorf("metric %s given twice", id)
+		}
+		seen[id] = true
+	}
+	if req.GroupBy != "" {
+		return errors.New("comparisons can't be grouped")
+	}
+	return checkReportRequest(&req.ReportRequest)
+}
+
+// compareTier returns the tier to make every report of the comparison from,
+// as reports made from different tiers don't have the same fields. A tier
+// of auto is only a rollup tier if every metric could use it.
+func (service *Service) compareTier(metrics []Metric, req *ReportRequest) (RollupTier, error) {
+	if req.Tier != RollupTierAuto {
+		return req.Tier, nil
+	}
+	var tier RollupTier
+	for i := range metrics {
+		t, err := service.reportTier(metrics[i].ID, &metrics[i], req)
+		if err != nil {
+			return "", err
+		}
+		if i > 0 && t != tier {
+			return RollupTierRaw, nil
+		}
+		tier = t
+	}
+	return tier, nil
+}
+
+// compareTimestamps returns the start of each bucket of the date histograms,
+// in milliseconds
+func compareTimestamps(req *ReportRequest) []int64 {
+	// the interval was checked with the request
+	interval, _ := parseDateInterval(req.DateInterval)
+	timestamps := []int64{}
+	for t := interval.floor(req.Start); t.Before(req.End); t = interval.next(t) {
+		timestamps = append(timestamps, t.UnixNano()/int64(time.Millisecond))
+	}
+	return timestamps
+}
+
+// alignBuckets lays out the buckets of the report one per timestamp, with an
+// empty bucket for each timestamp the report has none for
+func alignBuckets(report *FullReport, timestamps []int64) []DateBucket {
+	byKey := map[int64]*DateBucket{}
+	for i := range report.DateHistReport.Buckets {
+		b := &report.DateHistReport.Buckets[i]
+		byKey[int64(b.Key)] = b
+	}
+
+	buckets := []DateBucket{}
+	for _, ts := range timestamps {
+		if b, ok := byKey[ts]; ok {
+			buckets = append(buckets, *b)
+			continue
+		}
+		t := time.Unix(0, ts*int64(time.Millisecond)).UTC()
+		buckets = append(buckets, DateBucket{
+			Key:         float64(ts),
+			KeyAsString: t.Format(strictDateTime),
+		})
+	}
+	return buckets
+}
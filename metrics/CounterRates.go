@@ -0,0 +1,100 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// Rates of counter metrics. Neither ES aggregation nor the min and max of a
+// bucket can tell a counter that went down because it was reset (e.g. the
+// process counting restarted), so the rates are worked out here, from the
+// points in time order.
+
+// counterIncrease is how much the counter went up from prev to cur. A drop
+// means the counter was reset to zero in between, and has since counted up
+// to cur.
+func counterIncrease(prev float64, cur float64) (float64, bool) {
+	if cur < prev {
+		return cur, true
+	}
+	return cur - prev, false
+}
+
+// addCounterRates sets the rate report of the whole report and of each of
+// its date buckets. The increase between two points is counted in the
+// bucket of the later point.
+func addCounterRates(report *FullReport, points []memPoint, req *ReportRequest) error {
+	sort.Sort(byMemPointTime(points))
+
+	total := &RateReport{}
+	report.RateReport = total
+
+	buckets := map[int64]*RateReport{}
+	var interval *dateInterval
+	if len(report.DateHistReport.Buckets) > 0 {
+		var err error
+		interval, err = parseDateInterval(req.DateInterval)
+		if err != nil {
+			return err
+		}
+		for i := range report.DateHistReport.Buckets {
+			bucket := &report.DateHistReport.Buckets[i]
+			bucket.Rate = &RateReport{}
+			buckets[int64(bucket.Key)] = bucket.Rate
+		}
+	}
+
+	for i := 1; i < len(points); i++ {
+		increase, reset := counterIncrease(points[i-1].value, points[i].value)
+		total.Increase += increase
+		if reset {
+			total.Resets++
+		}
+
+		if interval == nil {
+			continue
+		}
+		key := interval.floor(points[i].timestamp).UnixNano() / int64(time.Millisecond)
+		if rate, ok := buckets[key]; ok {
+			rate.Increase += increase
+			if reset {
+				rate.Resets++
+			}
+		}
+	}
+
+	if len(points) > 1 {
+		span := points[len(points)-1].timestamp.Sub(points[0].timestamp).Seconds()
+		if span > 0 {
+			total.PerSecond = total.Increase / span
+		}
+	}
+
+	for key, rate := range buckets {
+		start := time.Unix(0, key*int64(time.Millisecond)).UTC()
+		span := interval.next(start).Sub(start).Seconds()
+		rate.PerSecond = rate.Increase / span
+	}
+
+	return nil
+}
+
+type byMemPointTime []memPoint
+
+func (a byMemPointTime) Len() int           { return len(a) }
+func (a byMemPointTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMemPointTime) Less(i, j int) bool { return a[i].timestamp.Before(a[j].timestamp) }
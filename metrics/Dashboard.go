@@ -0,0 +1,87 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// Dashboard is a saved layout of the page at GET /ui: the series of some
+// metrics, over the same range of time up to now.
+type Dashboard struct {
+	ID          piazza.Ident     `json:"id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Range       string           `json:"range"` // how far back the panels go, e.g. "24h" or "7d"
+	Panels      []DashboardPanel `json:"panels"`
+	CreatedOn   time.Time        `json:"createdOn"`
+}
+
+// DashboardPanel is one metric on a dashboard. The step and aggregator are
+// as for a SeriesRequest; if the step is not set, the page picks it from
+// the range.
+type DashboardPanel struct {
+	MetricID   piazza.Ident `json:"metricId"`
+	Title      string       `json:"title,omitempty"`
+	Step       string       `json:"step,omitempty"`
+	Aggregator string       `json:"aggregator,omitempty"`
+	Width      int          `json:"width,omitempty"` // columns of 12, all of them if not set
+}
+
+// the most panels a dashboard may have
+const maxDashboardPanels = 50
+
+func checkDashboard(dashboard *Dashboard) error {
+	if dashboard.Name == "" {
+		return errors.New("dashboard has no name")
+	}
+	if dashboard.Range == "" {
+		dashboard.Range = "24h"
+	}
+	r, err := parseDateInterval(dashboard.Range)
+	if err != nil || r.fixed <= 0 {
+		return fmt.Errorf("invalid range: \"%s\"", dashboard.Range)
+	}
+	if len(dashboard.Panels) > maxDashboardPanels {
+		return fmt.Errorf("too many panels: more than %d", maxDashboardPanels)
+	}
+
+	for i := range dashboard.Panels {
+		panel := &dashboard.Panels[i]
+		if panel.MetricID == piazza.NoIdent {
+			return fmt.Errorf("panel %d has no metricId", i)
+		}
+		if panel.Step != "" {
+			_, err = parseDateInterval(panel.Step)
+			if err != nil {
+				return fmt.Errorf("panel %d: %s", i, err.Error())
+			}
+		}
+		if panel.Aggregator != "" {
+			_, err = parseSeriesAggregator(panel.Aggregator)
+			if err != nil {
+				return fmt.Errorf("panel %d: %s", i, err.Error())
+			}
+		}
+		if panel.Width < 0 || panel.Width > 12 {
+			return fmt.Errorf("panel %d: invalid width: %d", i, panel.Width)
+		}
+	}
+	return nil
+}
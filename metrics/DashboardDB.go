@@ -0,0 +1,176 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// IDashboardDB is the storage interface for Dashboards.
+// DashboardDB is the Elasticsearch-backed implementation; MemDashboardDB
+// keeps them in memory.
+type IDashboardDB interface {
+	PostData(dashboard *Dashboard, id piazza.Ident) (piazza.Ident, error)
+	PutData(dashboard *Dashboard, id piazza.Ident) error
+	GetAll(format *piazza.JsonPagination) ([]Dashboard, int64, error)
+	GetOne(id piazza.Ident) (*Dashboard, bool, error)
+	DeleteByID(id piazza.Ident) (bool, error)
+}
+
+// DashboardDB keeps the dashboards as another type in the metric index.
+type DashboardDB struct {
+	*ResourceDB
+	mapping string
+}
+
+const DashboardDBMapping string = "Dashboard"
+
+const dashboardMapping = `{
+	"Dashboard":{
+		"properties": {
+			"name": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"range": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"panels": {
+				"properties": {
+					"metricId": {
+						"type": "string",
+						"index": "not_analyzed"
+					}
+				}
+			},
+			"createdOn": {
+				"type": "date"
+			}
+		}
+	}
+}`
+
+// NewDashboardDB uses the metric index, which must already exist.
+func NewDashboardDB(service *Service, esi elasticsearch.IIndex) (*DashboardDB, error) {
+	ok, err := esi.TypeExists(DashboardDBMapping)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		err = esi.SetMapping(DashboardDBMapping, piazza.JsonString(dashboardMapping))
+		if err != nil {
+			log.Printf("NewDashboardDB: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	rdb := &ResourceDB{service: service, Esi: esi}
+	db := &DashboardDB{ResourceDB: rdb, mapping: DashboardDBMapping}
+	return db, nil
+}
+
+func (db *DashboardDB) PostData(dashboard *Dashboard, id piazza.Ident) (piazza.Ident, error) {
+	indexResult, err := db.Esi.PostData(db.mapping, id.String(), dashboard)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("DashboardDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return piazza.NoIdent, LoggedError("DashboardDB.PostData failed: not created")
+	}
+
+	return id, nil
+}
+
+func (db *DashboardDB) PutData(dashboard *Dashboard, id piazza.Ident) error {
+	_, err := db.Esi.PutData(db.mapping, id.String(), dashboard)
+	if err != nil {
+		return LoggedError("DashboardDB.PutData failed: %s", err)
+	}
+	return nil
+}
+
+func (db *DashboardDB) GetAll(format *piazza.JsonPagination) ([]Dashboard, int64, error) {
+	dashboards := []Dashboard{}
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return dashboards, 0, err
+	}
+	if !exists {
+		return dashboards, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("DashboardDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("DashboardDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var dashboard Dashboard
+			err := json.Unmarshal(*hit.Source, &dashboard)
+			if err != nil {
+				return nil, 0, err
+			}
+			dashboards = append(dashboards, dashboard)
+		}
+	}
+
+	return dashboards, searchResult.TotalHits(), nil
+}
+
+func (db *DashboardDB) GetOne(id piazza.Ident) (*Dashboard, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("DashboardDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("DashboardDB.GetOne failed: %s no getResult", id.String())
+	}
+	if !getResult.Found {
+		return nil, false, fmt.Errorf("DashboardDB.GetOne failed: %s not found", id.String())
+	}
+
+	var dashboard Dashboard
+	err = json.Unmarshal(*getResult.Source, &dashboard)
+	if err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &dashboard, getResult.Found, nil
+}
+
+func (db *DashboardDB) DeleteByID(id piazza.Ident) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return false, fmt.Errorf("DashboardDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("DashboardDB.DeleteById failed: no deleteResult")
+	}
+	if !deleteResult.Found {
+		return false, fmt.Errorf("DashboardDB.DeleteById failed: not found")
+	}
+
+	return true, nil
+}
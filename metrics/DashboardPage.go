@@ -0,0 +1,430 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// dashboardPage is the page served at GET /ui. It is self-contained, and
+// uses only the REST API: it lists the metrics, draws the series of the
+// ones picked over the chosen range, with the stats and percentiles of
+// their reports, and loads and saves the layout as a Dashboard.
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pz-metrics</title>
+<style>
+body { margin: 0; font-family: sans-serif; font-size: 13px; color: #333; background: #f4f4f4; }
+header { display: flex; align-items: center; gap: 12px; padding: 8px 16px; background: #263238; color: #eee; }
+header h1 { font-size: 16px; margin: 0 16px 0 0; }
+header input, header select, header button { font-size: 13px; }
+#main { display: flex; align-items: flex-start; }
+nav { width: 240px; padding: 8px; box-sizing: border-box; }
+nav input { width: 100%; box-sizing: border-box; margin-bottom: 6px; }
+nav ul { list-style: none; margin: 0; padding: 0; max-height: 80vh; overflow-y: auto; }
+nav li { padding: 3px 6px; cursor: pointer; border-radius: 3px; }
+nav li:hover { background: #dde; }
+nav li small { color: #888; }
+#panels { flex: 1; display: grid; grid-template-columns: repeat(12, 1fr); gap: 10px; padding: 8px; }
+.panel { background: #fff; border: 1px solid #ccc; border-radius: 4px; padding: 8px; min-width: 0; }
+.panel h2 { font-size: 14px; margin: 0 0 4px 0; display: flex; justify-content: space-between; }
+.panel h2 span button { margin-left: 4px; }
+.panel svg { width: 100%; height: 200px; }
+.panel table { border-collapse: collapse; margin: 4px 12px 0 0; display: inline-table; vertical-align: top; }
+.panel td, .panel th { padding: 1px 8px; text-align: right; border-bottom: 1px solid #eee; }
+.panel th { text-align: left; font-weight: normal; color: #666; }
+#error { color: #b00; padding: 0 16px; }
+#empty { grid-column: span 12; color: #888; padding: 24px; }
+</style>
+</head>
+<body>
+<header>
+  <h1>pz-metrics</h1>
+  <label>Range
+    <select id="range">
+      <option>1h</option><option>6h</option><option selected>24h</option><option>7d</option><option>30d</option>
+    </select>
+  </label>
+  <label>Dashboard <select id="dashboards"><option value="">(new)</option></select></label>
+  <input id="name" placeholder="name">
+  <button id="save">Save</button>
+  <button id="delete">Delete</button>
+</header>
+<div id="error"></div>
+<div id="main">
+  <nav>
+    <input id="filter" placeholder="filter metrics">
+    <ul id="metrics"></ul>
+  </nav>
+  <section id="panels"></section>
+</div>
+<script>
+(function() {
+"use strict";
+
+var SVGNS = "http://www.w3.org/2000/svg";
+
+// the dashboard being shown; its id is empty until it is saved
+var dashboard = {id: "", name: "", range: "24h", panels: []};
+var metrics = {};
+
+function $(id) { return document.getElementById(id); }
+
+function showError(err) { $("error").textContent = err ? String(err.message || err) : ""; }
+
+function api(method, path, body) {
+  var opts = {method: method, headers: {"Accept": "application/json"}};
+  if (body !== undefined) {
+    opts.body = JSON.stringify(body);
+    opts.headers["Content-Type"] = "application/json";
+  }
+  return fetch(path, opts).then(function(resp) {
+    return resp.json().then(function(json) {
+      if (!resp.ok) {
+        throw new Error(json.message || resp.statusText);
+      }
+      return json;
+    });
+  });
+}
+
+function query(params) {
+  return Object.keys(params).map(function(k) {
+    return encodeURIComponent(k) + "=" + encodeURIComponent(params[k]);
+  }).join("&");
+}
+
+var units = {ms: 1, s: 1000, m: 60000, h: 3600000, d: 86400000, w: 604800000};
+
+function millis(s) {
+  var m = /^([0-9.]+)(ms|s|m|h|d|w)$/.exec(s);
+  return m ? parseFloat(m[1]) * units[m[2]] : 86400000;
+}
+
+// pickStep returns a round step that makes at most 200 points of the range
+function pickStep(range) {
+  var steps = ["1m", "5m", "15m", "1h", "6h", "1d", "1w"];
+  for (var i = 0; i < steps.length; i++) {
+    if (millis(range) / millis(steps[i]) <= 200) {
+      return steps[i];
+    }
+  }
+  return steps[steps.length - 1];
+}
+
+function el(tag, text) {
+  var e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function svgEl(tag, attrs, text) {
+  var e = document.createElementNS(SVGNS, tag);
+  Object.keys(attrs).forEach(function(k) { e.setAttribute(k, attrs[k]); });
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function fmt(v) {
+  if (v === null || v === undefined) {
+    return "";
+  }
+  return Math.abs(v) >= 1e6 || (v !== 0 && Math.abs(v) < 1e-3) ? v.toExponential(3) : String(+v.toFixed(3));
+}
+
+//---------------------------------------------------------------------
+
+function loadMetrics() {
+  return api("GET", "/metric?" + query({perPage: 1000, sortBy: "name", order: "asc"})).then(function(json) {
+    metrics = {};
+    (json.data || []).forEach(function(m) { metrics[m.id] = m; });
+    drawMetricList();
+  });
+}
+
+function drawMetricList() {
+  var filter = $("filter").value.toLowerCase();
+  var ul = $("metrics");
+  ul.innerHTML = "";
+  Object.keys(metrics).map(function(id) { return metrics[id]; }).sort(function(a, b) {
+    return a.name < b.name ? -1 : a.name > b.name ? 1 : 0;
+  }).forEach(function(m) {
+    if (filter && m.name.toLowerCase().indexOf(filter) < 0) {
+      return;
+    }
+    var li = el("li", m.name + " ");
+    li.appendChild(el("small", m.units || ""));
+    li.title = m.description || "";
+    li.onclick = function() {
+      dashboard.panels.push({metricId: m.id});
+      drawPanels();
+    };
+    ul.appendChild(li);
+  });
+}
+
+function loadDashboards(selected) {
+  return api("GET", "/dashboard?" + query({perPage: 1000})).then(function(json) {
+    var select = $("dashboards");
+    select.innerHTML = "";
+    select.appendChild(el("option", "(new)"));
+    select.options[0].value = "";
+    (json.data || []).forEach(function(d) {
+      var opt = el("option", d.name);
+      opt.value = d.id;
+      select.appendChild(opt);
+    });
+    select.value = selected || "";
+  });
+}
+
+function setRange(range) {
+  var select = $("range");
+  var found = false;
+  for (var i = 0; i < select.options.length; i++) {
+    found = found || select.options[i].value === range;
+  }
+  if (!found) {
+    select.appendChild(el("option", range));
+  }
+  select.value = range;
+}
+
+function loadDashboard(id) {
+  if (!id) {
+    dashboard = {id: "", name: "", range: $("range").value, panels: []};
+    $("name").value = "";
+    location.hash = "";
+    drawPanels();
+    return Promise.resolve();
+  }
+  return api("GET", "/dashboard/" + encodeURIComponent(id)).then(function(json) {
+    dashboard = json.data;
+    dashboard.panels = dashboard.panels || [];
+    $("name").value = dashboard.name;
+    $("dashboards").value = dashboard.id;
+    setRange(dashboard.range);
+    location.hash = dashboard.id;
+    drawPanels();
+  });
+}
+
+function saveDashboard() {
+  dashboard.name = $("name").value;
+  dashboard.range = $("range").value;
+  var save = dashboard.id ?
+    api("PUT", "/dashboard/" + encodeURIComponent(dashboard.id), dashboard) :
+    api("POST", "/dashboard", dashboard);
+  return save.then(function(json) {
+    dashboard = json.data;
+    location.hash = dashboard.id;
+    return loadDashboards(dashboard.id);
+  });
+}
+
+function deleteDashboard() {
+  if (!dashboard.id || !confirm("Delete the dashboard \"" + dashboard.name + "\"?")) {
+    return Promise.resolve();
+  }
+  return api("DELETE", "/dashboard/" + encodeURIComponent(dashboard.id)).then(function() {
+    return loadDashboards("");
+  }).then(function() {
+    return loadDashboard("");
+  });
+}
+
+//---------------------------------------------------------------------
+
+function drawPanels() {
+  var section = $("panels");
+  section.innerHTML = "";
+  if (dashboard.panels.length === 0) {
+    section.appendChild(el("div", "Pick a metric on the left to chart it."));
+    section.lastChild.id = "empty";
+    return;
+  }
+  dashboard.panels.forEach(function(panel, i) {
+    section.appendChild(drawPanel(panel, i));
+  });
+}
+
+function drawPanel(panel, i) {
+  var metric = metrics[panel.metricId];
+  var div = el("div");
+  div.className = "panel";
+  div.style.gridColumn = "span " + (panel.width || 12);
+
+  var h2 = el("h2", panel.title || (metric ? metric.name : panel.metricId));
+  var buttons = el("span");
+  var widen = el("button", (panel.width || 12) === 12 ? "half" : "full");
+  widen.onclick = function() {
+    panel.width = (panel.width || 12) === 12 ? 6 : 12;
+    drawPanels();
+  };
+  var remove = el("button", "remove");
+  remove.onclick = function() {
+    dashboard.panels.splice(i, 1);
+    drawPanels();
+  };
+  buttons.appendChild(widen);
+  buttons.appendChild(remove);
+  h2.appendChild(buttons);
+  div.appendChild(h2);
+
+  if (!metric) {
+    div.appendChild(el("p", "metric not found: " + panel.metricId));
+    return div;
+  }
+
+  var chart = svgEl("svg", {viewBox: "0 0 600 200", preserveAspectRatio: "none"});
+  div.appendChild(chart);
+  var tables = el("div");
+  div.appendChild(tables);
+
+  var end = new Date();
+  var start = new Date(end.getTime() - millis($("range").value));
+  var step = panel.step || pickStep($("range").value);
+  var params = {start: start.toISOString().replace(/\.\d+Z$/, "Z"), end: end.toISOString().replace(/\.\d+Z$/, "Z")};
+
+  var seriesParams = {step: step, aggregator: panel.aggregator || "avg"};
+  Object.keys(params).forEach(function(k) { seriesParams[k] = params[k]; });
+
+  api("GET", "/series/" + encodeURIComponent(panel.metricId) + "?" + query(seriesParams)).then(function(json) {
+    var values = drawSeries(chart, json.data.points || [], metric, seriesParams.aggregator);
+
+    var lo = Math.min.apply(null, values), hi = Math.max.apply(null, values);
+    var reportParams = {dateInterval: step, valueInterval: values.length && hi > lo ? (hi - lo) / 20 : 1};
+    Object.keys(params).forEach(function(k) { reportParams[k] = params[k]; });
+    return api("GET", "/report/" + encodeURIComponent(panel.metricId) + "?" + query(reportParams));
+  }).then(function(json) {
+    drawReport(tables, json.data);
+  }).catch(function(err) {
+    tables.appendChild(el("p", String(err.message || err)));
+  });
+  return div;
+}
+
+// drawSeries draws the points as a line, broken where a step has no value,
+// and returns the values
+function drawSeries(chart, points, metric, aggregator) {
+  var values = points.filter(function(p) { return p[1] !== null; }).map(function(p) { return p[1]; });
+  var W = 600, H = 200, left = 50, bottom = 20;
+  chart.appendChild(svgEl("text", {x: left, y: 12, fill: "#666", "font-size": 11},
+    aggregator + " per step, " + (aggregator === "count" ? "count" : (metric.units || "value"))));
+  if (values.length === 0) {
+    chart.appendChild(svgEl("text", {x: W / 2, y: H / 2, "text-anchor": "middle", fill: "#888"}, "no data"));
+    return values;
+  }
+
+  var lo = Math.min.apply(null, values), hi = Math.max.apply(null, values);
+  if (hi === lo) {
+    hi = lo + 1;
+  }
+  var t0 = points[0][0], t1 = points[points.length - 1][0];
+  var x = function(t) { return left + (t1 > t0 ? (t - t0) / (t1 - t0) : 0.5) * (W - left - 10); };
+  var y = function(v) { return 20 + (1 - (v - lo) / (hi - lo)) * (H - 20 - bottom); };
+
+  [lo, (lo + hi) / 2, hi].forEach(function(v) {
+    chart.appendChild(svgEl("line", {x1: left, x2: W - 10, y1: y(v), y2: y(v), stroke: "#eee"}));
+    chart.appendChild(svgEl("text", {x: left - 4, y: y(v) + 4, "text-anchor": "end", fill: "#666", "font-size": 10}, fmt(v)));
+  });
+  [t0, t1].forEach(function(t, i) {
+    chart.appendChild(svgEl("text", {x: x(t), y: H - 4, "text-anchor": i ? "end" : "start", fill: "#666", "font-size": 10},
+      new Date(t).toLocaleString()));
+  });
+
+  var d = "";
+  var pen = "M";
+  points.forEach(function(p) {
+    if (p[1] === null) {
+      pen = "M";
+      return;
+    }
+    // a point with no neighbors is a dot, from the round cap of "l0 0"
+    d += pen + x(p[0]).toFixed(1) + " " + y(p[1]).toFixed(1) + (pen === "M" ? " l0 0 " : " ");
+    pen = "L";
+  });
+  chart.appendChild(svgEl("path", {d: d, fill: "none", stroke: "#1f77b4", "stroke-width": 1.5, "stroke-linecap": "round"}));
+  return values;
+}
+
+function drawReport(tables, report) {
+  var stats = el("table");
+  var s = report.stats_report || {};
+  [["count", s.count], ["min", s.min], ["max", s.max], ["avg", s.avg], ["sum", s.sum], ["std dev", s.std_deviation]]
+    .forEach(function(row) {
+      var tr = el("tr");
+      tr.appendChild(el("th", row[0]));
+      tr.appendChild(el("td", fmt(row[1])));
+      stats.appendChild(tr);
+    });
+  if (report.rate_report) {
+    [["increase", report.rate_report.increase], ["per second", report.rate_report.per_second]].forEach(function(row) {
+      var tr = el("tr");
+      tr.appendChild(el("th", row[0]));
+      tr.appendChild(el("td", fmt(row[1])));
+      stats.appendChild(tr);
+    });
+  }
+  tables.appendChild(stats);
+
+  var values = (report.percs_report && report.percs_report.values) || {};
+  var keys = Object.keys(values).sort(function(a, b) { return parseFloat(a) - parseFloat(b); });
+  if (keys.length) {
+    var percs = el("table");
+    keys.forEach(function(k) {
+      var tr = el("tr");
+      tr.appendChild(el("th", "p" + parseFloat(k)));
+      tr.appendChild(el("td", fmt(values[k])));
+      percs.appendChild(tr);
+    });
+    tables.appendChild(percs);
+  }
+}
+
+//---------------------------------------------------------------------
+
+function run(promise) {
+  showError(null);
+  return promise.catch(showError);
+}
+
+$("filter").oninput = drawMetricList;
+$("range").onchange = function() {
+  dashboard.range = $("range").value;
+  drawPanels();
+};
+$("dashboards").onchange = function() { run(loadDashboard($("dashboards").value)); };
+$("save").onclick = function() { run(saveDashboard()); };
+$("delete").onclick = function() { run(deleteDashboard()); };
+
+var initial = location.hash.replace(/^#/, "");
+run(Promise.all([loadMetrics(), loadDashboards(initial)]).then(function() {
+  return loadDashboard(initial);
+}));
+
+// keep the charts current
+setInterval(function() {
+  if (!document.hidden) {
+    drawPanels();
+  }
+}, 60000);
+})();
+</script>
+</body>
+</html>
+`
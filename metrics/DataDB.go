@@ -17,12 +17,38 @@ package metrics
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sort"
+	"time"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
 )
 
+// IDataDB is the storage interface for Data points and the reports computed
+// over them. DataDB is the Elasticsearch-backed implementation; MemDataDB
+// keeps everything in memory.
+type IDataDB interface {
+	PostData(data *Data, id piazza.Ident) (piazza.Ident, error)
+	PostDataBatch(datas []Data) ([]error, error)
+	GetAll(format *piazza.JsonPagination) ([]Data, int64, error)
+	GetOne(id piazza.Ident) (*Data, bool, error)
+	DeleteByID(id piazza.Ident) (bool, error)
+	CountByMetric(id piazza.Ident) (int64, error)
+	DeleteByMetric(id piazza.Ident, progress func(int64)) (int64, error)
+	DeleteOlderThan(id piazza.Ident, cutoff time.Time) (int64, error)
+	DropBefore(cutoff time.Time) (int64, []string, error)
+	GetLatestOfEach(ids []piazza.Ident) (map[piazza.Ident]*Data, error)
+	GetPoints(id piazza.Ident, req *ReportRequest, limit int) ([]Data, error)
+	GetSeries(id piazza.Ident, req *SeriesRequest) (map[int64]float64, error)
+	GetByMetric(id piazza.Ident, start time.Time, end time.Time, format *piazza.JsonPagination) ([]Data, int64, error)
+	GetSummary(id piazza.Ident, req *ReportRequest) (*StatsReport, error)
+	GetSummaryOfEach(ids []piazza.Ident, req *ReportRequest) (map[piazza.Ident]*StatsReport, error)
+	ComputeRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error)
+	GetStats(id piazza.Ident, req *ReportRequest) (*FullReport, error)
+	GetGroupedStats(id piazza.Ident, req *ReportRequest) (*GroupedReport, error)
+}
+
 type DataDB struct {
 	*ResourceDB
 	mapping string
@@ -49,8 +75,23 @@ const DataIndexSettings = `
 						"type": "double",
 						"store": true,
 						"index": "not_analyzed"
+					},
+					"labels": {
+						"type": "object"
 					}
-                }
+                },
+                "dynamic_templates": [
+					{
+						"labels": {
+							"path_match": "labels.*",
+							"mapping": {
+								"type": "string",
+								"store": true,
+								"index": "not_analyzed"
+							}
+						}
+					}
+                ]
             }
         }
 }`
@@ -61,121 +102,719 @@ func NewDataDB(service *Service, esi elasticsearch.IIndex) (*DataDB, error) {
 		return nil, err
 	}
 	ardb := DataDB{ResourceDB: rdb, mapping: DataDBMapping}
+
+	err = ardb.setupPartitions()
+	if err != nil {
+		return nil, err
+	}
 	return &ardb, nil
 }
 
-func (db *DataDB) PostData(obj interface{}, id piazza.Ident) (piazza.Ident, error) {
+type createResponse struct {
+	Created bool `json:"created"`
+}
+
+// PostData stores the Data in the partition for its timestamp.
+func (db *DataDB) PostData(data *Data, id piazza.Ident) (piazza.Ident, error) {
+	endpoint := fmt.Sprintf("/%s/%s/%s?op_type=create", db.dataPartition(data), db.mapping, id.String())
 
-	indexResult, err := db.Esi.PostData(db.mapping, id.String(), obj)
+	out := &createResponse{}
+	err := db.Esi.DirectAccess("PUT", endpoint, data, out)
 	if err != nil {
 		return piazza.NoIdent, LoggedError("DataDB.PostData failed: %s", err)
 	}
-	if !indexResult.Created {
+	if !out.Created {
 		return piazza.NoIdent, LoggedError("DataDB.PostData failed: not created")
 	}
 
 	return id, nil
 }
 
-func (db *DataDB) GetAll(format *piazza.JsonPagination) ([]Data, int64, error) {
-	datas := []Data{}
+// PostDataBatch stores the Data, which must already have their IDs set, with
+// a single request to the ES bulk API. Each goes to the partition for its
+// timestamp, and, as with PostData, is not stored if one with its ID is. The
+// returned errors are per-item, in the same order as the datas; the error is
+// for the request as a whole.
+func (db *DataDB) PostDataBatch(datas []Data) ([]error, error) {
+	lines := []interface{}{}
+	for _, data := range datas {
+		lines = append(lines, db.bulkAction(db.dataPartition(&data), db.mapping, "create", data.ID), data)
+	}
 
-	exists, err := db.Esi.TypeExists(db.mapping)
+	results, err := db.bulk(lines, len(datas))
 	if err != nil {
-		return datas, 0, err
+		return nil, LoggedError("DataDB.PostDataBatch failed: %s", err)
 	}
-	if !exists {
-		return datas, 0, nil
+
+	errs := make([]error, len(datas))
+	for i, result := range results {
+		if result.Error != nil {
+			errs[i] = fmt.Errorf("%s: %s", result.Error.Type, result.Error.Reason)
+		} else if result.Status != http.StatusCreated {
+			errs[i] = fmt.Errorf("not created: status %d", result.Status)
+		}
 	}
 
-	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	return errs, nil
+}
+
+type countResponse struct {
+	Count int64 `json:"count"`
+}
+
+type hitsResponse struct {
+	Hits struct {
+		Total int64 `json:"total"`
+		Hits  []struct {
+			Index  string           `json:"_index"`
+			ID     string           `json:"_id"`
+			Source *json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func newMetricIDQuery(id piazza.Ident) map[string]interface{} {
+	return map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": newTermQuery("metricId", id.String()),
+		},
+	}
+}
+
+func (db *DataDB) CountByMetric(id piazza.Ident) (int64, error) {
+	endpoint := fmt.Sprintf("/%s/%s/_count", db.aliasName(), db.mapping)
+
+	out := &countResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, newMetricIDQuery(id), out)
 	if err != nil {
-		return nil, 0, LoggedError("DataDB.GetAll failed: %s", err)
+		return 0, LoggedError("DataDB.CountByMetric failed: %s", err)
 	}
-	if searchResult == nil {
-		return nil, 0, LoggedError("DataDB.GetAll failed: no searchResult")
+	return out.Count, nil
+}
+
+// the number of documents deleted per bulk request
+const deletePageSize = 1000
+
+// DeleteByMetric deletes all the Data for the metric. After each page,
+// progress (if not nil) is called with the total deleted so far.
+func (db *DataDB) DeleteByMetric(id piazza.Ident, progress func(int64)) (int64, error) {
+	deleted, err := db.deleteByQuery(db.aliasName(), db.mapping, newMetricIDQuery(id), progress)
+	if err != nil {
+		return deleted, LoggedError("DataDB.DeleteByMetric failed: %s", err)
 	}
+	return deleted, nil
+}
 
-	if searchResult != nil && searchResult.GetHits() != nil {
-		for _, hit := range *searchResult.GetHits() {
-			var data Data
-			err := json.Unmarshal(*hit.Source, &data)
-			if err != nil {
-				return nil, 0, err
-			}
-			datas = append(datas, data)
+// DeleteOlderThan deletes the Data for the metric with timestamps before
+// the cutoff.
+func (db *DataDB) DeleteOlderThan(id piazza.Ident, cutoff time.Time) (int64, error) {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"constant_score": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"and": newAndFilter(
+						map[string]interface{}{
+							"term":  newTermQuery("metricId", id.String()),
+							"range": newRangeQuery("timestamp", time.Time{}, cutoff),
+						},
+					),
+				},
+			},
+		},
+	}
+
+	deleted, err := db.deleteByQuery(db.searchTarget(time.Time{}, cutoff), db.mapping, query, nil)
+	if err != nil {
+		return deleted, LoggedError("DataDB.DeleteOlderThan failed: %s", err)
+	}
+	return deleted, nil
+}
+
+func (db *DataDB) GetAll(format *piazza.JsonPagination) ([]Data, int64, error) {
+	endpoint := db.searchEndpoint(db.aliasName(), db.mapping, "")
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		},
+		"from": format.Page * format.PerPage,
+		"size": format.PerPage,
+	}
+	if format.SortBy != "" {
+		order := "asc"
+		if format.Order == piazza.PaginationOrderDescending {
+			order = "desc"
+		}
+		query["sort"] = []interface{}{
+			map[string]interface{}{format.SortBy: map[string]interface{}{"order": order}},
 		}
 	}
 
-	return datas, searchResult.TotalHits(), nil
+	out := &hitsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, 0, LoggedError("DataDB.GetAll failed: %s", err)
+	}
+
+	datas := []Data{}
+	for _, hit := range out.Hits.Hits {
+		var data Data
+		err := json.Unmarshal(*hit.Source, &data)
+		if err != nil {
+			return nil, 0, err
+		}
+		datas = append(datas, data)
+	}
+
+	return datas, out.Hits.Total, nil
+}
+
+// findByID looks up the Data in every partition, returning the hit. If
+// there is none, it returns false.
+func (db *DataDB) findByID(id piazza.Ident) (*hitsResponse, bool, error) {
+	endpoint := db.searchEndpoint(db.aliasName(), db.mapping, "")
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"ids": map[string]interface{}{
+				"values": []string{id.String()},
+			},
+		},
+		"size": 1,
+	}
+
+	out := &hitsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, len(out.Hits.Hits) > 0, nil
 }
 
 func (db *DataDB) GetOne(id piazza.Ident) (*Data, bool, error) {
 	//log.Printf("DataDB.GetOne: %s %s", id.String(), db.mapping)
-	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	out, found, err := db.findByID(id)
 	if err != nil {
 		return nil, false, fmt.Errorf("DataDB.GetOne failed: %s", err)
 	}
-	if getResult == nil {
-		return nil, true, fmt.Errorf("DataDB.GetOne failed: %s no getResult", id.String())
+	if !found {
+		return nil, false, fmt.Errorf("DataDB.GetOne failed: %s not found", id.String())
 	}
 
-	src := getResult.Source
+	src := out.Hits.Hits[0].Source
+	if src == nil {
+		return nil, true, fmt.Errorf("DataDB.GetOne failed: %s no source", id.String())
+	}
 	var data Data
 	err = json.Unmarshal(*src, &data)
 	if err != nil {
-		return nil, getResult.Found, err
+		return nil, true, err
 	}
 
-	return &data, getResult.Found, nil
+	return &data, true, nil
+}
+
+type deleteResponse struct {
+	Found bool `json:"found"`
 }
 
 func (db *DataDB) DeleteByID(id piazza.Ident) (bool, error) {
-	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	out, found, err := db.findByID(id)
 	if err != nil {
-		return deleteResult.Found, fmt.Errorf("DataDB.DeleteById failed: %s", err)
+		return false, fmt.Errorf("DataDB.DeleteById failed: %s", err)
 	}
-	if deleteResult == nil {
-		return false, fmt.Errorf("DataDB.DeleteById failed: no deleteResult")
+	if !found {
+		return false, fmt.Errorf("DataDB.DeleteById failed: not found")
 	}
 
+	endpoint := fmt.Sprintf("/%s/%s/%s", out.Hits.Hits[0].Index, db.mapping, id.String())
+	deleteResult := &deleteResponse{}
+	err = db.Esi.DirectAccess("DELETE", endpoint, nil, deleteResult)
+	if err != nil {
+		return false, fmt.Errorf("DataDB.DeleteById failed: %s", err)
+	}
 	if !deleteResult.Found {
 		return false, fmt.Errorf("DataDB.DeleteById failed: not found")
 	}
 
-	return deleteResult.Found, nil
+	return true, nil
 }
 
-func (db *DataDB) GetStats(id piazza.Ident, req *ReportRequest) (*FullReport, error) {
-	indexName := db.Esi.IndexName()
-	//log.Printf("DataDB.GetStats: %s %s", id.String(), indexName)
-
-	//log.Printf("DataDB.GetStats: %#v", *req)
+type latestAggsResponse struct {
+	Aggregations struct {
+		Metrics struct {
+			Buckets []struct {
+				Key    string       `json:"key"`
+				Latest hitsResponse `json:"latest"`
+			} `json:"buckets"`
+		} `json:"metrics"`
+	} `json:"aggregations"`
+}
 
-	command := "/_search?search_type=count"
-	endpoint := fmt.Sprintf("/%s%s", indexName, command)
+// GetLatestOfEach returns the Data with the most recent timestamp of each
+// of the metrics, in one query. The metrics with no data are left out.
+func (db *DataDB) GetLatestOfEach(ids []piazza.Ident) (map[piazza.Ident]*Data, error) {
+	latest := map[piazza.Ident]*Data{}
+	if len(ids) == 0 {
+		return latest, nil
+	}
+	endpoint := db.searchEndpoint(db.aliasName(), db.mapping, "search_type=count")
 
-	in := &map[string]interface{}{
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"terms": newTermQuery("metricId", ids),
+		},
 		"aggs": map[string]interface{}{
-			"full_report": map[string]interface{}{
+			"metrics": newTermsAggsQuery("metricId", len(ids), map[string]interface{}{
+				"latest": map[string]interface{}{
+					"top_hits": map[string]interface{}{
+						"size": 1,
+						"sort": []interface{}{
+							map[string]interface{}{"timestamp": map[string]interface{}{"order": "desc"}},
+						},
+					},
+				},
+			}),
+		},
+	}
+
+	out := &latestAggsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, LoggedError("DataDB.GetLatestOfEach failed: %s", err)
+	}
+	for _, bucket := range out.Aggregations.Metrics.Buckets {
+		hits := bucket.Latest.Hits.Hits
+		if len(hits) == 0 || hits[0].Source == nil {
+			continue
+		}
+		var data Data
+		err = json.Unmarshal(*hits[0].Source, &data)
+		if err != nil {
+			return nil, err
+		}
+		latest[piazza.Ident(bucket.Key)] = &data
+	}
+	return latest, nil
+}
+
+// GetPoints returns the Data a report on the request would be made from,
+// oldest first, for computations that can't be done by ES aggregations. If
+// there are more than limit of them, errTooManyPoints is returned; a limit of
+// 0 means there is none.
+func (db *DataDB) GetPoints(id piazza.Ident, req *ReportRequest, limit int) ([]Data, error) {
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), db.mapping, "scroll=1m")
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"constant_score": map[string]interface{}{
+				"filter": newReportFilter(id, req),
+			},
+		},
+		"size": scrollPageSize,
+		"sort": []interface{}{
+			map[string]interface{}{"timestamp": map[string]interface{}{"order": "asc"}},
+		},
+	}
+
+	datas := []Data{}
+	err := db.scroll(endpoint, query, func(source *json.RawMessage) error {
+		var data Data
+		err := json.Unmarshal(*source, &data)
+		if err != nil {
+			return err
+		}
+		if limit > 0 && len(datas) >= limit {
+			return errTooManyPoints
+		}
+		datas = append(datas, data)
+		return nil
+	})
+	if err == errTooManyPoints {
+		return nil, err
+	}
+	if err != nil {
+		return nil, LoggedError("DataDB.GetPoints failed: %s", err)
+	}
+
+	return datas, nil
+}
+
+// GetByMetric returns one page of the metric's Data with timestamps in
+// [start, end), sorted by timestamp in the order of the pagination, and the
+// number of such Data in all.
+func (db *DataDB) GetByMetric(id piazza.Ident, start time.Time, end time.Time,
+	format *piazza.JsonPagination) ([]Data, int64, error) {
+
+	endpoint := db.searchEndpoint(db.searchTarget(start, end), db.mapping, "")
+
+	order := "asc"
+	if format.Order == piazza.PaginationOrderDescending {
+		order = "desc"
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"constant_score": map[string]interface{}{
 				"filter": map[string]interface{}{
 					"and": newAndFilter(
 						map[string]interface{}{
 							"term":  newTermQuery("metricId", id.String()),
-							"range": newRangeQuery("timestamp", req.Start, req.End),
+							"range": newRangeQuery("timestamp", start, end),
 						},
 					),
 				},
+			},
+		},
+		"from": format.Page * format.PerPage,
+		"size": format.PerPage,
+		"sort": []interface{}{
+			map[string]interface{}{"timestamp": map[string]interface{}{"order": order}},
+		},
+	}
+
+	out := &hitsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, 0, LoggedError("DataDB.GetByMetric failed: %s", err)
+	}
+
+	datas := []Data{}
+	for _, hit := range out.Hits.Hits {
+		var data Data
+		err = json.Unmarshal(*hit.Source, &data)
+		if err != nil {
+			return nil, 0, LoggedError("DataDB.GetByMetric failed: %s", err)
+		}
+		datas = append(datas, data)
+	}
+
+	return datas, out.Hits.Total, nil
+}
+
+// newSeriesValueAggs is the aggregation for the value of one step
+func newSeriesValueAggs(agg *seriesAggregator) map[string]interface{} {
+	switch agg.name {
+	case "last":
+		return map[string]interface{}{
+			"top_hits": map[string]interface{}{
+				"size":    1,
+				"_source": []string{"value"},
+				"sort": []interface{}{
+					map[string]interface{}{"timestamp": map[string]interface{}{"order": "desc"}},
+				},
+			},
+		}
+	case "percentile":
+		return map[string]interface{}{
+			"percentiles": map[string]interface{}{
+				"field":    "value",
+				"percents": []float64{agg.percent},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"stats": map[string]interface{}{
+			"field": "value",
+		},
+	}
+}
+
+type seriesBucket struct {
+	Key      float64 `json:"key"`
+	DocCount int64   `json:"doc_count"`
+	Value    struct {
+		BucketStats                     // stats
+		Values       map[string]float64 `json:"values"` // percentiles
+		hitsResponse                    // top_hits
+	} `json:"value"`
+}
+
+type seriesAggsResponse struct {
+	Error        *ErrorResponse `json:"error"`
+	Aggregations struct {
+		Series struct {
+			Steps struct {
+				Buckets []seriesBucket `json:"buckets"`
+			} `json:"steps"`
+		} `json:"series"`
+	} `json:"aggregations"`
+}
+
+// GetSeries returns the aggregate value of each step of the request that
+// has data, keyed by the start of the step in milliseconds since the epoch.
+func (db *DataDB) GetSeries(id piazza.Ident, req *SeriesRequest) (map[int64]float64, error) {
+	agg, err := parseSeriesAggregator(req.Aggregator)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"series": map[string]interface{}{
+				"filter": newReportFilter(id, &ReportRequest{Start: req.Start, End: req.End}),
+				"aggs": map[string]interface{}{
+					"steps": map[string]interface{}{
+						"date_histogram": map[string]interface{}{
+							"field":         "timestamp",
+							"interval":      req.Step,
+							"min_doc_count": 1,
+						},
+						"aggs": map[string]interface{}{
+							"value": newSeriesValueAggs(agg),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	out := &seriesAggsResponse{}
+	err = db.Esi.DirectAccess("GET", endpoint, in, out)
+	if out.Error != nil && out.Error.RootCause != nil && (out.Error.RootCause)[0] != nil {
+		return nil, fmt.Errorf("%#v", (out.Error.RootCause)[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[int64]float64{}
+	for _, bucket := range out.Aggregations.Series.Steps.Buckets {
+		key := int64(bucket.Key)
+		value := bucket.Value
+
+		switch agg.name {
+		case "count":
+			values[key] = float64(bucket.DocCount)
+		case "sum":
+			values[key] = value.Sum
+		case "min":
+			values[key] = value.Min
+		case "max":
+			values[key] = value.Max
+		case "avg":
+			values[key] = value.Avg
+		case "percentile":
+			values[key] = value.Values[percentileKey(agg.percent)]
+		case "last":
+			if len(value.Hits.Hits) == 0 || value.Hits.Hits[0].Source == nil {
+				continue
+			}
+			var data Data
+			err = json.Unmarshal(*value.Hits.Hits[0].Source, &data)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = data.Value
+		}
+	}
+
+	return values, nil
+}
+
+// GetSummary is a cheap GetStats: just the statistics, without the
+// percentiles and histograms, so the intervals in the request are unused.
+func (db *DataDB) GetSummary(id piazza.Ident, req *ReportRequest) (*StatsReport, error) {
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"full_report": map[string]interface{}{
+				"filter": newReportFilter(id, req),
+				"aggs": map[string]interface{}{
+					"stats_report": newExtendedStatsAggsQuery("value"),
+				},
+			},
+		},
+	}
+
+	out := &AggsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, in, out)
+	if out.Error != nil && out.Error.RootCause != nil && (out.Error.RootCause)[0] != nil {
+		return nil, fmt.Errorf("%#v", (out.Error.RootCause)[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &out.Aggregations.FullReport.StatsReport, nil
+}
+
+type summaryAggsResponse struct {
+	Aggregations struct {
+		Summaries struct {
+			Metrics struct {
+				Buckets []struct {
+					Key         string      `json:"key"`
+					StatsReport StatsReport `json:"stats_report"`
+				} `json:"buckets"`
+			} `json:"metrics"`
+		} `json:"summaries"`
+	} `json:"aggregations"`
+	Error *ErrorResponse `json:"error"`
+}
+
+// GetSummaryOfEach is GetSummary for each of the metrics, in one query. The
+// request's labels are unused. A metric with no data in the range gets an
+// empty summary.
+func (db *DataDB) GetSummaryOfEach(ids []piazza.Ident, req *ReportRequest) (map[piazza.Ident]*StatsReport, error) {
+	summaries := map[piazza.Ident]*StatsReport{}
+	for _, id := range ids {
+		summaries[id] = &StatsReport{}
+	}
+	if len(ids) == 0 {
+		return summaries, nil
+	}
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"summaries": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"and": []interface{}{
+						map[string]interface{}{"terms": newTermQuery("metricId", ids)},
+						map[string]interface{}{"range": newRangeQuery("timestamp", req.Start, req.End)},
+					},
+				},
+				"aggs": map[string]interface{}{
+					"metrics": newTermsAggsQuery("metricId", len(ids), map[string]interface{}{
+						"stats_report": newExtendedStatsAggsQuery("value"),
+					}),
+				},
+			},
+		},
+	}
+
+	out := &summaryAggsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, in, out)
+	if out.Error != nil && out.Error.RootCause != nil && (out.Error.RootCause)[0] != nil {
+		return nil, fmt.Errorf("%#v", (out.Error.RootCause)[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range out.Aggregations.Summaries.Metrics.Buckets {
+		bucket := &out.Aggregations.Summaries.Metrics.Buckets[i]
+		summaries[piazza.Ident(bucket.Key)] = &bucket.StatsReport
+	}
+	return summaries, nil
+}
+
+type rollupAggsResponse struct {
+	Aggregations struct {
+		Rollups struct {
+			Periods struct {
+				Buckets []struct {
+					Key   float64     `json:"key"`
+					Stats StatsReport `json:"stats"`
+				} `json:"buckets"`
+			} `json:"periods"`
+		} `json:"rollups"`
+	} `json:"aggregations"`
+}
+
+// ComputeRollups summarizes the metric's Data in [start, end), one Rollup
+// per period of the tier that has any, in time order. A period only partly
+// in the range is summarized over just that part.
+func (db *DataDB) ComputeRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error) {
+	endpoint := db.searchEndpoint(db.searchTarget(start, end), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"rollups": map[string]interface{}{
+				"filter": newReportFilter(id, &ReportRequest{Start: start, End: end}),
 				"aggs": map[string]interface{}{
-					"stats_report":      newExtendedStatsAggsQuery("value"),
-					"percs_report":      newPercentilesAggsQuery("field", "value"),
-					"date_hist_report":  newDateHistogramAggsQuery("timestamp", req.DateInterval, "value"),
-					"value_hist_report": newHistogramAggsQuery("value", req.ValueInterval),
+					"periods": map[string]interface{}{
+						"date_histogram": map[string]interface{}{
+							"field":         "timestamp",
+							"interval":      fmt.Sprintf("%dh", int64(tier.interval().fixed/time.Hour)),
+							"min_doc_count": 1,
+						},
+						"aggs": map[string]interface{}{
+							"stats": newExtendedStatsAggsQuery("value"),
+						},
+					},
 				},
 			},
 		},
 	}
 
+	out := &rollupAggsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, in, out)
+	if err != nil {
+		return nil, LoggedError("DataDB.ComputeRollups failed: %s", err)
+	}
+
+	rollups := []Rollup{}
+	for _, bucket := range out.Aggregations.Rollups.Periods.Buckets {
+		periodStart := time.Unix(0, int64(bucket.Key)*int64(time.Millisecond)).UTC()
+		rollups = append(rollups, Rollup{
+			ID:           newRollupID(id, tier, periodStart),
+			MetricID:     id,
+			Tier:         tier,
+			Timestamp:    periodStart.Format(time.RFC3339),
+			Count:        bucket.Stats.Count,
+			Sum:          bucket.Stats.Sum,
+			Min:          bucket.Stats.Min,
+			Max:          bucket.Stats.Max,
+			SumOfSquares: bucket.Stats.SumOfSquares,
+		})
+	}
+
+	return rollups, nil
+}
+
+// newReportFilter selects the data for one metric within the time range of
+// the request, and with all the labels the request asks for
+func newReportFilter(id piazza.Ident, req *ReportRequest) map[string]interface{} {
+	and := newAndFilter(
+		map[string]interface{}{
+			"term":  newTermQuery("metricId", id.String()),
+			"range": newRangeQuery("timestamp", req.Start, req.End),
+		},
+	)
+	for k, v := range req.Labels {
+		and = append(and, map[string]interface{}{
+			"term": newTermQuery("labels."+k, v),
+		})
+	}
+
+	return map[string]interface{}{
+		"and": and,
+	}
+}
+
+func newFullReportAggs(req *ReportRequest) map[string]interface{} {
+	aggs := map[string]interface{}{
+		"stats_report":      newExtendedStatsAggsQuery("value"),
+		"percs_report":      newPercentilesAggsQuery("field", "value", req.Percentiles),
+		"date_hist_report":  newDateHistogramAggsQuery("timestamp", req.DateInterval, "value"),
+		"value_hist_report": newHistogramAggsQuery("value", req.ValueInterval),
+	}
+	if len(req.PercentileRanks) > 0 {
+		aggs["ranks_report"] = newPercentileRanksAggsQuery("value", req.PercentileRanks)
+	}
+	return aggs
+}
+
+func (db *DataDB) GetStats(id piazza.Ident, req *ReportRequest) (*FullReport, error) {
+	//log.Printf("DataDB.GetStats: %s %s", id.String(), db.Esi.IndexName())
+
+	//log.Printf("DataDB.GetStats: %#v", *req)
+
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"full_report": map[string]interface{}{
+				"filter": newReportFilter(id, req),
+				"aggs":   newFullReportAggs(req),
+			},
+		},
+	}
+
 	out := &AggsResponse{}
 	err := db.Esi.DirectAccess("GET", endpoint, in, out)
 	if out.Error != nil && out.Error.RootCause != nil && (out.Error.RootCause)[0] != nil {
@@ -188,6 +827,55 @@ func (db *DataDB) GetStats(id piazza.Ident, req *ReportRequest) (*FullReport, er
 
 	sort.Sort(ByDateBucket(out.Aggregations.FullReport.DateHistReport.Buckets))
 	sort.Sort(ByValueBucket(out.Aggregations.FullReport.ValueHistReport.Buckets))
+	out.Aggregations.FullReport.takeRanks()
+
+	if len(out.Aggregations.FullReport.ValueHistReport.Buckets) > maxReportValueBuckets {
+		return nil, errTooManyValueBuckets
+	}
 
 	return &out.Aggregations.FullReport, nil
 }
+
+// the most label values a grouped report will have groups for
+const maxLabelGroups = 1000
+
+// GetGroupedStats is like GetStats, but returns a separate report for each
+// value of the req.GroupBy label. Data without that label is left out.
+func (db *DataDB) GetGroupedStats(id piazza.Ident, req *ReportRequest) (*GroupedReport, error) {
+	endpoint := db.searchEndpoint(db.searchTarget(req.Start, req.End), "", "search_type=count")
+
+	in := &map[string]interface{}{
+		"aggs": map[string]interface{}{
+			"full_report": map[string]interface{}{
+				"filter": newReportFilter(id, req),
+				"aggs": map[string]interface{}{
+					"groups": newTermsAggsQuery("labels."+req.GroupBy, maxLabelGroups, newFullReportAggs(req)),
+				},
+			},
+		},
+	}
+
+	out := &GroupedAggsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, in, out)
+	if out.Error != nil && out.Error.RootCause != nil && (out.Error.RootCause)[0] != nil {
+		return nil, fmt.Errorf("%#v", (out.Error.RootCause)[0])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GroupedReport{GroupBy: req.GroupBy, Groups: []LabelReport{}}
+	for _, bucket := range out.Aggregations.FullReport.Groups.Buckets {
+		sort.Sort(ByDateBucket(bucket.DateHistReport.Buckets))
+		sort.Sort(ByValueBucket(bucket.ValueHistReport.Buckets))
+		bucket.takeRanks()
+		if len(bucket.ValueHistReport.Buckets) > maxReportValueBuckets {
+			return nil, errTooManyValueBuckets
+		}
+		report.Groups = append(report.Groups, LabelReport{Value: bucket.Key, Report: bucket.FullReport})
+	}
+	sort.Sort(ByLabelValue(report.Groups))
+
+	return report, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+type JobStatus string
+
+const (
+	JobStatusRunning   JobStatus = "Running"
+	JobStatusSucceeded JobStatus = "Succeeded"
+	JobStatusFailed    JobStatus = "Failed"
+)
+
+// Job is a long-running operation done in the background, such as deleting
+// all the data of a metric. Jobs are only tracked in memory, so they don't
+// survive a restart of the service.
+type Job struct {
+	ID         piazza.Ident `json:"id"`
+	Type       string       `json:"type"`
+	Target     piazza.Ident `json:"target"` // what the job is acting on
+	Status     JobStatus    `json:"status"`
+	Total      int64        `json:"total"` // expected amount of work, e.g. documents
+	Done       int64        `json:"done"`  // work completed so far
+	Message    string       `json:"message,omitempty"`
+	CreatedOn  time.Time    `json:"createdOn"`
+	FinishedOn *time.Time   `json:"finishedOn,omitempty"`
+}
+
+const JobTypeDeleteMetric = "DeleteMetric"
+
+// the most finished jobs kept; the oldest are forgotten first
+const maxFinishedJobs = 100
+
+//---------------------------------------------------------------------
+
+type jobList struct {
+	sync.Mutex
+	jobs     map[piazza.Ident]*Job
+	finished []piazza.Ident // oldest first
+}
+
+func newJobList() *jobList {
+	return &jobList{jobs: map[piazza.Ident]*Job{}}
+}
+
+func (list *jobList) add(job *Job) {
+	list.Lock()
+	defer list.Unlock()
+	list.jobs[job.ID] = job
+}
+
+// get returns a copy of the job, safe to read while the job runs
+func (list *jobList) get(id piazza.Ident) (*Job, bool) {
+	list.Lock()
+	defer list.Unlock()
+
+	job, ok := list.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	cpy := *job
+	if job.FinishedOn != nil {
+		finishedOn := *job.FinishedOn
+		cpy.FinishedOn = &finishedOn
+	}
+	return &cpy, true
+}
+
+func (list *jobList) update(id piazza.Ident, f func(job *Job)) {
+	list.Lock()
+	defer list.Unlock()
+
+	if job, ok := list.jobs[id]; ok {
+		f(job)
+	}
+}
+
+func (list *jobList) finish(id piazza.Ident, err error) {
+	list.Lock()
+	defer list.Unlock()
+
+	job, ok := list.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	job.FinishedOn = &now
+	job.Status = JobStatusSucceeded
+	if err != nil {
+		job.Status = JobStatusFailed
+		job.Message = err.Error()
+	}
+
+	list.finished = append(list.finished, id)
+	if over := len(list.finished) - maxFinishedJobs; over > 0 {
+		for _, old := range list.finished[:over] {
+			delete(list.jobs, old)
+		}
+		list.finished = list.finished[over:]
+	}
+}
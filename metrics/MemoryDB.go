@@ -0,0 +1,834 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+//---------------------------------------------------------------------
+
+// memTable is the in-memory stand-in for one Elasticsearch mapping type:
+// a set of documents keyed by id, remembered in insertion order.
+type memTable struct {
+	sync.RWMutex
+	ids  []piazza.Ident
+	docs map[piazza.Ident]interface{}
+}
+
+func newMemTable() *memTable {
+	return &memTable{docs: map[piazza.Ident]interface{}{}}
+}
+
+func (t *memTable) post(id piazza.Ident, doc interface{}) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.docs[id]; ok {
+		return fmt.Errorf("id already exists: %s", id.String())
+	}
+	t.ids = append(t.ids, id)
+	t.docs[id] = doc
+	return nil
+}
+
+// put replaces the document, or adds it if there is none with the id
+func (t *memTable) put(id piazza.Ident, doc interface{}) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.docs[id]; !ok {
+		t.ids = append(t.ids, id)
+	}
+	t.docs[id] = doc
+}
+
+func (t *memTable) get(id piazza.Ident) (interface{}, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	doc, ok := t.docs[id]
+	return doc, ok
+}
+
+func (t *memTable) delete(id piazza.Ident) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.docs[id]; !ok {
+		return false
+	}
+	delete(t.docs, id)
+	for i, x := range t.ids {
+		if x == id {
+			t.ids = append(t.ids[:i], t.ids[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// all returns every document, in insertion order
+func (t *memTable) all() []interface{} {
+	t.RLock()
+	defer t.RUnlock()
+
+	docs := make([]interface{}, len(t.ids))
+	for i, id := range t.ids {
+		docs[i] = t.docs[id]
+	}
+	return docs
+}
+
+// page returns one page of the documents, and the total number of documents
+func (t *memTable) page(format *piazza.JsonPagination) ([]interface{}, int64) {
+	docs := t.all()
+	total := int64(len(docs))
+
+	if format == nil {
+		return docs, total
+	}
+
+	if format.Order == piazza.PaginationOrderDescending {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	start, end := pageBounds(len(docs), format)
+	return docs[start:end], total
+}
+
+// pageBounds returns where the page starts and ends in a list of n items
+func pageBounds(n int, format *piazza.JsonPagination) (int, int) {
+	if format.PerPage <= 0 {
+		return 0, n
+	}
+	start := format.Page * format.PerPage
+	if start >= n {
+		return n, n
+	}
+	end := start + format.PerPage
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+//---------------------------------------------------------------------
+
+// MemMetricDB is an IMetricDB that keeps its Metrics in memory.
+type MemMetricDB struct {
+	table *memTable
+
+	// the ID of the Metric with each name, keyed by metricNameID
+	names      map[string]piazza.Ident
+	namesMutex sync.Mutex
+}
+
+func NewMemMetricDB() *MemMetricDB {
+	return &MemMetricDB{table: newMemTable(), names: map[string]piazza.Ident{}}
+}
+
+func (db *MemMetricDB) PostData(metric *Metric, id piazza.Ident) (piazza.Ident, error) {
+	obj := *metric
+	err := db.table.post(id, &obj)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("MemMetricDB.PostData failed: %s", err)
+	}
+	return id, nil
+}
+
+func (db *MemMetricDB) PutData(metric *Metric, id piazza.Ident) error {
+	obj := *metric
+	db.table.put(id, &obj)
+	return nil
+}
+
+func (db *MemMetricDB) GetAll(format *piazza.JsonPagination) ([]Metric, int64, error) {
+	docs, total := db.table.page(format)
+
+	metrics := []Metric{}
+	for _, doc := range docs {
+		metrics = append(metrics, *doc.(*Metric))
+	}
+	return metrics, total, nil
+}
+
+func (db *MemMetricDB) GetOne(id piazza.Ident) (*Metric, bool, error) {
+	doc, ok := db.table.get(id)
+	if !ok {
+		return nil, false, &notFoundError{fmt.Sprintf("MemMetricDB.GetOne failed: %s not found", id.String())}
+	}
+	metric := *doc.(*Metric)
+	return &metric, true, nil
+}
+
+func (db *MemMetricDB) GetByName(namespace string, name string) (*Metric, bool, error) {
+	for _, doc := range db.table.all() {
+		metric := *doc.(*Metric)
+		if metric.Namespace == namespace && metric.Name == name {
+			return &metric, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (db *MemMetricDB) ClaimName(namespace string, name string, id piazza.Ident) (piazza.Ident, error) {
+	db.namesMutex.Lock()
+	defer db.namesMutex.Unlock()
+
+	key := metricNameID(namespace, name)
+	owner, ok := db.names[key]
+	if ok {
+		return owner, nil
+	}
+	db.names[key] = id
+	return id, nil
+}
+
+func (db *MemMetricDB) ReleaseName(namespace string, name string, id piazza.Ident) error {
+	db.namesMutex.Lock()
+	defer db.namesMutex.Unlock()
+
+	key := metricNameID(namespace, name)
+	if db.names[key] == id {
+		delete(db.names, key)
+	}
+	return nil
+}
+
+func (db *MemMetricDB) Search(query *MetricQuery, format *piazza.JsonPagination) ([]Metric, int64, error) {
+	metrics := []Metric{}
+	for _, doc := range db.table.all() {
+		metric := doc.(*Metric)
+		if query.matches(metric) {
+			metrics = append(metrics, *metric)
+		}
+	}
+
+	switch format.SortBy {
+	case "name":
+		sort.Stable(byMetricName(metrics))
+	case "createdOn":
+		sort.Stable(byMetricCreatedOn(metrics))
+	}
+	if format.Order == piazza.PaginationOrderDescending {
+		for i, j := 0, len(metrics)-1; i < j; i, j = i+1, j-1 {
+			metrics[i], metrics[j] = metrics[j], metrics[i]
+		}
+	}
+
+	start, end := pageBounds(len(metrics), format)
+	return metrics[start:end], int64(len(metrics)), nil
+}
+
+type byMetricName []Metric
+
+func (a byMetricName) Len() int           { return len(a) }
+func (a byMetricName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMetricName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+type byMetricCreatedOn []Metric
+
+func (a byMetricCreatedOn) Len() int           { return len(a) }
+func (a byMetricCreatedOn) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMetricCreatedOn) Less(i, j int) bool { return a[i].CreatedOn.Before(a[j].CreatedOn) }
+
+func (db *MemMetricDB) DeleteByID(id piazza.Ident) (bool, error) {
+	if !db.table.delete(id) {
+		return false, fmt.Errorf("MemMetricDB.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+
+// MemDataDB is an IDataDB that keeps its Data in memory and computes
+// reports itself, instead of asking Elasticsearch for aggregations.
+type MemDataDB struct {
+	table *memTable
+}
+
+func NewMemDataDB() *MemDataDB {
+	return &MemDataDB{table: newMemTable()}
+}
+
+func (db *MemDataDB) PostData(data *Data, id piazza.Ident) (piazza.Ident, error) {
+	// same check Elasticsearch makes against the "date" mapping
+	_, err := time.Parse(time.RFC3339Nano, data.Timestamp)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("MemDataDB.PostData failed: bad timestamp: %s", err)
+	}
+
+	obj := *data
+	err = db.table.post(id, &obj)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("MemDataDB.PostData failed: %s", err)
+	}
+	return id, nil
+}
+
+func (db *MemDataDB) PostDataBatch(datas []Data) ([]error, error) {
+	errs := make([]error, len(datas))
+	for i := range datas {
+		_, errs[i] = db.PostData(&datas[i], datas[i].ID)
+	}
+	return errs, nil
+}
+
+func (db *MemDataDB) GetAll(format *piazza.JsonPagination) ([]Data, int64, error) {
+	docs, total := db.table.page(format)
+
+	datas := []Data{}
+	for _, doc := range docs {
+		datas = append(datas, *doc.(*Data))
+	}
+	return datas, total, nil
+}
+
+func (db *MemDataDB) GetOne(id piazza.Ident) (*Data, bool, error) {
+	doc, ok := db.table.get(id)
+	if !ok {
+		return nil, false, fmt.Errorf("MemDataDB.GetOne failed: %s not found", id.String())
+	}
+	data := *doc.(*Data)
+	return &data, true, nil
+}
+
+func (db *MemDataDB) DeleteByID(id piazza.Ident) (bool, error) {
+	if !db.table.delete(id) {
+		return false, fmt.Errorf("MemDataDB.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+func (db *MemDataDB) CountByMetric(id piazza.Ident) (int64, error) {
+	var count int64
+	for _, doc := range db.table.all() {
+		if doc.(*Data).MetricID == id {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *MemDataDB) DeleteByMetric(id piazza.Ident, progress func(int64)) (int64, error) {
+	var deleted int64
+	for _, doc := range db.table.all() {
+		data := doc.(*Data)
+		if data.MetricID != id {
+			continue
+		}
+		if db.table.delete(data.ID) {
+			deleted++
+		}
+	}
+	if progress != nil {
+		progress(deleted)
+	}
+	return deleted, nil
+}
+
+func (db *MemDataDB) DeleteOlderThan(id piazza.Ident, cutoff time.Time) (int64, error) {
+	var deleted int64
+	for _, doc := range db.table.all() {
+		data := doc.(*Data)
+		if data.MetricID != id {
+			continue
+		}
+		// the timestamp was checked when posted
+		t, _ := time.Parse(time.RFC3339Nano, data.Timestamp)
+		if !t.Before(cutoff) {
+			continue
+		}
+		if db.table.delete(data.ID) {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DropBefore deletes the Data, of every metric, with timestamps before the
+// cutoff. There are no partitions to drop.
+func (db *MemDataDB) DropBefore(cutoff time.Time) (int64, []string, error) {
+	var deleted int64
+	for _, doc := range db.table.all() {
+		data := doc.(*Data)
+		t, _ := time.Parse(time.RFC3339Nano, data.Timestamp)
+		if !t.Before(cutoff) {
+			continue
+		}
+		if db.table.delete(data.ID) {
+			deleted++
+		}
+	}
+	return deleted, []string{}, nil
+}
+
+// reportPoints returns the points of the metric in the time range of the
+// request, having all the labels the request asks for
+func (db *MemDataDB) reportPoints(id piazza.Ident, req *ReportRequest) []*Data {
+	datas := []*Data{}
+	for _, doc := range db.table.all() {
+		data := doc.(*Data)
+		if data.MetricID != id {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, data.Timestamp)
+		if err != nil {
+			continue
+		}
+		if t.Before(req.Start) || !t.Before(req.End) {
+			continue
+		}
+		if !hasLabels(data, req.Labels) {
+			continue
+		}
+		datas = append(datas, data)
+	}
+	return datas
+}
+
+func hasLabels(data *Data, labels map[string]string) bool {
+	for k, v := range labels {
+		if data.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func toMemPoints(datas []*Data) []memPoint {
+	points := make([]memPoint, len(datas))
+	for i, data := range datas {
+		// already checked by reportPoints
+		t, _ := time.Parse(time.RFC3339Nano, data.Timestamp)
+		points[i] = memPoint{timestamp: t, value: data.Value}
+	}
+	return points
+}
+
+func (db *MemDataDB) getLatest(id piazza.Ident) (*Data, bool, error) {
+	var latest *Data
+	var latestTime time.Time
+	for _, doc := range db.table.all() {
+		data := doc.(*Data)
+		if data.MetricID != id {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, data.Timestamp)
+		if err != nil {
+			continue
+		}
+		if latest == nil || t.After(latestTime) {
+			latest = data
+			latestTime = t
+		}
+	}
+	if latest == nil {
+		return nil, false, nil
+	}
+
+	data := *latest
+	return &data, true, nil
+}
+
+func (db *MemDataDB) GetPoints(id piazza.Ident, req *ReportRequest, limit int) ([]Data, error) {
+	points := db.reportPoints(id, req)
+	if limit > 0 && len(points) > limit {
+		return nil, errTooManyPoints
+	}
+	datas := []Data{}
+	for _, data := range points {
+		datas = append(datas, *data)
+	}
+	sort.Stable(byDataTime(datas))
+	return datas, nil
+}
+
+func (db *MemDataDB) GetByMetric(id piazza.Ident, start time.Time, end time.Time,
+	format *piazza.JsonPagination) ([]Data, int64, error) {
+
+	datas, err := db.GetPoints(id, &ReportRequest{Start: start, End: end}, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if format.Order == piazza.PaginationOrderDescending {
+		sort.Stable(sort.Reverse(byDataTime(datas)))
+	}
+
+	first, last := pageBounds(len(datas), format)
+	return datas[first:last], int64(len(datas)), nil
+}
+
+func (db *MemDataDB) GetSeries(id piazza.Ident, req *SeriesRequest) (map[int64]float64, error) {
+	agg, err := parseSeriesAggregator(req.Aggregator)
+	if err != nil {
+		return nil, err
+	}
+	step, err := parseDateInterval(req.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	datas, err := db.GetPoints(id, &ReportRequest{Start: req.Start, End: req.End}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := map[int64][]float64{}
+	for _, point := range toMemPoints(toDataPtrs(datas)) {
+		key := step.floor(point.timestamp).UnixNano() / int64(time.Millisecond)
+		steps[key] = append(steps[key], point.value)
+	}
+
+	values := map[int64]float64{}
+	for key, stepValues := range steps {
+		values[key] = agg.of(stepValues)
+	}
+	return values, nil
+}
+
+func toDataPtrs(datas []Data) []*Data {
+	ptrs := make([]*Data, len(datas))
+	for i := range datas {
+		ptrs[i] = &datas[i]
+	}
+	return ptrs
+}
+
+// byDataTime sorts Data whose timestamps are known to be good
+type byDataTime []Data
+
+func (a byDataTime) Len() int      { return len(a) }
+func (a byDataTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDataTime) Less(i, j int) bool {
+	ti, _ := time.Parse(time.RFC3339Nano, a[i].Timestamp)
+	tj, _ := time.Parse(time.RFC3339Nano, a[j].Timestamp)
+	return ti.Before(tj)
+}
+
+func (db *MemDataDB) GetLatestOfEach(ids []piazza.Ident) (map[piazza.Ident]*Data, error) {
+	latest := map[piazza.Ident]*Data{}
+	for _, id := range ids {
+		data, found, err := db.getLatest(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			latest[id] = data
+		}
+	}
+	return latest, nil
+}
+
+func (db *MemDataDB) GetSummaryOfEach(ids []piazza.Ident, req *ReportRequest) (map[piazza.Ident]*StatsReport, error) {
+	summaries := map[piazza.Ident]*StatsReport{}
+	for _, id := range ids {
+		stats, err := db.GetSummary(id, req)
+		if err != nil {
+			return nil, err
+		}
+		summaries[id] = stats
+	}
+	return summaries, nil
+}
+
+func (db *MemDataDB) GetSummary(id piazza.Ident, req *ReportRequest) (*StatsReport, error) {
+	datas := db.reportPoints(id, req)
+	values := make([]float64, len(datas))
+	for i, data := range datas {
+		values[i] = data.Value
+	}
+	stats := newMemStatsReport(values)
+	return &stats, nil
+}
+
+func (db *MemDataDB) ComputeRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error) {
+	points := toMemPoints(db.reportPoints(id, &ReportRequest{Start: start, End: end}))
+	return newRollups(id, tier, points), nil
+}
+
+func (db *MemDataDB) GetStats(id piazza.Ident, req *ReportRequest) (*FullReport, error) {
+	points := toMemPoints(db.reportPoints(id, req))
+	return newMemFullReport(points, req)
+}
+
+func (db *MemDataDB) GetGroupedStats(id piazza.Ident, req *ReportRequest) (*GroupedReport, error) {
+	groups := map[string][]*Data{}
+	for _, data := range db.reportPoints(id, req) {
+		value, ok := data.Labels[req.GroupBy]
+		if !ok {
+			continue
+		}
+		groups[value] = append(groups[value], data)
+	}
+
+	report := &GroupedReport{GroupBy: req.GroupBy, Groups: []LabelReport{}}
+	for value, datas := range groups {
+		full, err := newMemFullReport(toMemPoints(datas), req)
+		if err != nil {
+			return nil, err
+		}
+		report.Groups = append(report.Groups, LabelReport{Value: value, Report: *full})
+	}
+	sort.Sort(ByLabelValue(report.Groups))
+
+	return report, nil
+}
+
+//---------------------------------------------------------------------
+
+// MemAlertDB is an IAlertDB that keeps its AlertRules, AlertEvents and
+// NotificationChannels in memory.
+type MemAlertDB struct {
+	table    *memTable
+	events   *memTable
+	channels *memTable
+}
+
+func NewMemAlertDB() *MemAlertDB {
+	return &MemAlertDB{table: newMemTable(), events: newMemTable(), channels: newMemTable()}
+}
+
+func (db *MemAlertDB) PostData(rule *AlertRule, id piazza.Ident) (piazza.Ident, error) {
+	obj := *rule
+	err := db.table.post(id, &obj)
+	if err != nil {
+		return piazza.NoIdent, LoggedError("MemAlertDB.PostData failed: %s", err)
+	}
+	return id, nil
+}
+
+func (db *MemAlertDB) PutData(rule *AlertRule, id piazza.Ident) error {
+	obj := *rule
+	db.table.put(id, &obj)
+	return nil
+}
+
+func (db *MemAlertDB) GetAll(format *piazza.JsonPagination) ([]AlertRule, int64, error) {
+	docs, total := db.table.page(format)
+
+	rules := []AlertRule{}
+	for _, doc := range docs {
+		rules = append(rules, *doc.(*AlertRule))
+	}
+	return rules, total, nil
+}
+
+func (db *MemAlertDB) GetOne(id piazza.Ident) (*AlertRule, bool, error) {
+	doc, ok := db.table.get(id)
+	if !ok {
+		return nil, false, fmt.Errorf("MemAlertDB.GetOne failed: %s not found", id.String())
+	}
+	rule := *doc.(*AlertRule)
+	return &rule, true, nil
+}
+
+func (db *MemAlertDB) DeleteByID(id piazza.Ident) (bool, error) {
+	if !db.table.delete(id) {
+		return false, fmt.Errorf("MemAlertDB.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+func (db *MemAlertDB) PostEvent(event *AlertEvent) error {
+	obj := *event
+	err := db.events.post(event.ID, &obj)
+	if err != nil {
+		return LoggedError("MemAlertDB.PostEvent failed: %s", err)
+	}
+	return nil
+}
+
+func (db *MemAlertDB) GetEvents(alertID piazza.Ident, format *piazza.JsonPagination) ([]AlertEvent, int64, error) {
+	events := []AlertEvent{}
+	for _, doc := range db.events.all() {
+		event := doc.(*AlertEvent)
+		if event.AlertID == alertID {
+			events = append(events, *event)
+		}
+	}
+	total := int64(len(events))
+
+	if format.Order == piazza.PaginationOrderDescending {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+	start, end := pageBounds(len(events), format)
+	return events[start:end], total, nil
+}
+
+func (db *MemAlertDB) PostChannel(channel *NotificationChannel) error {
+	obj := *channel
+	err := db.channels.post(channel.ID, &obj)
+	if err != nil {
+		return LoggedError("MemAlertDB.PostChannel failed: %s", err)
+	}
+	return nil
+}
+
+func (db *MemAlertDB) GetChannels(format *piazza.JsonPagination) ([]NotificationChannel, int64, error) {
+	docs, total := db.channels.page(format)
+
+	channels := []NotificationChannel{}
+	for _, doc := range docs {
+		channels = append(channels, *doc.(*NotificationChannel))
+	}
+	return channels, total, nil
+}
+
+func (db *MemAlertDB) GetChannel(id piazza.Ident) (*NotificationChannel, bool, error) {
+	doc, ok := db.channels.get(id)
+	if !ok {
+		return nil, false, fmt.Errorf("MemAlertDB.GetChannel failed: %s not found", id.String())
+	}
+	channel := *doc.(*NotificationChannel)
+	return &channel, true, nil
+}
+
+func (db *MemAlertDB) DeleteChannel(id piazza.Ident) (bool, error) {
+	if !db.channels.delete(id) {
+		return false, fmt.Errorf("MemAlertDB.DeleteChannel failed: not found")
+	}
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+
+// MemDashboardDB is an IDashboardDB that keeps its Dashboards in memory.
+type MemDashboardDB struct {
+	table *memTable
+}
+
+func NewMemDashboardDB() *MemDashboardDB {
+	return &MemDashboardDB{table: newMemTable()}
+}
+
+// copyDashboard is a copy that shares nothing with the original
+func copyDashboard(dashboard *Dashboard) *Dashboard {
+	obj := *dashboard
+	obj.Panels = append([]DashboardPanel{}, dashboard.Panels...)
+	return &obj
+}
+
+func (db *MemDashboardDB) PostData(dashboard *Dashboard, id piazza.Ident) (piazza.Ident, error) {
+	err := db.table.post(id, copyDashboard(dashboard))
+	if err != nil {
+		return piazza.NoIdent, LoggedError("MemDashboardDB.PostData failed: %s", err)
+	}
+	return id, nil
+}
+
+func (db *MemDashboardDB) PutData(dashboard *Dashboard, id piazza.Ident) error {
+	db.table.put(id, copyDashboard(dashboard))
+	return nil
+}
+
+func (db *MemDashboardDB) GetAll(format *piazza.JsonPagination) ([]Dashboard, int64, error) {
+	docs, total := db.table.page(format)
+
+	dashboards := []Dashboard{}
+	for _, doc := range docs {
+		dashboards = append(dashboards, *copyDashboard(doc.(*Dashboard)))
+	}
+	return dashboards, total, nil
+}
+
+func (db *MemDashboardDB) GetOne(id piazza.Ident) (*Dashboard, bool, error) {
+	doc, ok := db.table.get(id)
+	if !ok {
+		return nil, false, fmt.Errorf("MemDashboardDB.GetOne failed: %s not found", id.String())
+	}
+	return copyDashboard(doc.(*Dashboard)), true, nil
+}
+
+func (db *MemDashboardDB) DeleteByID(id piazza.Ident) (bool, error) {
+	if !db.table.delete(id) {
+		return false, fmt.Errorf("MemDashboardDB.DeleteById failed: not found")
+	}
+	return true, nil
+}
+
+//---------------------------------------------------------------------
+
+// MemRollupDB is an IRollupDB that keeps its Rollups in memory.
+type MemRollupDB struct {
+	table *memTable
+}
+
+func NewMemRollupDB() *MemRollupDB {
+	return &MemRollupDB{table: newMemTable()}
+}
+
+func (db *MemRollupDB) PutRollups(rollups []Rollup) error {
+	for i := range rollups {
+		obj := rollups[i]
+		db.table.put(obj.ID, &obj)
+	}
+	return nil
+}
+
+// tierRollups returns the metric's rollups of the tier for the periods
+// starting in [start, end), oldest first
+func (db *MemRollupDB) tierRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) []Rollup {
+	rollups := []Rollup{}
+	for _, doc := range db.table.all() {
+		rollup := doc.(*Rollup)
+		if rollup.MetricID != id || rollup.Tier != tier {
+			continue
+		}
+		t := rollup.start()
+		if t.Before(start) || !t.Before(end) {
+			continue
+		}
+		rollups = append(rollups, *rollup)
+	}
+	sort.Sort(byRollupTime(rollups))
+	return rollups
+}
+
+func (db *MemRollupDB) GetRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error) {
+	return db.tierRollups(id, tier, start, end), nil
+}
+
+func (db *MemRollupDB) GetLatest(id piazza.Ident, tier RollupTier) (*Rollup, bool, error) {
+	rollups := db.tierRollups(id, tier, time.Time{}, maxDataTime)
+	if len(rollups) == 0 {
+		return nil, false, nil
+	}
+	return &rollups[len(rollups)-1], true, nil
+}
+
+func (db *MemRollupDB) DeleteByMetric(id piazza.Ident) (int64, error) {
+	var deleted int64
+	for _, doc := range db.table.all() {
+		rollup := doc.(*Rollup)
+		if rollup.MetricID != id {
+			continue
+		}
+		if db.table.delete(rollup.ID) {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,351 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions in this file compute, in process, the same aggregations
+// DataDB.GetStats asks Elasticsearch for.
+
+// the percentiles Elasticsearch reports when not asked for specific ones
+var defaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+// format used by ES for "strict_date_time"
+const strictDateTime = "2006-01-02T15:04:05.000Z07:00"
+
+type memPoint struct {
+	timestamp time.Time
+	value     float64
+}
+
+func newMemFullReport(points []memPoint, req *ReportRequest) (*FullReport, error) {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.value
+	}
+
+	interval, err := parseDateInterval(req.DateInterval)
+	if err != nil {
+		return nil, err
+	}
+	dateHist, err := newMemDateHistReport(points, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	valueHist, err := newMemValueHistReport(values, req.ValueInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FullReport{
+		StatsReport:     newMemStatsReport(values),
+		PercsReport:     newMemPercsReport(values, req.Percentiles, req.PercentileRanks),
+		DateHistReport:  *dateHist,
+		ValueHistReport: *valueHist,
+	}
+	return report, nil
+}
+
+//---------------------------------------------------------------------
+
+func newMemBucketStats(values []float64) BucketStats {
+	stats := BucketStats{Count: int64(len(values))}
+	if len(values) == 0 {
+		return stats
+	}
+
+	stats.Min = values[0]
+	stats.Max = values[0]
+	for _, v := range values {
+		stats.Sum += v
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+	}
+	stats.Avg = stats.Sum / float64(len(values))
+	return stats
+}
+
+// matches the ES "extended_stats" aggregation: population variance, and
+// bounds at two standard deviations from the mean
+func newMemStatsReport(values []float64) StatsReport {
+	bucket := newMemBucketStats(values)
+
+	stats := StatsReport{
+		Count: bucket.Count,
+		Min:   bucket.Min,
+		Max:   bucket.Max,
+		Avg:   bucket.Avg,
+		Sum:   bucket.Sum,
+	}
+	if stats.Count == 0 {
+		return stats
+	}
+
+	for _, v := range values {
+		stats.SumOfSquares += v * v
+	}
+	n := float64(stats.Count)
+	stats.Variance = math.Max(0.0, stats.SumOfSquares/n-stats.Avg*stats.Avg)
+	stats.StdDeviation = math.Sqrt(stats.Variance)
+	stats.StdDeviationBounds.Lower = stats.Avg - 2*stats.StdDeviation
+	stats.StdDeviationBounds.Upper = stats.Avg + 2*stats.StdDeviation
+
+	return stats
+}
+
+//---------------------------------------------------------------------
+
+// percentileKey formats a percent the way ES keys its percentiles, e.g. "5.0"
+func percentileKey(percent float64) string {
+	s := strconv.FormatFloat(percent, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// percentile uses linear interpolation between the closest ranks; the
+// values must already be sorted
+func percentile(sorted []float64, percent float64) float64 {
+	if len(sorted) == 0 {
+		return 0.0
+	}
+	rank := percent / 100.0 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo < 0 {
+		lo = 0
+	}
+	if hi >= len(sorted) {
+		hi = len(sorted) - 1
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[hi]-sorted[lo])
+}
+
+// newMemPercsReport has the percentiles, the default ones if none are
+// given, and the percentile ranks of the values
+func newMemPercsReport(values []float64, percents []float64, ranks []float64) PercsReport {
+	report := PercsReport{Values: map[string]float64{}}
+	if len(ranks) > 0 {
+		report.Ranks = map[string]float64{}
+	}
+	if len(values) == 0 {
+		return report
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	if len(percents) == 0 {
+		percents = defaultPercents
+	}
+	for _, p := range percents {
+		report.Values[percentileKey(p)] = percentile(sorted, p)
+	}
+	for _, v := range ranks {
+		report.Ranks[percentileKey(v)] = percentileRank(sorted, v)
+	}
+	return report
+}
+
+// percentileRank is the percent of the values at or below v; the values
+// must already be sorted
+func percentileRank(sorted []float64, v float64) float64 {
+	n := sort.Search(len(sorted), func(i int) bool { return sorted[i] > v })
+	return float64(n) / float64(len(sorted)) * 100.0
+}
+
+//---------------------------------------------------------------------
+
+// dateInterval is a parsed ES date histogram interval: either a calendar
+// unit (year, quarter, month, week) or a fixed duration
+type dateInterval struct {
+	calendar string
+	fixed    time.Duration
+}
+
+var calendarUnits = map[string]string{
+	"year": "year", "1y": "year",
+	"quarter": "quarter", "1q": "quarter",
+	"month": "month", "1M": "month",
+	"week": "week", "1w": "week",
+}
+
+var fixedUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+func parseDateInterval(s string) (*dateInterval, error) {
+	switch s {
+	case "day":
+		s = "1d"
+	case "hour":
+		s = "1h"
+	case "minute":
+		s = "1m"
+	case "second":
+		s = "1s"
+	}
+
+	if unit := calendarUnits[s]; unit != "" {
+		return &dateInterval{calendar: unit}, nil
+	}
+
+	// "ms" must be tried before "s" and "m"
+	for _, suffix := range []string{"ms", "s", "m", "h", "d", "w"} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+		if err != nil {
+			break
+		}
+		d := time.Duration(n * float64(fixedUnits[suffix]))
+		if d < time.Millisecond {
+			break
+		}
+		return &dateInterval{fixed: d}, nil
+	}
+
+	return nil, fmt.Errorf("invalid date interval: \"%s\"", s)
+}
+
+// floor returns the start of the bucket t falls in
+func (d *dateInterval) floor(t time.Time) time.Time {
+	t = t.UTC()
+	switch d.calendar {
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		m := (int(t.Month())-1)/3*3 + 1
+		return time.Date(t.Year(), time.Month(m), 1, 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "week":
+		// ES weeks start on Monday
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+
+	step := d.fixed.Nanoseconds() / int64(time.Millisecond)
+	ms := t.UnixNano() / int64(time.Millisecond)
+	key := ms - ms%step
+	if ms%step < 0 {
+		key -= step
+	}
+	return time.Unix(0, key*int64(time.Millisecond)).UTC()
+}
+
+// next returns the start of the bucket after the one starting at t
+func (d *dateInterval) next(t time.Time) time.Time {
+	switch d.calendar {
+	case "year":
+		return t.AddDate(1, 0, 0)
+	case "quarter":
+		return t.AddDate(0, 3, 0)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	}
+	return t.Add(d.fixed)
+}
+
+func newMemDateHistReport(points []memPoint, interval *dateInterval) (*DateHistReport, error) {
+	report := &DateHistReport{Buckets: []DateBucket{}}
+	if len(points) == 0 {
+		return report, nil
+	}
+
+	buckets := map[int64][]float64{}
+	first := interval.floor(points[0].timestamp)
+	last := first
+	for _, p := range points {
+		key := interval.floor(p.timestamp)
+		buckets[key.UnixNano()] = append(buckets[key.UnixNano()], p.value)
+		if key.Before(first) {
+			first = key
+		}
+		if key.After(last) {
+			last = key
+		}
+	}
+
+	// like "min_doc_count: 0", include the empty buckets in between
+	for key := first; !key.After(last); key = interval.next(key) {
+		if len(report.Buckets) == maxReportDateBuckets {
+			return nil, errTooManyDateBuckets
+		}
+		values := buckets[key.UnixNano()]
+		bucket := DateBucket{
+			Key:         float64(key.UnixNano() / int64(time.Millisecond)),
+			KeyAsString: key.Format(strictDateTime),
+			BucketStats: newMemBucketStats(values),
+			DocCount:    len(values),
+		}
+		report.Buckets = append(report.Buckets, bucket)
+	}
+
+	return report, nil
+}
+
+func newMemValueHistReport(values []float64, valueInterval string) (*ValueHistReport, error) {
+	interval, err := strconv.ParseFloat(valueInterval, 64)
+	if err != nil || interval <= 0.0 {
+		return nil, fmt.Errorf("invalid value interval: \"%s\"", valueInterval)
+	}
+
+	report := &ValueHistReport{Buckets: []ValueBucket{}}
+	if len(values) == 0 {
+		return report, nil
+	}
+
+	// like ES, only the buckets that have values in them
+	buckets := map[float64][]float64{}
+	for _, v := range values {
+		key := math.Floor(v/interval) * interval
+		buckets[key] = append(buckets[key], v)
+		if len(buckets) > maxReportValueBuckets {
+			return nil, errTooManyValueBuckets
+		}
+	}
+
+	for key, values := range buckets {
+		bucket := ValueBucket{
+			Key:         key,
+			BucketStats: newMemBucketStats(values),
+			DocCount:    len(values),
+		}
+		report.Buckets = append(report.Buckets, bucket)
+	}
+	sort.Sort(ByValueBucket(report.Buckets))
+
+	return report, nil
+}
@@ -15,13 +15,115 @@
 package metrics
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
 
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
 	"github.com/venicegeo/pz-gocommon/gocommon"
 )
 
+// IMetricDB is the storage interface for Metric objects. MetricDB is the
+// Elasticsearch-backed implementation; MemMetricDB keeps everything in memory.
+type IMetricDB interface {
+	PostData(metric *Metric, id piazza.Ident) (piazza.Ident, error)
+	PutData(metric *Metric, id piazza.Ident) error
+	GetAll(format *piazza.JsonPagination) ([]Metric, int64, error)
+	GetOne(id piazza.Ident) (*Metric, bool, error)
+	GetByName(namespace string, name string) (*Metric, bool, error)
+	ClaimName(namespace string, name string, id piazza.Ident) (piazza.Ident, error)
+	ReleaseName(namespace string, name string, id piazza.Ident) error
+	Search(query *MetricQuery, format *piazza.JsonPagination) ([]Metric, int64, error)
+	DeleteByID(id piazza.Ident) (bool, error)
+}
+
+// notFoundError is what GetOne returns when there is no such Metric, as
+// opposed to when the lookup itself failed
+type notFoundError struct {
+	message string
+}
+
+func (e *notFoundError) Error() string {
+	return e.message
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// MetricQuery selects the Metrics for GET /metric. Each field that is set
+// must match; the zero value matches every Metric.
+type MetricQuery struct {
+	Name      string // the name, or a pattern with "*" and "?" wildcards
+	Namespace string
+	Units     Units
+	Type      MetricType        // metrics with no type are gauges
+	Labels    map[string]string // labels the metric must have
+	Text      string            // words that must all be in the description, in any case
+}
+
+func (query *MetricQuery) isNameWildcard() bool {
+	return strings.ContainsAny(query.Name, "*?")
+}
+
+// descriptionWords splits the text into lower-case words, as ES does for
+// the analyzed description
+func descriptionWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matches is the query, for MemMetricDB
+func (query *MetricQuery) matches(metric *Metric) bool {
+	if query.Name != "" {
+		if query.isNameWildcard() {
+			pattern := regexp.QuoteMeta(query.Name)
+			pattern = strings.Replace(pattern, `\*`, ".*", -1)
+			pattern = strings.Replace(pattern, `\?`, ".", -1)
+			ok, _ := regexp.MatchString("^"+pattern+"$", metric.Name)
+			if !ok {
+				return false
+			}
+		} else if metric.Name != query.Name {
+			return false
+		}
+	}
+	if query.Namespace != "" && metric.Namespace != query.Namespace {
+		return false
+	}
+	if query.Units != "" && metric.Units != query.Units {
+		return false
+	}
+	if query.Type != "" && metric.TypeOrDefault() != query.Type {
+		return false
+	}
+	for k, v := range query.Labels {
+		if metric.Labels[k] != v {
+			return false
+		}
+	}
+	if query.Text != "" {
+		words := map[string]bool{}
+		for _, word := range descriptionWords(metric.Description) {
+			words[word] = true
+		}
+		for _, word := range descriptionWords(query.Text) {
+			if !words[word] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 type MetricDB struct {
 	*ResourceDB
 	mapping string
@@ -42,19 +144,59 @@ const MetricIndexSettings = `
 					"description": {
 						"type": "string",
 						"store": true,
-						"index": "not_analyzed"
+						"index": "not_analyzed",
+						"fields": {
+							"text": {
+								"type": "string"
+							}
+						}
 					},
 					"units": {
 						"type": "string",
 						"store": true,
 						"index": "not_analyzed"
 					},
+					"type": {
+						"type": "string",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"namespace": {
+						"type": "string",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"retention": {
+						"type": "string",
+						"store": true,
+						"index": "not_analyzed"
+					},
 					"datatype": {
 						"type": "string",
 						"store": true,
 						"index": "not_analyzed"
+					},
+					"createdOn": {
+						"type": "date",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"labels": {
+						"type": "object"
 					}
-				}
+				},
+				"dynamic_templates": [
+					{
+						"labels": {
+							"path_match": "labels.*",
+							"mapping": {
+								"type": "string",
+								"store": true,
+								"index": "not_analyzed"
+							}
+						}
+					}
+				]
             }
         }
 }`
@@ -65,11 +207,80 @@ func NewMetricDB(service *Service, esi elasticsearch.IIndex) (*MetricDB, error)
 		return nil, err
 	}
 	ardb := MetricDB{ResourceDB: rdb, mapping: MetricDBMapping}
+	err = ardb.updateMapping()
+	if err != nil {
+		return nil, err
+	}
 	return &ardb, nil
 }
 
-func (db *MetricDB) PostData(obj interface{}, id piazza.Ident) (piazza.Ident, error) {
-	indexResult, err := db.Esi.PostData(db.mapping, id.String(), obj)
+// updateMapping brings the mapping of an index made by an older version up
+// to MetricIndexSettings, which added description.text, createdOn and the
+// labels. The Metrics already in it are then indexed again, so that they
+// can be found by those fields too. Labels that ES already mapped by itself
+// keep that mapping, though, until the index is made again.
+func (db *MetricDB) updateMapping() error {
+	endpoint := fmt.Sprintf("/%s/_mapping/%s", db.Esi.IndexName(), db.mapping)
+	current := map[string]struct {
+		Mappings map[string]struct {
+			Properties map[string]struct {
+				Fields map[string]interface{} `json:"fields"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}{}
+	err := db.Esi.DirectAccess("GET", endpoint, nil, &current)
+	if err != nil {
+		return LoggedError("MetricDB.updateMapping failed: %s", err)
+	}
+	for _, index := range current {
+		props := index.Mappings[db.mapping].Properties
+		_, hasCreatedOn := props["createdOn"]
+		_, hasText := props["description"].Fields["text"]
+		if hasCreatedOn && hasText {
+			return nil
+		}
+	}
+
+	var settings struct {
+		Mappings map[string]*json.RawMessage `json:"mappings"`
+	}
+	err = json.Unmarshal([]byte(MetricIndexSettings), &settings)
+	if err != nil {
+		return err
+	}
+	mapping := fmt.Sprintf(`{"%s":%s}`, db.mapping, string(*settings.Mappings[db.mapping]))
+	err = db.Esi.SetMapping(db.mapping, piazza.JsonString(mapping))
+	if err != nil {
+		return LoggedError("MetricDB.updateMapping failed: %s", err)
+	}
+
+	log.Printf("Updated the mapping of index %s; indexing its metrics again", db.Esi.IndexName())
+	const perPage = 1000
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{
+			Page:    page,
+			PerPage: perPage,
+			SortBy:  "name",
+			Order:   piazza.PaginationOrderAscending,
+		}
+		metrics, _, err := db.GetAll(format)
+		if err != nil {
+			return err
+		}
+		for i := range metrics {
+			err = db.PutData(&metrics[i], metrics[i].ID)
+			if err != nil {
+				return err
+			}
+		}
+		if len(metrics) < perPage {
+			return nil
+		}
+	}
+}
+
+func (db *MetricDB) PostData(metric *Metric, id piazza.Ident) (piazza.Ident, error) {
+	indexResult, err := db.Esi.PostData(db.mapping, id.String(), metric)
 	if err != nil {
 		return piazza.NoIdent, LoggedError("MetricDB.PostData failed: %s", err)
 	}
@@ -80,6 +291,14 @@ func (db *MetricDB) PostData(obj interface{}, id piazza.Ident) (piazza.Ident, er
 	return id, nil
 }
 
+func (db *MetricDB) PutData(metric *Metric, id piazza.Ident) error {
+	_, err := db.Esi.PutData(db.mapping, id.String(), metric)
+	if err != nil {
+		return LoggedError("MetricDB.PutData failed: %s", err)
+	}
+	return nil
+}
+
 func (db *MetricDB) GetAll(format *piazza.JsonPagination) ([]Metric, int64, error) {
 	metrics := []Metric{}
 	exists, err := db.Esi.TypeExists(db.mapping)
@@ -115,11 +334,19 @@ func (db *MetricDB) GetAll(format *piazza.JsonPagination) ([]Metric, int64, erro
 func (db *MetricDB) GetOne(id piazza.Ident) (*Metric, bool, error) {
 	getResult, err := db.Esi.GetByID(db.mapping, id.String())
 	if err != nil {
+		// a missing document may come back as an error too
+		exists, existsErr := db.Esi.ItemExists(db.mapping, id.String())
+		if existsErr == nil && !exists {
+			return nil, false, &notFoundError{fmt.Sprintf("MetricDB.GetOne failed: %s not found", id.String())}
+		}
 		return nil, false, fmt.Errorf("MetricDB.GetOne failed: %s", err)
 	}
 	if getResult == nil {
 		return nil, true, fmt.Errorf("MetricDB.GetOne failed: %s no getResult", id.String())
 	}
+	if !getResult.Found {
+		return nil, false, &notFoundError{fmt.Sprintf("MetricDB.GetOne failed: %s not found", id.String())}
+	}
 
 	src := getResult.Source
 	var metric Metric
@@ -131,6 +358,237 @@ func (db *MetricDB) GetOne(id piazza.Ident) (*Metric, bool, error) {
 	return &metric, getResult.Found, nil
 }
 
+// GetByName returns the Metric with the name in the namespace, "" being no
+// namespace. The index is refreshed first, so that a Metric just created is
+// found.
+func (db *MetricDB) GetByName(namespace string, name string) (*Metric, bool, error) {
+	refreshEndpoint := fmt.Sprintf("/%s/_refresh", db.Esi.IndexName())
+	err := db.Esi.DirectAccess("POST", refreshEndpoint, nil, &map[string]interface{}{})
+	if err != nil {
+		return nil, false, LoggedError("MetricDB.GetByName failed: %s", err)
+	}
+
+	must := []interface{}{
+		map[string]interface{}{"term": newTermQuery("name", name)},
+	}
+	mustNot := []interface{}{}
+	if namespace == "" {
+		mustNot = append(mustNot, map[string]interface{}{
+			"exists": map[string]interface{}{"field": "namespace"},
+		})
+	} else {
+		must = append(must, map[string]interface{}{"term": newTermQuery("namespace", namespace)})
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     must,
+				"must_not": mustNot,
+			},
+		},
+		"size": 1,
+	}
+
+	endpoint := fmt.Sprintf("/%s/%s/_search", db.Esi.IndexName(), db.mapping)
+	out := &hitsResponse{}
+	err = db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, false, LoggedError("MetricDB.GetByName failed: %s", err)
+	}
+	if len(out.Hits.Hits) == 0 || out.Hits.Hits[0].Source == nil {
+		return nil, false, nil
+	}
+
+	var metric Metric
+	err = json.Unmarshal(*out.Hits.Hits[0].Source, &metric)
+	if err != nil {
+		return nil, false, err
+	}
+	return &metric, true, nil
+}
+
+// MetricNameDBMapping is the type, in the Metric index, of the documents
+// that keep the names unique: one per namespace and name, with the ID of the
+// Metric that has it.
+const MetricNameDBMapping string = "MetricName"
+
+type metricName struct {
+	MetricID piazza.Ident `json:"metricId"`
+}
+
+// metricNameID is the ID of the document for the name in the namespace. A
+// name has no "/", so the two can't run together.
+func metricNameID(namespace string, name string) string {
+	sum := sha1.Sum([]byte(namespace + "/" + name))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClaimName gives the name, in the namespace, to the Metric with the id,
+// unless another Metric has it already. It returns the ID of the Metric that
+// has the name. The document is created with op_type=create, so of two
+// services claiming a name at once, only one gets it.
+func (db *MetricDB) ClaimName(namespace string, name string, id piazza.Ident) (piazza.Ident, error) {
+	endpoint := fmt.Sprintf("/%s/%s/%s?op_type=create",
+		db.Esi.IndexName(), MetricNameDBMapping, metricNameID(namespace, name))
+
+	out := &createResponse{}
+	err := db.Esi.DirectAccess("PUT", endpoint, &metricName{MetricID: id}, out)
+	if err == nil && out.Created {
+		return id, nil
+	}
+
+	// a conflict, if the name is taken
+	owner, found, ownerErr := db.nameOwner(namespace, name)
+	if ownerErr == nil && found {
+		return owner, nil
+	}
+	if err == nil {
+		err = errors.New("not created")
+	}
+	return piazza.NoIdent, LoggedError("MetricDB.ClaimName failed: %s", err)
+}
+
+// ReleaseName lets another Metric have the name, in the namespace, if the
+// Metric with the id has it.
+func (db *MetricDB) ReleaseName(namespace string, name string, id piazza.Ident) error {
+	owner, found, err := db.nameOwner(namespace, name)
+	if err != nil {
+		return LoggedError("MetricDB.ReleaseName failed: %s", err)
+	}
+	if !found || owner != id {
+		return nil
+	}
+	_, err = db.Esi.DeleteByID(MetricNameDBMapping, metricNameID(namespace, name))
+	if err != nil {
+		return LoggedError("MetricDB.ReleaseName failed: %s", err)
+	}
+	return nil
+}
+
+// nameOwner returns the ID of the Metric that has the name in the namespace,
+// if any
+func (db *MetricDB) nameOwner(namespace string, name string) (piazza.Ident, bool, error) {
+	nameID := metricNameID(namespace, name)
+	getResult, err := db.Esi.GetByID(MetricNameDBMapping, nameID)
+	if err != nil {
+		// a missing document may come back as an error too
+		exists, existsErr := db.Esi.ItemExists(MetricNameDBMapping, nameID)
+		if existsErr == nil && !exists {
+			return piazza.NoIdent, false, nil
+		}
+		return piazza.NoIdent, false, err
+	}
+	if getResult == nil || !getResult.Found || getResult.Source == nil {
+		return piazza.NoIdent, false, nil
+	}
+
+	var claim metricName
+	err = json.Unmarshal(*getResult.Source, &claim)
+	if err != nil {
+		return piazza.NoIdent, false, err
+	}
+	return claim.MetricID, true, nil
+}
+
+// newMetricSearchQuery is the ES query for the Metrics matching the query
+func newMetricSearchQuery(query *MetricQuery) map[string]interface{} {
+	must := []interface{}{}
+
+	if query.Name != "" {
+		if query.isNameWildcard() {
+			must = append(must, map[string]interface{}{
+				"wildcard": newTermQuery("name", query.Name),
+			})
+		} else {
+			must = append(must, map[string]interface{}{"term": newTermQuery("name", query.Name)})
+		}
+	}
+	if query.Namespace != "" {
+		must = append(must, map[string]interface{}{"term": newTermQuery("namespace", query.Namespace)})
+	}
+	if query.Units != "" {
+		must = append(must, map[string]interface{}{"term": newTermQuery("units", string(query.Units))})
+	}
+	if query.Type == MetricTypeGauge {
+		// metrics from before there were types are gauges
+		must = append(must, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []interface{}{
+					map[string]interface{}{"term": newTermQuery("type", string(query.Type))},
+					map[string]interface{}{
+						"bool": map[string]interface{}{
+							"must_not": map[string]interface{}{
+								"exists": map[string]interface{}{"field": "type"},
+							},
+						},
+					},
+				},
+			},
+		})
+	} else if query.Type != "" {
+		must = append(must, map[string]interface{}{"term": newTermQuery("type", string(query.Type))})
+	}
+	for k, v := range query.Labels {
+		must = append(must, map[string]interface{}{"term": newTermQuery("labels."+k, v)})
+	}
+	if query.Text != "" {
+		must = append(must, map[string]interface{}{
+			"match": map[string]interface{}{
+				"description.text": map[string]interface{}{
+					"query":    query.Text,
+					"operator": "and",
+				},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": must,
+		},
+	}
+}
+
+// Search returns one page of the Metrics matching the query, and the number
+// of them in all.
+func (db *MetricDB) Search(query *MetricQuery, format *piazza.JsonPagination) ([]Metric, int64, error) {
+	endpoint := fmt.Sprintf("/%s/%s/_search", db.Esi.IndexName(), db.mapping)
+
+	in := map[string]interface{}{
+		"query": newMetricSearchQuery(query),
+		"from":  format.Page * format.PerPage,
+		"size":  format.PerPage,
+	}
+	if format.SortBy != "" {
+		order := "asc"
+		if format.Order == piazza.PaginationOrderDescending {
+			order = "desc"
+		}
+		in["sort"] = []interface{}{
+			map[string]interface{}{format.SortBy: map[string]interface{}{"order": order}},
+		}
+	}
+
+	out := &hitsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, in, out)
+	if err != nil {
+		return nil, 0, LoggedError("MetricDB.Search failed: %s", err)
+	}
+
+	metrics := []Metric{}
+	for _, hit := range out.Hits.Hits {
+		var metric Metric
+		err = json.Unmarshal(*hit.Source, &metric)
+		if err != nil {
+			return nil, 0, LoggedError("MetricDB.Search failed: %s", err)
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, out.Hits.Total, nil
+}
+
 func (db *MetricDB) DeleteByID(id piazza.Ident) (bool, error) {
 	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
 	if err != nil {
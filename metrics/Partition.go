@@ -0,0 +1,226 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The Data are written to monthly partitions: indices named after the data
+// index, plus the month, e.g. "datas-2016.07". ES creates each one, from
+// an index template, when the first Data for its month is written. The
+// template also puts every partition behind an alias, e.g. "datas_all",
+// which covers the data index itself too, so that any Data written to it
+// before partitioning are still found.
+//
+// A query with a time range goes only to the partitions that overlap the
+// range; one without goes to the alias. Dropping a partition is how old
+// Data are deleted in bulk.
+
+// the month suffix of a partition name
+const partitionFormat = "2006.01"
+
+// the most partitions a query will name; for a longer range, the alias is
+// searched instead
+const maxSearchPartitions = 36
+
+// partitionStart returns the start of the month t is in
+func partitionStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (db *DataDB) aliasName() string {
+	return db.Esi.IndexName() + "_all"
+}
+
+// partitionName returns the name of the partition Data at time t belong in
+func (db *DataDB) partitionName(t time.Time) string {
+	return db.Esi.IndexName() + "-" + t.UTC().Format(partitionFormat)
+}
+
+// dataPartition returns the name of the partition the Data belongs in. The
+// timestamp is checked when the Data is posted.
+func (db *DataDB) dataPartition(data *Data) string {
+	t, _ := time.Parse(time.RFC3339Nano, data.Timestamp)
+	return db.partitionName(t)
+}
+
+// parsePartition returns the start of the month of the named partition. If
+// the name isn't one of a partition, it returns false.
+func (db *DataDB) parsePartition(name string) (time.Time, bool) {
+	prefix := db.Esi.IndexName() + "-"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(partitionFormat, strings.TrimPrefix(name, prefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// searchTarget returns the indices to search for Data in [start, end): the
+// data index and each partition overlapping the range, or the alias if
+// that would be too many.
+func (db *DataDB) searchTarget(start time.Time, end time.Time) string {
+	if start.IsZero() || !end.After(start) {
+		return db.aliasName()
+	}
+
+	indices := []string{db.Esi.IndexName()}
+	for t := partitionStart(start); t.Before(end); t = t.AddDate(0, 1, 0) {
+		if len(indices) > maxSearchPartitions {
+			return db.aliasName()
+		}
+		indices = append(indices, db.partitionName(t))
+	}
+	return strings.Join(indices, ",")
+}
+
+// searchEndpoint returns the endpoint for a search of the target. The
+// partitions a target names may not all exist, which isn't an error.
+func (db *DataDB) searchEndpoint(target string, mapping string, params string) string {
+	path := "/" + target
+	if mapping != "" {
+		path += "/" + mapping
+	}
+	path += "/_search?ignore_unavailable=true"
+	if params != "" {
+		path += "&" + params
+	}
+	return path
+}
+
+// setupPartitions installs the template the partitions are created from,
+// and puts the data index behind the alias.
+func (db *DataDB) setupPartitions() error {
+	template := map[string]interface{}{}
+	err := json.Unmarshal([]byte(DataIndexSettings), &template)
+	if err != nil {
+		return err
+	}
+	template["template"] = db.Esi.IndexName() + "-*"
+	template["aliases"] = map[string]interface{}{
+		db.aliasName(): map[string]interface{}{},
+	}
+
+	endpoint := fmt.Sprintf("/_template/%s", db.Esi.IndexName())
+	err = db.Esi.DirectAccess("PUT", endpoint, template, &map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	in := map[string]interface{}{
+		"actions": []interface{}{
+			map[string]interface{}{
+				"add": map[string]interface{}{
+					"index": db.Esi.IndexName(),
+					"alias": db.aliasName(),
+				},
+			},
+		},
+	}
+	return db.Esi.DirectAccess("POST", "/_aliases", in, &map[string]interface{}{})
+}
+
+// partitions returns the names of the existing partitions, oldest first
+func (db *DataDB) partitions() ([]string, error) {
+	out := map[string]interface{}{}
+	err := db.Esi.DirectAccess("GET", "/_alias/"+db.aliasName(), nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range out {
+		if _, ok := db.parsePartition(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DropPartitions deletes every partition, and the template. The data index
+// itself is left for its owner to delete.
+func (db *DataDB) DropPartitions() error {
+	names, err := db.partitions()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = db.Esi.DirectAccess("DELETE", "/"+name, nil, &map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+	}
+	endpoint := fmt.Sprintf("/_template/%s", db.Esi.IndexName())
+	return db.Esi.DirectAccess("DELETE", endpoint, nil, &map[string]interface{}{})
+}
+
+// DropBefore deletes the Data, of every metric, with timestamps before the
+// cutoff. The partitions wholly before it are dropped, and returned; the
+// rest of the Data, in the data index and the partition the cutoff falls
+// in, are deleted one by one.
+func (db *DataDB) DropBefore(cutoff time.Time) (int64, []string, error) {
+	names, err := db.partitions()
+	if err != nil {
+		return 0, nil, LoggedError("DataDB.DropBefore failed: %s", err)
+	}
+
+	var deleted int64
+	dropped := []string{}
+	for _, name := range names {
+		start, _ := db.parsePartition(name)
+		if start.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+
+		out := &countResponse{}
+		err = db.Esi.DirectAccess("GET", "/"+name+"/_count", nil, out)
+		if err != nil {
+			return deleted, dropped, LoggedError("DataDB.DropBefore failed: %s", err)
+		}
+		err = db.Esi.DirectAccess("DELETE", "/"+name, nil, &map[string]interface{}{})
+		if err != nil {
+			return deleted, dropped, LoggedError("DataDB.DropBefore failed: %s", err)
+		}
+		deleted += out.Count
+		dropped = append(dropped, name)
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"constant_score": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"range": newRangeQuery("timestamp", time.Time{}, cutoff),
+				},
+			},
+		},
+	}
+	target := db.Esi.IndexName() + "," + db.partitionName(cutoff)
+	n, err := db.deleteByQuery(target, db.mapping, query, nil)
+	deleted += n
+	if err != nil {
+		return deleted, dropped, LoggedError("DataDB.DropBefore failed: %s", err)
+	}
+
+	return deleted, dropped, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rendering of metrics in the Prometheus text exposition format, version 0.0.4.
+
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// what the stored data of each metric is turned into, for GET /prometheus
+type PrometheusAggregate string
+
+const (
+	PrometheusLatest PrometheusAggregate = "latest"
+	PrometheusAvg    PrometheusAggregate = "avg"
+	PrometheusSum    PrometheusAggregate = "sum"
+	PrometheusMin    PrometheusAggregate = "min"
+	PrometheusMax    PrometheusAggregate = "max"
+	PrometheusCount  PrometheusAggregate = "count"
+)
+
+func (a PrometheusAggregate) valid() bool {
+	switch a {
+	case PrometheusLatest, PrometheusAvg, PrometheusSum, PrometheusMin, PrometheusMax, PrometheusCount:
+		return true
+	}
+	return false
+}
+
+func (a PrometheusAggregate) of(stats *StatsReport) float64 {
+	value, _ := stats.aggregate(string(a))
+	return value
+}
+
+var prometheusUnitSuffixes = map[Units]string{
+	UnitSeconds:      "_seconds",
+	UnitMilliseconds: "_milliseconds",
+	UnitBytes:        "_bytes",
+	UnitSquareYards:  "_square_yards",
+}
+
+// prometheusSample is one metric's value; counter is set when the value is
+// the count itself, not some aggregate of the counts
+type prometheusSample struct {
+	metric  *Metric
+	value   float64
+	counter bool
+}
+
+// prometheusName turns the metric's name into a legal Prometheus name, with
+// the suffix for its units
+func prometheusName(metric *Metric) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("pzmetrics_")
+	for _, r := range metric.Name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			buf.WriteRune(r)
+		default:
+			buf.WriteRune('_')
+		}
+	}
+
+	name := buf.String()
+	suffix := prometheusUnitSuffixes[metric.Units]
+	if !strings.HasSuffix(name, suffix) {
+		name += suffix
+	}
+	return name
+}
+
+func prometheusEscapeHelp(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func prometheusEscapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func prometheusValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// renderPrometheus writes one HELP/TYPE block per name. Different metrics
+// can end up with the same Prometheus name, so every sample carries the
+// metric's ID as a label, and a name is only typed as a counter if all its
+// samples are counters.
+func renderPrometheus(samples []prometheusSample) string {
+	byName := map[string][]prometheusSample{}
+	names := []string{}
+	for _, sample := range samples {
+		name := prometheusName(sample.metric)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], sample)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, name := range names {
+		group := byName[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, prometheusEscapeHelp(group[0].metric.Description))
+		typ := "counter"
+		for _, sample := range group {
+			if !sample.counter {
+				typ = "gauge"
+			}
+		}
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+		for _, sample := range group {
+			fmt.Fprintf(buf, "%s{metric_id=\"%s\"} %s\n", name,
+				prometheusEscapeLabel(sample.metric.ID.String()), prometheusValue(sample.value))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,199 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Rendering of reports as CSV, for spreadsheets. A report is a few tables,
+// one after another, each with its own header row and separated by a blank
+// line: the statistics, the percentiles, the percentile ranks if any were
+// asked for, the date histogram and the value histogram. A grouped report
+// has the same tables, with a first column for the value of the label
+// grouped by.
+
+const CsvContentType = "text/csv; charset=utf-8"
+
+func csvFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// csvBucketStats is the columns for a bucket's stats; an empty bucket has
+// only a count.
+func csvBucketStats(b *BucketStats) []string {
+	if b.Count == 0 {
+		return []string{"0", "", "", "", ""}
+	}
+	return []string{
+		strconv.FormatInt(b.Count, 10), csvFloat(b.Min), csvFloat(b.Max), csvFloat(b.Avg), csvFloat(b.Sum),
+	}
+}
+
+// csvGroup is one report to write, and the columns to lead its rows with
+type csvGroup struct {
+	prefix []string
+	report *FullReport
+}
+
+// csvTable is one table: its header, and how to make its rows from a report
+type csvTable struct {
+	header []string
+	rows   func(report *FullReport) [][]string
+}
+
+func csvStatsRows(report *FullReport) [][]string {
+	s := &report.StatsReport
+	rows := [][]string{
+		{"count", strconv.FormatInt(s.Count, 10)},
+		{"min", csvFloat(s.Min)},
+		{"max", csvFloat(s.Max)},
+		{"avg", csvFloat(s.Avg)},
+		{"sum", csvFloat(s.Sum)},
+		{"sum_of_squares", csvFloat(s.SumOfSquares)},
+		{"variance", csvFloat(s.Variance)},
+		{"std_deviation", csvFloat(s.StdDeviation)},
+		{"std_deviation_lower", csvFloat(s.StdDeviationBounds.Lower)},
+		{"std_deviation_upper", csvFloat(s.StdDeviationBounds.Upper)},
+	}
+	if r := report.RateReport; r != nil {
+		rows = append(rows,
+			[]string{"increase", csvFloat(r.Increase)},
+			[]string{"per_second", csvFloat(r.PerSecond)},
+			[]string{"resets", strconv.FormatInt(r.Resets, 10)},
+		)
+	}
+	return rows
+}
+
+func csvPercentileRows(report *FullReport) [][]string {
+	rows := [][]string{}
+	keys, percents := sortedPercsKeys(report.PercsReport.Values)
+	for i, k := range keys {
+		rows = append(rows, []string{csvFloat(percents[i]), csvFloat(report.PercsReport.Values[k])})
+	}
+	return rows
+}
+
+func csvRankRows(report *FullReport) [][]string {
+	rows := [][]string{}
+	keys, values := sortedPercsKeys(report.PercsReport.Ranks)
+	for i, k := range keys {
+		rows = append(rows, []string{csvFloat(values[i]), csvFloat(report.PercsReport.Ranks[k])})
+	}
+	return rows
+}
+
+func csvDateHistRows(withRates bool) func(report *FullReport) [][]string {
+	return func(report *FullReport) [][]string {
+		rows := [][]string{}
+		for i := range report.DateHistReport.Buckets {
+			b := &report.DateHistReport.Buckets[i]
+			t := time.Unix(0, int64(b.Key)*int64(time.Millisecond)).UTC()
+			row := append([]string{t.Format(time.RFC3339)}, csvBucketStats(&b.BucketStats)...)
+			if withRates {
+				if b.Rate != nil {
+					row = append(row, csvFloat(b.Rate.Increase), csvFloat(b.Rate.PerSecond),
+						strconv.FormatInt(b.Rate.Resets, 10))
+				} else {
+					row = append(row, "", "", "")
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+}
+
+func csvValueHistRows(report *FullReport) [][]string {
+	rows := [][]string{}
+	for i := range report.ValueHistReport.Buckets {
+		b := &report.ValueHistReport.Buckets[i]
+		rows = append(rows, append([]string{csvFloat(b.Key)}, csvBucketStats(&b.BucketStats)...))
+	}
+	return rows
+}
+
+// writeCsvGroups writes the tables for the reports, which are all made the
+// same way
+func writeCsvGroups(out io.Writer, groupHeader []string, groups []csvGroup) error {
+	// rollups have no distribution
+	distribution := true
+	withRates := false
+	withRanks := false
+	for _, group := range groups {
+		if tier := group.report.Tier; tier != "" && tier != RollupTierRaw {
+			distribution = false
+		}
+		if group.report.Type == MetricTypeCounter {
+			withRates = true
+		}
+		if group.report.PercsReport.Ranks != nil {
+			withRanks = true
+		}
+	}
+
+	tables := []csvTable{{[]string{"statistic", "value"}, csvStatsRows}}
+	if distribution {
+		tables = append(tables, csvTable{[]string{"percentile", "value"}, csvPercentileRows})
+	}
+	if distribution && withRanks {
+		tables = append(tables, csvTable{[]string{"value", "percentile_rank"}, csvRankRows})
+	}
+	header := []string{"timestamp", "count", "min", "max", "avg", "sum"}
+	if withRates {
+		header = append(header, "increase", "per_second", "resets")
+	}
+	tables = append(tables, csvTable{header, csvDateHistRows(withRates)})
+	if distribution {
+		header = []string{"value", "count", "min", "max", "avg", "sum"}
+		tables = append(tables, csvTable{header, csvValueHistRows})
+	}
+
+	w := csv.NewWriter(out)
+	for i, table := range tables {
+		if i > 0 {
+			w.Write([]string{})
+		}
+		w.Write(append(append([]string{}, groupHeader...), table.header...))
+		for _, group := range groups {
+			for _, row := range table.rows(group.report) {
+				w.Write(append(append([]string{}, group.prefix...), row...))
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WriteReportCsv writes the report, a *FullReport or a *GroupedReport, as
+// CSV.
+func WriteReportCsv(out io.Writer, report interface{}) error {
+	switch r := report.(type) {
+	case *FullReport:
+		return writeCsvGroups(out, []string{}, []csvGroup{{prefix: []string{}, report: r}})
+	case *GroupedReport:
+		groups := []csvGroup{}
+		for i := range r.Groups {
+			groups = append(groups, csvGroup{prefix: []string{r.Groups[i].Value}, report: &r.Groups[i].Report})
+		}
+		return writeCsvGroups(out, []string{r.GroupBy}, groups)
+	}
+	return fmt.Errorf("not a report: %T", report)
+}
@@ -0,0 +1,349 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//---------------------------------------------------------------------
+
+// OverflowPolicy says what a Reporter does with a new Data when its queue
+// is already full. The zero value means the default, OverflowDropOldest.
+type OverflowPolicy int
+
+const (
+	OverflowDropOldest OverflowPolicy = iota + 1 // discard the oldest queued Data
+	OverflowDropNewest                           // discard the new Data
+	OverflowBlock                                // wait for room in the queue
+)
+
+type ReporterConfig struct {
+	// send as soon as this many Data are queued...
+	BatchSize int
+	// ...or when this much time has passed since the last send
+	FlushInterval time.Duration
+
+	// at most this many Data are held in memory
+	QueueSize int
+	Overflow  OverflowPolicy
+
+	// a failed send is retried this many times, waiting InitialBackoff
+	// before the first retry and twice as long before each next one, up
+	// to MaxBackoff; a negative number means never retry. A batch that
+	// pz-metrics rejects as bad is not retried, but dropped.
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultReporterConfig = ReporterConfig{
+	BatchSize:      100,
+	FlushInterval:  10 * time.Second,
+	QueueSize:      10000,
+	Overflow:       OverflowDropOldest,
+	MaxRetries:     5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+}
+
+type ReporterStats struct {
+	Sent    int64 `json:"sent"`    // stored by pz-metrics
+	Failed  int64 `json:"failed"`  // sent, but rejected by pz-metrics, alone or with its batch
+	Dropped int64 `json:"dropped"` // never sent: queue overflow, or unsent at Close
+}
+
+//---------------------------------------------------------------------
+
+// Reporter queues Data in memory and posts them to pz-metrics in batches
+// from a background goroutine, so that the caller never waits on the network.
+type Reporter struct {
+	client *Client
+	config ReporterConfig
+
+	mutex   sync.Mutex
+	notFull *sync.Cond
+	queue   []Data
+	closed  bool
+	stats   ReporterStats
+	lastErr error
+
+	kick    chan struct{}
+	flushes chan chan error
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewReporter starts a Reporter that sends using the given client. Any field
+// left zero in the config is taken from DefaultReporterConfig; a nil config
+// means use all the defaults.
+func NewReporter(client *Client, config *ReporterConfig) (*Reporter, error) {
+	if client == nil {
+		return nil, errors.New("NewReporter: client is nil")
+	}
+
+	cfg := DefaultReporterConfig
+	if config != nil {
+		if config.Overflow != 0 {
+			cfg.Overflow = config.Overflow
+		}
+		if config.MaxRetries < 0 {
+			cfg.MaxRetries = 0
+		} else if config.MaxRetries > 0 {
+			cfg.MaxRetries = config.MaxRetries
+		}
+		if config.BatchSize > 0 {
+			cfg.BatchSize = config.BatchSize
+		}
+		if config.FlushInterval > 0 {
+			cfg.FlushInterval = config.FlushInterval
+		}
+		if config.QueueSize > 0 {
+			cfg.QueueSize = config.QueueSize
+		}
+		if config.InitialBackoff > 0 {
+			cfg.InitialBackoff = config.InitialBackoff
+		}
+		if config.MaxBackoff > 0 {
+			cfg.MaxBackoff = config.MaxBackoff
+		}
+	}
+	if cfg.BatchSize > MaxDataBatchSize {
+		return nil, LoggedError("NewReporter: batch size %d is over the limit of %d",
+			cfg.BatchSize, MaxDataBatchSize)
+	}
+	switch cfg.Overflow {
+	case OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return nil, LoggedError("NewReporter: unknown overflow policy %d", cfg.Overflow)
+	}
+
+	r := &Reporter{
+		client:  client,
+		config:  cfg,
+		queue:   []Data{},
+		kick:    make(chan struct{}, 1),
+		flushes: make(chan chan error),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	r.notFull = sync.NewCond(&r.mutex)
+
+	go r.run()
+
+	return r, nil
+}
+
+// PostData queues the data for sending. It only returns an error if the
+// Reporter has been closed.
+func (r *Reporter) PostData(data *Data) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.config.Overflow == OverflowBlock {
+		for !r.closed && len(r.queue) >= r.config.QueueSize {
+			r.notFull.Wait()
+		}
+	}
+	if r.closed {
+		return errors.New("Reporter.PostData: reporter is closed")
+	}
+
+	if len(r.queue) >= r.config.QueueSize {
+		if r.config.Overflow == OverflowDropNewest {
+			r.stats.Dropped++
+			return nil
+		}
+		r.queue = r.queue[1:]
+		r.stats.Dropped++
+	}
+	r.queue = append(r.queue, *data)
+
+	if len(r.queue) >= r.config.BatchSize {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Flush sends everything queued so far, and waits until that is done.
+func (r *Reporter) Flush() error {
+	reply := make(chan error)
+	select {
+	case r.flushes <- reply:
+		return <-reply
+	case <-r.stopped:
+		return errors.New("Reporter.Flush: reporter is closed")
+	}
+}
+
+// Close makes one last attempt at sending whatever is queued, without
+// waiting to retry, and stops the Reporter. Data still unsent is dropped.
+func (r *Reporter) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return errors.New("Reporter.Close: reporter is already closed")
+	}
+	r.closed = true
+	r.notFull.Broadcast()
+	r.mutex.Unlock()
+
+	close(r.done)
+	<-r.stopped
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.queue) > 0 {
+		r.stats.Dropped += int64(len(r.queue))
+		r.queue = []Data{}
+		return r.lastErr
+	}
+	return nil
+}
+
+func (r *Reporter) Stats() ReporterStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stats
+}
+
+//---------------------------------------------------------------------
+
+func (r *Reporter) run() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(r.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.sendAll()
+		case <-r.kick:
+			r.sendAll()
+		case reply := <-r.flushes:
+			reply <- r.sendAll()
+		case <-r.done:
+			r.sendAll()
+			return
+		}
+	}
+}
+
+// sendAll sends the queue, one batch at a time. A batch that can't be sent
+// goes back on the front of the queue, to be tried again later, unless
+// pz-metrics rejected it: sending it again would only fail again, and keep
+// the rest of the queue from being sent, so it is dropped and counted as
+// failed.
+func (r *Reporter) sendAll() error {
+	var rejected error
+	for {
+		r.mutex.Lock()
+		n := len(r.queue)
+		if n == 0 {
+			r.mutex.Unlock()
+			return rejected
+		}
+		if n > r.config.BatchSize {
+			n = r.config.BatchSize
+		}
+		batch := make([]Data, n)
+		copy(batch, r.queue[:n])
+		r.queue = r.queue[n:]
+		r.notFull.Broadcast()
+		r.mutex.Unlock()
+
+		result, status, err := r.sendWithRetry(batch)
+
+		r.mutex.Lock()
+		if err != nil && isRejected(status) {
+			r.lastErr = err
+			r.stats.Failed += int64(len(batch))
+			r.mutex.Unlock()
+			rejected = err
+			continue
+		}
+		if err != nil {
+			r.lastErr = err
+			r.requeue(batch)
+			r.mutex.Unlock()
+			return err
+		}
+		r.stats.Sent += int64(result.Created)
+		r.stats.Failed += int64(result.Failed)
+		r.mutex.Unlock()
+	}
+}
+
+// isRejected returns true if the status says the batch itself was refused,
+// rather than that the service couldn't take it just then
+func isRejected(status int) bool {
+	return status >= 400 && status < 500 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
+
+func (r *Reporter) sendWithRetry(batch []Data) (*DataBatchResult, int, error) {
+	backoff := r.config.InitialBackoff
+
+	for retry := 0; ; retry++ {
+		result, status, err := r.client.postDataBatch(batch)
+		if err == nil {
+			return result, status, nil
+		}
+		if retry >= r.config.MaxRetries || isRejected(status) {
+			return nil, status, err
+		}
+
+		// when closing, don't wait around to try again
+		select {
+		case <-time.After(backoff):
+		case <-r.done:
+			return nil, status, err
+		}
+
+		backoff *= 2
+		if backoff > r.config.MaxBackoff {
+			backoff = r.config.MaxBackoff
+		}
+	}
+}
+
+// requeue puts the batch back in front of the queue, and then applies the
+// overflow policy if that made the queue too long. When blocking, the queue
+// is allowed to stay over its size until the next send.
+func (r *Reporter) requeue(batch []Data) {
+	r.queue = append(batch, r.queue...)
+
+	over := len(r.queue) - r.config.QueueSize
+	if over <= 0 {
+		return
+	}
+
+	switch r.config.Overflow {
+	case OverflowDropOldest:
+		r.queue = r.queue[over:]
+		r.stats.Dropped += int64(over)
+	case OverflowDropNewest:
+		r.queue = r.queue[:r.config.QueueSize]
+		r.stats.Dropped += int64(over)
+	}
+}
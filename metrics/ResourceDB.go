@@ -14,7 +14,15 @@
 
 package metrics
 
-import "github.com/venicegeo/pz-gocommon/elasticsearch"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
 
 type ResourceDB struct {
 	service *Service
@@ -36,3 +44,180 @@ func NewResourceDB(service *Service, esi elasticsearch.IIndex, settings string)
 
 	return db, nil
 }
+
+//---------------------------------------------------------------------
+
+type bulkItemResult struct {
+	ID     string     `json:"_id"`
+	Status int        `json:"status"`
+	Error  *RootCause `json:"error"`
+}
+
+type bulkItem struct {
+	Index  *bulkItemResult `json:"index"`
+	Create *bulkItemResult `json:"create"`
+	Delete *bulkItemResult `json:"delete"`
+}
+
+func (item *bulkItem) result() *bulkItemResult {
+	if item.Index != nil {
+		return item.Index
+	}
+	if item.Create != nil {
+		return item.Create
+	}
+	if item.Delete != nil {
+		return item.Delete
+	}
+	return &bulkItemResult{}
+}
+
+type bulkResponse struct {
+	Errors bool        `json:"errors"`
+	Items  []*bulkItem `json:"items"`
+}
+
+// bulk sends the lines, one JSON object per line, to the ES bulk API and
+// returns the per-item results.
+//
+// The bulk API takes newline-delimited JSON, which DirectAccess can't send,
+// so this goes to ES directly.
+func (db *ResourceDB) bulk(lines []interface{}, numItems int) ([]*bulkItemResult, error) {
+	url, err := db.service.sys.GetURL(piazza.PzElasticSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	enc := json.NewEncoder(body)
+	for _, line := range lines {
+		err = enc.Encode(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := http.Post(url+"/_bulk", "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bulk request status %d", resp.StatusCode)
+	}
+
+	out := &bulkResponse{}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Items) != numItems {
+		return nil, fmt.Errorf("expected %d bulk items, got %d", numItems, len(out.Items))
+	}
+
+	results := make([]*bulkItemResult, numItems)
+	for i, item := range out.Items {
+		results[i] = item.result()
+	}
+	return results, nil
+}
+
+func (db *ResourceDB) bulkAction(index string, mapping string, action string, id piazza.Ident) map[string]interface{} {
+	return map[string]interface{}{
+		action: map[string]interface{}{
+			"_index": index,
+			"_type":  mapping,
+			"_id":    id.String(),
+		},
+	}
+}
+
+// deleteByQuery deletes all the documents of the mapping, in the target
+// indices, that the query matches. ES 2 has no delete-by-query without a
+// plugin, so this repeatedly looks up a page of matching IDs and bulk
+// deletes them. Target indices that don't exist are skipped.
+func (db *ResourceDB) deleteByQuery(target string, mapping string, query map[string]interface{}, progress func(int64)) (int64, error) {
+	searchEndpoint := fmt.Sprintf("/%s/%s/_search?ignore_unavailable=true", target, mapping)
+	refreshEndpoint := fmt.Sprintf("/%s/_refresh?ignore_unavailable=true", target)
+
+	query["size"] = deletePageSize
+	query["_source"] = false
+
+	var deleted int64
+	for {
+		err := db.Esi.DirectAccess("POST", refreshEndpoint, nil, &map[string]interface{}{})
+		if err != nil {
+			return deleted, err
+		}
+
+		out := &hitsResponse{}
+		err = db.Esi.DirectAccess("GET", searchEndpoint, query, out)
+		if err != nil {
+			return deleted, err
+		}
+		hits := out.Hits.Hits
+		if len(hits) == 0 {
+			return deleted, nil
+		}
+
+		lines := []interface{}{}
+		for _, hit := range hits {
+			lines = append(lines, db.bulkAction(hit.Index, mapping, "delete", piazza.Ident(hit.ID)))
+		}
+		results, err := db.bulk(lines, len(hits))
+		if err != nil {
+			return deleted, err
+		}
+		for _, result := range results {
+			if result.Error != nil {
+				return deleted, fmt.Errorf("%s: %s", result.Error.Type, result.Error.Reason)
+			}
+			deleted++
+		}
+
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+}
+
+type scrollResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	hitsResponse
+}
+
+// the number of documents fetched per scroll request
+const scrollPageSize = 1000
+
+// scroll runs the search, which must ask for a scroll, and calls f with
+// the source of every hit, a page at a time
+func (db *ResourceDB) scroll(endpoint string, query map[string]interface{}, f func(*json.RawMessage) error) error {
+	out := &scrollResponse{}
+	err := db.Esi.DirectAccess("POST", endpoint, query, out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		in := map[string]interface{}{"scroll_id": []string{out.ScrollID}}
+		db.Esi.DirectAccess("DELETE", "/_search/scroll", in, &map[string]interface{}{})
+	}()
+
+	for len(out.Hits.Hits) > 0 {
+		for _, hit := range out.Hits.Hits {
+			err = f(hit.Source)
+			if err != nil {
+				return err
+			}
+		}
+
+		in := map[string]interface{}{"scroll": "1m", "scroll_id": out.ScrollID}
+		out = &scrollResponse{}
+		err = db.Esi.DirectAccess("POST", "/_search/scroll", in, out)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
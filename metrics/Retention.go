@@ -0,0 +1,324 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// RetentionRun is one purge of the expired Data of every metric.
+type RetentionRun struct {
+	StartedOn  time.Time `json:"startedOn"`
+	FinishedOn time.Time `json:"finishedOn"`
+	Metrics    int       `json:"metrics"`              // how many metrics had a retention to apply
+	Deleted    int64     `json:"deleted"`              // how many Data were removed
+	Partitions []string  `json:"partitions,omitempty"` // the data partitions dropped
+	Message    string    `json:"message,omitempty"`    // why the run failed, if it did
+}
+
+// RetentionStatus is returned from GET /retention. Like Jobs, the runs are
+// only kept in memory.
+type RetentionStatus struct {
+	Default      string         `json:"default,omitempty"`  // for metrics with no retention of their own
+	Interval     string         `json:"interval,omitempty"` // how often the purge runs, if it does
+	TotalDeleted int64          `json:"totalDeleted"`       // since the service started
+	Runs         []RetentionRun `json:"runs"`               // the latest, newest first
+}
+
+// the default of $PZ_METRICS_RETENTION_INTERVAL
+const DefaultRetentionInterval = time.Hour
+
+// the most runs kept in the log; the oldest are forgotten first
+const maxRetentionRuns = 100
+
+// parseRetention parses a retention such as "30d" or "12h". Calendar
+// intervals, like "month", aren't allowed, as they have no fixed length.
+func parseRetention(s string) (time.Duration, error) {
+	interval, err := parseDateInterval(s)
+	if err != nil || interval.calendar != "" || interval.fixed <= 0 {
+		return 0, fmt.Errorf("invalid retention: \"%s\"", s)
+	}
+	return interval.fixed, nil
+}
+
+//---------------------------------------------------------------------
+
+// purgeLog holds the default retention and the runs, oldest first.
+// running is held for the length of a run, so that two never overlap.
+type purgeLog struct {
+	sync.Mutex
+	running sync.Mutex
+
+	defaultRetention string
+	runs             []RetentionRun
+	totalDeleted     int64
+}
+
+func (l *purgeLog) add(run *RetentionRun) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.runs = append(l.runs, *run)
+	if over := len(l.runs) - maxRetentionRuns; over > 0 {
+		l.runs = l.runs[over:]
+	}
+	l.totalDeleted += run.Deleted
+}
+
+// retentionPurger purges the expired Data every interval, until stopped
+type retentionPurger struct {
+	interval time.Duration
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// SetDefaultRetention sets how long the Data of a metric with no retention
+// of its own is kept, e.g. "30d". If "" (the default), it is kept forever.
+func (service *Service) SetDefaultRetention(s string) error {
+	if s != "" {
+		_, err := parseRetention(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	service.purges.Lock()
+	defer service.purges.Unlock()
+	service.purges.defaultRetention = s
+	return nil
+}
+
+// StartRetention starts purging the expired Data every interval, in the
+// background.
+func (service *Service) StartRetention(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("StartRetention: invalid interval: %s", interval)
+	}
+	if service.retention != nil {
+		return errors.New("StartRetention: already started")
+	}
+
+	purger := &retentionPurger{
+		interval: interval,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	service.retention = purger
+
+	go func() {
+		defer close(purger.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				service.purgeExpired(now)
+			case <-purger.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopRetention stops the purging started by StartRetention, waiting for
+// any run underway to finish.
+func (service *Service) StopRetention() {
+	if service.retention == nil {
+		return
+	}
+	close(service.retention.done)
+	<-service.retention.stopped
+	service.retention = nil
+}
+
+// longestRetention returns the longest retention of the metrics, the
+// default being that of those without one, or false if any keeps its Data
+// forever.
+func longestRetention(metrics []Metric, defaultRetention string) (time.Duration, bool) {
+	var longest time.Duration
+	for _, metric := range metrics {
+		retention := metric.Retention
+		if retention == "" {
+			retention = defaultRetention
+		}
+		if retention == "" {
+			return 0, false
+		}
+		keep, err := parseRetention(retention)
+		if err != nil {
+			return 0, false
+		}
+		if keep > longest {
+			longest = keep
+		}
+	}
+	return longest, true
+}
+
+// purgeExpired deletes, for each metric with a retention, the Data older
+// than now less the retention, and logs the run. A metric that can't be
+// purged doesn't stop the others from being; the run's message is the
+// first error.
+//
+// If every metric has a retention, the Data older than the longest of them
+// are dropped all at once, whole partitions at a time; only the metrics
+// with shorter retentions are then purged one by one.
+func (service *Service) purgeExpired(now time.Time) *RetentionRun {
+	service.purges.running.Lock()
+	defer service.purges.running.Unlock()
+
+	service.purges.Lock()
+	defaultRetention := service.purges.defaultRetention
+	service.purges.Unlock()
+
+	run := &RetentionRun{StartedOn: now}
+	fail := func(format string, a ...interface{}) {
+		if run.Message == "" {
+			run.Message = fmt.Sprintf(format, a...)
+		}
+	}
+
+	// the retention of each metric that has one
+	keeps := map[piazza.Ident]time.Duration{}
+	var longest time.Duration
+	forever := false
+
+	metrics, err := service.allMetrics()
+	if err != nil {
+		fail("%s", err)
+	}
+
+	for _, metric := range metrics {
+		retention := metric.Retention
+		if retention == "" {
+			retention = defaultRetention
+		}
+		if retention == "" {
+			forever = true
+			continue
+		}
+		keep, err := parseRetention(retention)
+		if err != nil {
+			fail("metric %s: %s", metric.ID.String(), err)
+			forever = true
+			continue
+		}
+		run.Metrics++
+		keeps[metric.ID] = keep
+		if keep > longest {
+			longest = keep
+		}
+	}
+
+	// dropping is only safe if we know every metric, and none keeps its
+	// Data forever. A metric made since we looked, or that we never got to
+	// see, has the default, so there must be one, and it is kept too.
+	drop := err == nil && !forever && len(keeps) > 0 && defaultRetention != ""
+	if drop {
+		keep, err := parseRetention(defaultRetention)
+		if err != nil {
+			fail("default: %s", err)
+			drop = false
+		} else if keep > longest {
+			longest = keep
+		}
+	}
+	if drop {
+		// a metric made or changed since we looked may keep its Data for
+		// longer, so they are read again, with this service making and
+		// changing none meanwhile, and nothing is dropped if one does
+		service.metricMutex.Lock()
+		metrics, err := service.allMetrics()
+		if err != nil {
+			fail("%s", err)
+			drop = false
+		} else if keep, ok := longestRetention(metrics, defaultRetention); !ok || keep > longest {
+			drop = false
+		}
+		if drop {
+			deleted, partitions, err := service.dataDB.DropBefore(now.Add(-longest))
+			run.Deleted += deleted
+			run.Partitions = partitions
+			if err != nil {
+				fail("%s", err)
+			}
+		}
+		service.metricMutex.Unlock()
+	}
+
+	for _, metric := range metrics {
+		keep, ok := keeps[metric.ID]
+		if !ok || (drop && keep == longest) {
+			continue
+		}
+		deleted, err := service.dataDB.DeleteOlderThan(metric.ID, now.Add(-keep))
+		run.Deleted += deleted
+		if err != nil {
+			fail("metric %s: %s", metric.ID.String(), err)
+		}
+	}
+
+	run.FinishedOn = time.Now()
+	service.purges.add(run)
+
+	log.Printf("Retention: deleted %d Data of %d metrics, dropped %d partitions",
+		run.Deleted, run.Metrics, len(run.Partitions))
+	if run.Message != "" {
+		log.Printf("Retention: %s", run.Message)
+	}
+
+	return run
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) GetRetention() *piazza.JsonResponse {
+	service.purges.Lock()
+	defer service.purges.Unlock()
+
+	status := &RetentionStatus{
+		Default:      service.purges.defaultRetention,
+		TotalDeleted: service.purges.totalDeleted,
+		Runs:         []RetentionRun{},
+	}
+	if service.retention != nil {
+		status.Interval = service.retention.interval.String()
+	}
+	for i := len(service.purges.runs) - 1; i >= 0; i-- {
+		status.Runs = append(status.Runs, service.purges.runs[i])
+	}
+
+	return service.newOKResponse(status)
+}
+
+// PostPurge purges the expired Data now, instead of waiting for the next
+// run, and returns the run.
+func (service *Service) PostPurge() *piazza.JsonResponse {
+	run := service.purgeExpired(time.Now())
+	if run.Message != "" {
+		return service.newInternalErrorResponse(errors.New(run.Message))
+	}
+	return service.newOKResponse(run)
+}
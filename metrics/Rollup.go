@@ -0,0 +1,709 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// RollupTier is the length of the periods Data are summarized over. Reports
+// and series say which tier they were made from; "raw" is the Data itself.
+type RollupTier string
+
+const (
+	RollupTierRaw  RollupTier = "raw"
+	RollupTierHour RollupTier = "hour"
+	RollupTierDay  RollupTier = "day"
+
+	// asks for the tier to be picked; only a request has it
+	RollupTierAuto RollupTier = "auto"
+)
+
+// the tiers that are rolled up, finest first
+var rollupTiers = []RollupTier{RollupTierHour, RollupTierDay}
+
+// Rollup is the summary of a metric's Data over one period of a tier.
+type Rollup struct {
+	ID           piazza.Ident `json:"id"`
+	MetricID     piazza.Ident `json:"metricId"`
+	Tier         RollupTier   `json:"tier"`
+	Timestamp    string       `json:"timestamp"` // the start of the period
+	Count        int64        `json:"count"`
+	Sum          float64      `json:"sum"`
+	Min          float64      `json:"min"`
+	Max          float64      `json:"max"`
+	SumOfSquares float64      `json:"sumOfSquares"`
+}
+
+// the default of $PZ_METRICS_ROLLUP_INTERVAL
+const DefaultRollupInterval = 10 * time.Minute
+
+// a tier is only picked for a range at least this many of its periods long
+const minRollupPeriods = 48
+
+// checkRollupTier returns an error if the tier, if given, isn't raw, auto or
+// one of the rolled up tiers
+func checkRollupTier(tier RollupTier) error {
+	switch tier {
+	case "", RollupTierRaw, RollupTierHour, RollupTierDay, RollupTierAuto:
+		return nil
+	}
+	return fmt.Errorf("invalid tier: \"%s\"", tier)
+}
+
+// interval returns the tier's period as a date histogram interval
+func (tier RollupTier) interval() *dateInterval {
+	if tier == RollupTierDay {
+		return &dateInterval{fixed: 24 * time.Hour}
+	}
+	return &dateInterval{fixed: time.Hour}
+}
+
+// holds returns whether every period of the tier falls entirely within one
+// bucket of the interval, so that the buckets can be made from rollups
+func (tier RollupTier) holds(interval *dateInterval) bool {
+	if interval.calendar != "" {
+		// weeks, months, quarters and years all start at midnight
+		return true
+	}
+	period := tier.interval().fixed
+	return interval.fixed >= period && interval.fixed%period == 0
+}
+
+func newRollupID(id piazza.Ident, tier RollupTier, start time.Time) piazza.Ident {
+	return piazza.Ident(fmt.Sprintf("%s:%s:%d", id.String(), tier, start.Unix()))
+}
+
+//---------------------------------------------------------------------
+
+func (r *Rollup) start() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, r.Timestamp)
+	return t
+}
+
+func (r *Rollup) add(value float64) {
+	if r.Count == 0 || value < r.Min {
+		r.Min = value
+	}
+	if r.Count == 0 || value > r.Max {
+		r.Max = value
+	}
+	r.Count++
+	r.Sum += value
+	r.SumOfSquares += value * value
+}
+
+func (r *Rollup) merge(other *Rollup) {
+	if other.Count == 0 {
+		return
+	}
+	if r.Count == 0 || other.Min < r.Min {
+		r.Min = other.Min
+	}
+	if r.Count == 0 || other.Max > r.Max {
+		r.Max = other.Max
+	}
+	r.Count += other.Count
+	r.Sum += other.Sum
+	r.SumOfSquares += other.SumOfSquares
+}
+
+func (r *Rollup) bucketStats() BucketStats {
+	stats := BucketStats{Count: r.Count}
+	if r.Count == 0 {
+		return stats
+	}
+	stats.Min = r.Min
+	stats.Max = r.Max
+	stats.Sum = r.Sum
+	stats.Avg = r.Sum / float64(r.Count)
+	return stats
+}
+
+// statsReport is what newMemStatsReport would make of the Data summarized
+func (r *Rollup) statsReport() StatsReport {
+	bucket := r.bucketStats()
+
+	stats := StatsReport{
+		Count:        bucket.Count,
+		Min:          bucket.Min,
+		Max:          bucket.Max,
+		Avg:          bucket.Avg,
+		Sum:          bucket.Sum,
+		SumOfSquares: r.SumOfSquares,
+	}
+	if stats.Count == 0 {
+		return stats
+	}
+
+	n := float64(stats.Count)
+	stats.Variance = math.Max(0.0, stats.SumOfSquares/n-stats.Avg*stats.Avg)
+	stats.StdDeviation = math.Sqrt(stats.Variance)
+	stats.StdDeviationBounds.Lower = stats.Avg - 2*stats.StdDeviation
+	stats.StdDeviationBounds.Upper = stats.Avg + 2*stats.StdDeviation
+
+	return stats
+}
+
+// newRollups summarizes the points, which may be in any order, one Rollup
+// per period of the tier that has any, in time order
+func newRollups(id piazza.Ident, tier RollupTier, points []memPoint) []Rollup {
+	interval := tier.interval()
+
+	byStart := map[int64]*Rollup{}
+	for _, p := range points {
+		start := interval.floor(p.timestamp)
+		rollup, ok := byStart[start.UnixNano()]
+		if !ok {
+			rollup = &Rollup{
+				ID:        newRollupID(id, tier, start),
+				MetricID:  id,
+				Tier:      tier,
+				Timestamp: start.Format(time.RFC3339),
+			}
+			byStart[start.UnixNano()] = rollup
+		}
+		rollup.add(p.value)
+	}
+
+	rollups := []Rollup{}
+	for _, rollup := range byStart {
+		rollups = append(rollups, *rollup)
+	}
+	sort.Sort(byRollupTime(rollups))
+	return rollups
+}
+
+type byRollupTime []Rollup
+
+func (a byRollupTime) Len() int           { return len(a) }
+func (a byRollupTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRollupTime) Less(i, j int) bool { return a[i].start().Before(a[j].start()) }
+
+//---------------------------------------------------------------------
+
+// newRollupReport is the report the rollups make, which are summaries over
+// periods that the date interval holds. Rollups have no distribution, so
+// the report has no percentiles and no value histogram.
+func newRollupReport(rollups []Rollup, interval *dateInterval) *FullReport {
+	total := &Rollup{}
+	for i := range rollups {
+		total.merge(&rollups[i])
+	}
+
+	return &FullReport{
+		StatsReport:     total.statsReport(),
+		PercsReport:     PercsReport{Values: map[string]float64{}},
+		DateHistReport:  *newRollupDateHistReport(rollups, interval),
+		ValueHistReport: ValueHistReport{Buckets: []ValueBucket{}},
+	}
+}
+
+// newRollupDateHistReport is like newMemDateHistReport, for rollups
+func newRollupDateHistReport(rollups []Rollup, interval *dateInterval) *DateHistReport {
+	report := &DateHistReport{Buckets: []DateBucket{}}
+	if len(rollups) == 0 {
+		return report
+	}
+
+	buckets := mergeRollups(rollups, interval)
+	first := interval.floor(rollups[0].start())
+	last := first
+	for i := range rollups {
+		key := interval.floor(rollups[i].start())
+		if key.Before(first) {
+			first = key
+		}
+		if key.After(last) {
+			last = key
+		}
+	}
+
+	for key := first; !key.After(last); key = interval.next(key) {
+		rollup := buckets[key.UnixNano()/int64(time.Millisecond)]
+		if rollup == nil {
+			rollup = &Rollup{}
+		}
+		bucket := DateBucket{
+			Key:         float64(key.UnixNano() / int64(time.Millisecond)),
+			KeyAsString: key.Format(strictDateTime),
+			BucketStats: rollup.bucketStats(),
+			DocCount:    int(rollup.Count),
+		}
+		report.Buckets = append(report.Buckets, bucket)
+	}
+
+	return report
+}
+
+// newRollupSeriesValues is GetSeries for rollups: the aggregate of each step
+// with data, keyed by the start of the step in milliseconds. The aggregator
+// must be one that rollups can answer.
+func newRollupSeriesValues(rollups []Rollup, step *dateInterval, agg *seriesAggregator) map[int64]float64 {
+	values := map[int64]float64{}
+	for key, rollup := range mergeRollups(rollups, step) {
+		stats := rollup.bucketStats()
+		switch agg.name {
+		case "sum":
+			values[key] = stats.Sum
+		case "min":
+			values[key] = stats.Min
+		case "max":
+			values[key] = stats.Max
+		case "count":
+			values[key] = float64(stats.Count)
+		default:
+			values[key] = stats.Avg
+		}
+	}
+	return values
+}
+
+// mergeRollups merges the rollups that fall in each bucket of the interval,
+// keyed by the start of the bucket in milliseconds
+func mergeRollups(rollups []Rollup, interval *dateInterval) map[int64]*Rollup {
+	buckets := map[int64]*Rollup{}
+	for i := range rollups {
+		key := interval.floor(rollups[i].start()).UnixNano() / int64(time.Millisecond)
+		if buckets[key] == nil {
+			buckets[key] = &Rollup{}
+		}
+		buckets[key].merge(&rollups[i])
+	}
+	return buckets
+}
+
+//---------------------------------------------------------------------
+
+// rollupMarks holds how far each metric has been rolled up in each tier:
+// every period before the mark is done, unless Data have been written to it
+// since, at or after the time it holds as late.
+type rollupMarks struct {
+	sync.Mutex
+	marks map[piazza.Ident]map[RollupTier]time.Time
+	late  map[piazza.Ident]map[RollupTier]time.Time
+}
+
+func (m *rollupMarks) get(id piazza.Ident, tier RollupTier) (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+	mark, ok := m.marks[id][tier]
+	return mark, ok
+}
+
+func (m *rollupMarks) set(id piazza.Ident, tier RollupTier, mark time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	if m.marks == nil {
+		m.marks = map[piazza.Ident]map[RollupTier]time.Time{}
+	}
+	if m.marks[id] == nil {
+		m.marks[id] = map[RollupTier]time.Time{}
+	}
+	m.marks[id][tier] = mark
+}
+
+func (m *rollupMarks) forget(id piazza.Ident) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.marks, id)
+	delete(m.late, id)
+}
+
+// wrote notes that Data at t have been written to the metric, so that its
+// periods are rolled up again if they already have been
+func (m *rollupMarks) wrote(id piazza.Ident, tier RollupTier, t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	if m.late == nil {
+		m.late = map[piazza.Ident]map[RollupTier]time.Time{}
+	}
+	if m.late[id] == nil {
+		m.late[id] = map[RollupTier]time.Time{}
+	}
+	if late, ok := m.late[id][tier]; !ok || t.Before(late) {
+		m.late[id][tier] = t
+	}
+}
+
+// getLate returns the earliest time Data have been written at since the
+// metric was last rolled up in the tier
+func (m *rollupMarks) getLate(id piazza.Ident, tier RollupTier) (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+	late, ok := m.late[id][tier]
+	return late, ok
+}
+
+// takeLate is getLate, and forgets the time
+func (m *rollupMarks) takeLate(id piazza.Ident, tier RollupTier) (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+	late, ok := m.late[id][tier]
+	delete(m.late[id], tier)
+	return late, ok
+}
+
+// rollupJob rolls up the new Data every interval, until stopped
+type rollupJob struct {
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// StartRollups starts rolling up the Data every interval, in the
+// background. The rollup storage must have been set up, by InitRollups or
+// InitInMemory.
+func (service *Service) StartRollups(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("StartRollups: invalid interval: %s", interval)
+	}
+	if service.rollupDB == nil {
+		return errors.New("StartRollups: no rollup storage")
+	}
+	if service.rollups != nil {
+		return errors.New("StartRollups: already started")
+	}
+
+	job := &rollupJob{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	service.rollups = job
+
+	go func() {
+		defer close(job.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				err := service.rollupAll(now)
+				if err != nil {
+					log.Printf("Rollups: %s", err.Error())
+				}
+			case <-job.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopRollups stops the rolling up started by StartRollups, waiting for any
+// run underway to finish.
+func (service *Service) StopRollups() {
+	if service.rollups == nil {
+		return
+	}
+	close(service.rollups.done)
+	<-service.rollups.stopped
+	service.rollups = nil
+}
+
+// rollupAll rolls up every metric in every tier, through the last period
+// complete as of now. A metric that can't be rolled up doesn't stop the
+// others from being; the first error is returned.
+func (service *Service) rollupAll(now time.Time) error {
+	metrics, err := service.allMetrics()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	n := 0
+	for _, metric := range metrics {
+		for _, tier := range rollupTiers {
+			count, err := service.rollupMetric(metric.ID, tier, now)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("metric %s: %s", metric.ID.String(), err)
+			}
+			n += count
+		}
+	}
+
+	log.Printf("Rollups: wrote %d rollups of %d metrics", n, len(metrics))
+	return firstErr
+}
+
+// rollupMetric writes the metric's rollups for the tier, from its mark up to
+// the last period complete as of now, and returns how many it wrote. The
+// period before the mark is done again, to take in Data that came late, and
+// so is every period since the earliest Data written since the last run.
+func (service *Service) rollupMetric(id piazza.Ident, tier RollupTier, now time.Time) (n int, err error) {
+	interval := tier.interval()
+	to := interval.floor(now)
+
+	late, isLate := service.rolledUp.takeLate(id, tier)
+	defer func() {
+		// if this run failed, the next one must still take them in
+		if err != nil && isLate {
+			service.rolledUp.wrote(id, tier, late)
+		}
+	}()
+
+	from, ok := service.rolledUp.get(id, tier)
+	if ok {
+		from = from.Add(-interval.fixed)
+	} else {
+		// after a restart, carry on from the latest rollup; for a new
+		// metric, start with its first Data
+		latest, found, err := service.rollupDB.GetLatest(id, tier)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			from = latest.start()
+		} else {
+			format := &piazza.JsonPagination{PerPage: 1, Order: piazza.PaginationOrderAscending}
+			datas, _, err := service.dataDB.GetByMetric(id, time.Time{}, maxDataTime, format)
+			if err != nil {
+				return 0, err
+			}
+			if len(datas) == 0 {
+				return 0, nil
+			}
+			first, err := time.Parse(time.RFC3339Nano, datas[0].Timestamp)
+			if err != nil {
+				return 0, err
+			}
+			from = interval.floor(first)
+		}
+	}
+	if isLate && late.Before(from) {
+		from = interval.floor(late)
+	}
+	if !from.Before(to) {
+		return 0, nil
+	}
+
+	rollups, err := service.dataDB.ComputeRollups(id, tier, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if len(rollups) > 0 {
+		err = service.rollupDB.PutRollups(rollups)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	service.rolledUp.set(id, tier, to)
+	return len(rollups), nil
+}
+
+// noteWritten notes the Data, once written, if they are in a period that
+// may have been rolled up already, so that it is done again
+func (service *Service) noteWritten(data *Data) {
+	if service.rollupDB == nil {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, data.Timestamp)
+	if err != nil {
+		return
+	}
+	for _, tier := range rollupTiers {
+		// with no mark, as after a restart, the rollups may be done anyway
+		mark, ok := service.rolledUp.get(data.MetricID, tier)
+		if !ok || t.Before(mark) {
+			service.rolledUp.wrote(data.MetricID, tier, t)
+		}
+	}
+}
+
+// deleteRollups deletes all the rollups of the metric
+func (service *Service) deleteRollups(id piazza.Ident) error {
+	if service.rollupDB == nil {
+		return nil
+	}
+	service.rolledUp.forget(id)
+	_, err := service.rollupDB.DeleteByMetric(id)
+	return err
+}
+
+//---------------------------------------------------------------------
+
+// pickRollupTier returns the tier to make a report or series over
+// [start, end) from, with buckets of the interval. If asked for a tier, it
+// is an error if that tier can't be used; if not, the coarsest tier that
+// can be used, whose periods the range spans at least minRollupPeriods of,
+// is picked, or else raw.
+func (service *Service) pickRollupTier(id piazza.Ident, asked RollupTier, start time.Time, end time.Time,
+	interval *dateInterval) (RollupTier, error) {
+
+	if asked == RollupTierRaw || (asked == "" && service.rollupDB == nil) {
+		return RollupTierRaw, nil
+	}
+	if service.rollupDB == nil {
+		return "", errors.New("data is not rolled up")
+	}
+
+	usable := func(tier RollupTier) error {
+		if !tier.holds(interval) {
+			return fmt.Errorf("the interval is not a whole number of %ss", tier)
+		}
+		mark, ok := service.rolledUp.get(id, tier)
+		if !ok || mark.Before(tier.interval().floor(end)) {
+			return fmt.Errorf("metric %s is not rolled up by %s through %s", id.String(), tier,
+				end.Format(time.RFC3339))
+		}
+		// Data written since the last run may be missing from the rollups
+		if late, ok := service.rolledUp.getLate(id, tier); ok && late.Before(mark) && late.Before(end) {
+			return fmt.Errorf("metric %s has Data at %s not yet rolled up by %s", id.String(),
+				late.Format(time.RFC3339), tier)
+		}
+		return nil
+	}
+
+	if asked != "" {
+		err := usable(asked)
+		if err != nil {
+			return "", err
+		}
+		return asked, nil
+	}
+
+	for i := len(rollupTiers) - 1; i >= 0; i-- {
+		tier := rollupTiers[i]
+		if end.Sub(start) < minRollupPeriods*tier.interval().fixed {
+			continue
+		}
+		if usable(tier) == nil {
+			return tier, nil
+		}
+	}
+	return RollupTierRaw, nil
+}
+
+// getRollups returns the rollups of the tier over [start, end), in time
+// order. Periods only partly in the range are summarized from the raw Data.
+func (service *Service) getRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error) {
+	interval := tier.interval()
+
+	first := interval.floor(start)
+	if first.Before(start) {
+		first = interval.next(first)
+	}
+	last := interval.floor(end)
+	if !first.Before(last) {
+		return service.dataDB.ComputeRollups(id, tier, start, end)
+	}
+
+	rollups := []Rollup{}
+	if start.Before(first) {
+		head, err := service.dataDB.ComputeRollups(id, tier, start, first)
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, head...)
+	}
+
+	body, err := service.rollupDB.GetRollups(id, tier, first, last)
+	if err != nil {
+		return nil, err
+	}
+	rollups = append(rollups, body...)
+
+	if last.Before(end) {
+		tail, err := service.dataDB.ComputeRollups(id, tier, last, end)
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, tail...)
+	}
+
+	return rollups, nil
+}
+
+// reportTier returns the tier to make the report from. Rollups have no
+// labels, and no distribution, so a report without percentiles or a value
+// histogram is only made from them when asked for: by the tier, or, for
+// gauges, by a tier of auto. A counter's rates need its Data in time order,
+// which rollups don't keep, so a counter report is always made from the
+// Data.
+func (service *Service) reportTier(id piazza.Ident, metric *Metric, req *ReportRequest) (RollupTier, error) {
+	if req.Tier == "" || req.Tier == RollupTierRaw {
+		return RollupTierRaw, nil
+	}
+	asked := req.Tier
+	if asked == RollupTierAuto {
+		asked = ""
+	}
+	if len(req.Labels) > 0 || req.GroupBy != "" {
+		if asked != "" {
+			return "", errors.New("rollups have no labels")
+		}
+		return RollupTierRaw, nil
+	}
+	if len(req.Percentiles) > 0 || len(req.PercentileRanks) > 0 {
+		if asked != "" {
+			return "", errors.New("rollups have no percentiles")
+		}
+		return RollupTierRaw, nil
+	}
+	if metric != nil && metric.TypeOrDefault() == MetricTypeCounter {
+		if asked != "" {
+			return "", errors.New("rollups have no counter rates")
+		}
+		return RollupTierRaw, nil
+	}
+	if asked == "" && (metric == nil || metric.TypeOrDefault() != MetricTypeGauge) {
+		return RollupTierRaw, nil
+	}
+
+	interval, err := parseDateInterval(req.DateInterval)
+	if err != nil {
+		if asked != "" {
+			return "", err
+		}
+		return RollupTierRaw, nil
+	}
+	return service.pickRollupTier(id, asked, req.Start, req.End, interval)
+}
+
+// seriesTier returns the tier to make the series from: rollups can only
+// be used for aggregators that don't need the Data themselves.
+func (service *Service) seriesTier(id piazza.Ident, req *SeriesRequest, step *dateInterval,
+	agg *seriesAggregator) (RollupTier, error) {
+
+	if req.Tier == RollupTierRaw {
+		return RollupTierRaw, nil
+	}
+	// a series made from rollups is the same as one made from the Data, so
+	// the tier is picked unless asked for
+	asked := req.Tier
+	if asked == RollupTierAuto {
+		asked = ""
+	}
+	switch agg.name {
+	case "avg", "sum", "min", "max", "count":
+	default:
+		if asked != "" {
+			return "", fmt.Errorf("rollups have no %s", req.Aggregator)
+		}
+		return RollupTierRaw, nil
+	}
+	return service.pickRollupTier(id, asked, req.Start, req.End, step)
+}
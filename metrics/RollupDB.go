@@ -0,0 +1,214 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/elasticsearch"
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// IRollupDB is the storage interface for Rollups. RollupDB is the
+// Elasticsearch-backed implementation; MemRollupDB keeps everything in
+// memory.
+type IRollupDB interface {
+	PutRollups(rollups []Rollup) error
+	GetRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error)
+	GetLatest(id piazza.Ident, tier RollupTier) (*Rollup, bool, error)
+	DeleteByMetric(id piazza.Ident) (int64, error)
+}
+
+// RollupDB keeps the rollups in their own index, apart from the Data.
+type RollupDB struct {
+	*ResourceDB
+	mapping string
+}
+
+const RollupDBMapping string = "Rollup"
+
+const RollupIndexSettings = `
+{
+        "mappings": {
+            "Rollup": {
+                "properties": {
+					"metricId": {
+						"type": "string",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"tier": {
+						"type": "string",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"timestamp": {
+						"type": "date",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"count": {
+						"type": "long",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"sum": {
+						"type": "double",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"min": {
+						"type": "double",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"max": {
+						"type": "double",
+						"store": true,
+						"index": "not_analyzed"
+					},
+					"sumOfSquares": {
+						"type": "double",
+						"store": true,
+						"index": "not_analyzed"
+					}
+                }
+            }
+        }
+}`
+
+func NewRollupDB(service *Service, esi elasticsearch.IIndex) (*RollupDB, error) {
+	rdb, err := NewResourceDB(service, esi, RollupIndexSettings)
+	if err != nil {
+		return nil, err
+	}
+	db := &RollupDB{ResourceDB: rdb, mapping: RollupDBMapping}
+	return db, nil
+}
+
+func newRollupTierQuery(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) map[string]interface{} {
+	and := newAndFilter(
+		map[string]interface{}{
+			"term":  newTermQuery("metricId", id.String()),
+			"range": newRangeQuery("timestamp", start, end),
+		},
+	)
+	and = append(and, map[string]interface{}{
+		"term": newTermQuery("tier", string(tier)),
+	})
+
+	return map[string]interface{}{
+		"constant_score": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"and": and,
+			},
+		},
+	}
+}
+
+// PutRollups stores the rollups with one bulk request, replacing any
+// already stored for the same periods.
+func (db *RollupDB) PutRollups(rollups []Rollup) error {
+	lines := []interface{}{}
+	for _, rollup := range rollups {
+		lines = append(lines, db.bulkAction(db.Esi.IndexName(), db.mapping, "index", rollup.ID), rollup)
+	}
+
+	results, err := db.bulk(lines, len(rollups))
+	if err != nil {
+		return LoggedError("RollupDB.PutRollups failed: %s", err)
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			return LoggedError("RollupDB.PutRollups failed: %s: %s", result.Error.Type, result.Error.Reason)
+		}
+		if result.Status != http.StatusCreated && result.Status != http.StatusOK {
+			return LoggedError("RollupDB.PutRollups failed: status %d", result.Status)
+		}
+	}
+	return nil
+}
+
+// GetRollups returns the metric's rollups of the tier for the periods
+// starting in [start, end), oldest first.
+func (db *RollupDB) GetRollups(id piazza.Ident, tier RollupTier, start time.Time, end time.Time) ([]Rollup, error) {
+	endpoint := fmt.Sprintf("/%s/%s/_search?scroll=1m", db.Esi.IndexName(), db.mapping)
+
+	query := map[string]interface{}{
+		"query": newRollupTierQuery(id, tier, start, end),
+		"size":  scrollPageSize,
+		"sort": []interface{}{
+			map[string]interface{}{"timestamp": map[string]interface{}{"order": "asc"}},
+		},
+	}
+
+	rollups := []Rollup{}
+	err := db.scroll(endpoint, query, func(source *json.RawMessage) error {
+		var rollup Rollup
+		err := json.Unmarshal(*source, &rollup)
+		if err != nil {
+			return err
+		}
+		rollups = append(rollups, rollup)
+		return nil
+	})
+	if err != nil {
+		return nil, LoggedError("RollupDB.GetRollups failed: %s", err)
+	}
+
+	return rollups, nil
+}
+
+// GetLatest returns the metric's rollup of the tier for the most recent
+// period. If there is none, it returns false.
+func (db *RollupDB) GetLatest(id piazza.Ident, tier RollupTier) (*Rollup, bool, error) {
+	endpoint := fmt.Sprintf("/%s/%s/_search", db.Esi.IndexName(), db.mapping)
+
+	query := map[string]interface{}{
+		"query": newRollupTierQuery(id, tier, time.Time{}, maxDataTime),
+		"size":  1,
+		"sort": []interface{}{
+			map[string]interface{}{"timestamp": map[string]interface{}{"order": "desc"}},
+		},
+	}
+
+	out := &hitsResponse{}
+	err := db.Esi.DirectAccess("GET", endpoint, query, out)
+	if err != nil {
+		return nil, false, LoggedError("RollupDB.GetLatest failed: %s", err)
+	}
+	if len(out.Hits.Hits) == 0 || out.Hits.Hits[0].Source == nil {
+		return nil, false, nil
+	}
+
+	var rollup Rollup
+	err = json.Unmarshal(*out.Hits.Hits[0].Source, &rollup)
+	if err != nil {
+		return nil, false, err
+	}
+	return &rollup, true, nil
+}
+
+// DeleteByMetric deletes the metric's rollups of every tier.
+func (db *RollupDB) DeleteByMetric(id piazza.Ident) (int64, error) {
+	deleted, err := db.deleteByQuery(db.Esi.IndexName(), db.mapping, newMetricIDQuery(id), nil)
+	if err != nil {
+		return deleted, LoggedError("RollupDB.DeleteByMetric failed: %s", err)
+	}
+	return deleted, nil
+}
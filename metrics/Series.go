@@ -0,0 +1,222 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// SeriesFill says what value a series has for a step with no data in it.
+type SeriesFill string
+
+const (
+	SeriesFillNull     SeriesFill = "null"     // no value
+	SeriesFillZero     SeriesFill = "zero"     // 0
+	SeriesFillPrevious SeriesFill = "previous" // the value of the step before
+)
+
+// SeriesRequest asks for the data of a metric, downsampled to one value per
+// step. The aggregator is one of avg, sum, min, max, count, last, or pN for
+// the Nth percentile, e.g. "p95" or "p99.9".
+type SeriesRequest struct {
+	Start      time.Time  `json:"start"`
+	End        time.Time  `json:"end"`
+	Step       string     `json:"step"` // as for a ReportRequest's DateInterval
+	Aggregator string     `json:"aggregator"`
+	Fill       SeriesFill `json:"fill"`
+	Tier       RollupTier `json:"tier,omitempty"` // as for a ReportRequest
+}
+
+// SeriesPoint is one step of a Series. In JSON it is the pair
+// [timestamp, value], with the timestamp in milliseconds since the epoch
+// and the value null if the step has none.
+type SeriesPoint struct {
+	Timestamp int64
+	Value     *float64
+}
+
+func (p SeriesPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Timestamp, p.Value})
+}
+
+func (p *SeriesPoint) UnmarshalJSON(b []byte) error {
+	var pair []*float64
+	err := json.Unmarshal(b, &pair)
+	if err != nil {
+		return err
+	}
+	if len(pair) != 2 || pair[0] == nil {
+		return fmt.Errorf("invalid series point: %s", string(b))
+	}
+	p.Timestamp = int64(*pair[0])
+	p.Value = pair[1]
+	return nil
+}
+
+// Series is returned from GET /series/:id: one point for each step from the
+// start of the request up to its end.
+type Series struct {
+	MetricID   piazza.Ident  `json:"metricId"`
+	Step       string        `json:"step"`
+	Aggregator string        `json:"aggregator"`
+	Fill       SeriesFill    `json:"fill"`
+	Tier       RollupTier    `json:"tier"` // what the series was made from
+	Points     []SeriesPoint `json:"points"`
+}
+
+// the most points a series may have
+const maxSeriesPoints = 10000
+
+//---------------------------------------------------------------------
+
+// seriesAggregator is a parsed SeriesRequest.Aggregator
+type seriesAggregator struct {
+	name    string  // avg, sum, min, max, count, last or percentile
+	percent float64 // for percentile
+}
+
+func parseSeriesAggregator(s string) (*seriesAggregator, error) {
+	switch s {
+	case "avg", "sum", "min", "max", "count", "last":
+		return &seriesAggregator{name: s}, nil
+	}
+
+	if strings.HasPrefix(s, "p") {
+		percent, err := strconv.ParseFloat(s[1:], 64)
+		if err == nil && percent >= 0.0 && percent <= 100.0 {
+			return &seriesAggregator{name: "percentile", percent: percent}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid aggregator: \"%s\"", s)
+}
+
+// of returns the aggregate of the values of one step, which are in time
+// order and never empty
+func (agg *seriesAggregator) of(values []float64) float64 {
+	switch agg.name {
+	case "count":
+		return float64(len(values))
+	case "last":
+		return values[len(values)-1]
+	case "percentile":
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Float64s(sorted)
+		return percentile(sorted, agg.percent)
+	}
+
+	stats := newMemBucketStats(values)
+	switch agg.name {
+	case "sum":
+		return stats.Sum
+	case "min":
+		return stats.Min
+	case "max":
+		return stats.Max
+	}
+	return stats.Avg
+}
+
+// checkSeriesRequest fills in the defaults of the request, and returns its
+// parsed step and aggregator
+func checkSeriesRequest(req *SeriesRequest) (*dateInterval, *seriesAggregator, error) {
+	if req.Aggregator == "" {
+		req.Aggregator = "avg"
+	}
+	if req.Fill == "" {
+		req.Fill = SeriesFillNull
+	}
+
+	if !req.Start.Before(req.End) {
+		return nil, nil, fmt.Errorf("start must be before end")
+	}
+	if req.Step == "" {
+		return nil, nil, fmt.Errorf("no step given")
+	}
+	step, err := parseDateInterval(req.Step)
+	if err != nil {
+		return nil, nil, err
+	}
+	agg, err := parseSeriesAggregator(req.Aggregator)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch req.Fill {
+	case SeriesFillNull, SeriesFillZero, SeriesFillPrevious:
+	default:
+		return nil, nil, fmt.Errorf("invalid fill: \"%s\"", req.Fill)
+	}
+	err = checkRollupTier(req.Tier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := 0
+	for t := step.floor(req.Start); t.Before(req.End); t = step.next(t) {
+		n++
+		if n > maxSeriesPoints {
+			return nil, nil, fmt.Errorf("too many steps: more than %d", maxSeriesPoints)
+		}
+	}
+
+	return step, agg, nil
+}
+
+// newSeries lays out one point per step, taking the values of the steps that
+// have data from values, keyed by the start of the step in milliseconds,
+// and filling in the others. Counts are always filled with zero, as that is
+// the true count of a step with no data.
+func newSeries(id piazza.Ident, req *SeriesRequest, step *dateInterval, agg *seriesAggregator,
+	values map[int64]float64) *Series {
+
+	series := &Series{
+		MetricID:   id,
+		Step:       req.Step,
+		Aggregator: req.Aggregator,
+		Fill:       req.Fill,
+		Points:     []SeriesPoint{},
+	}
+
+	var prev *float64
+	for t := step.floor(req.Start); t.Before(req.End); t = step.next(t) {
+		key := t.UnixNano() / int64(time.Millisecond)
+		point := SeriesPoint{Timestamp: key}
+
+		if v, ok := values[key]; ok && !math.IsNaN(v) {
+			point.Value = &v
+		} else if agg.name == "count" || req.Fill == SeriesFillZero {
+			zero := 0.0
+			point.Value = &zero
+		} else if req.Fill == SeriesFillPrevious {
+			point.Value = prev
+		}
+
+		if point.Value != nil {
+			prev = point.Value
+		}
+		series.Points = append(series.Points, point)
+	}
+
+	return series
+}
@@ -15,7 +15,12 @@
 package metrics
 
 import (
+	"bytes"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/venicegeo/pz-gocommon/gocommon"
@@ -29,6 +34,11 @@ type Server struct {
 const Version = "1.0.0"
 
 func (server *Server) handleGetRoot(c *gin.Context) {
+	// a browser is sent to the dashboard
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Redirect(http.StatusFound, "/ui")
+		return
+	}
 	resp := server.service.GetRoot()
 	piazza.GinReturnJson(c, resp)
 }
@@ -45,6 +55,7 @@ func (server *Server) handlePostMetric(c *gin.Context) {
 	if err != nil {
 		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
 		piazza.GinReturnJson(c, resp)
+		return
 	}
 	resp := server.service.PostMetric(&metric)
 	piazza.GinReturnJson(c, resp)
@@ -62,9 +73,48 @@ func (server *Server) handleGetMetric(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutMetric(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	var metric Metric
+	err := c.BindJSON(&metric)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutMetric(id, &metric)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePatchMetric(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	var patch MetricPatch
+	err := c.BindJSON(&patch)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PatchMetric(id, &patch)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetMetricByName(c *gin.Context) {
+	resp := server.service.GetMetricByName(c.Query("namespace"), c.Param("name"))
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetMetricData(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetDataRange(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteMetric(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteMetric(id)
+	cascade := c.Query("cascade") == "true"
+	resp := server.service.DeleteMetric(id, cascade)
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -74,11 +124,24 @@ func (server *Server) handlePostData(c *gin.Context) {
 	if err != nil {
 		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
 		piazza.GinReturnJson(c, resp)
+		return
 	}
 	resp := server.service.PostData(&data)
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePostDataBatch(c *gin.Context) {
+	var datas []Data
+	err := c.BindJSON(&datas)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostDataBatch(datas)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleGetData(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	//log.Printf("Server.handleGetData: %s", id.String())
@@ -92,15 +155,378 @@ func (server *Server) handleDeleteData(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
-func (server *Server) handleGetReport(c *gin.Context) {
+// GET /prometheus?aggregate=avg&window=5m
+func (server *Server) handleGetPrometheus(c *gin.Context) {
+	aggregate := PrometheusAggregate(c.DefaultQuery("aggregate", string(PrometheusLatest)))
+
+	window, err := time.ParseDuration(c.DefaultQuery("window", "5m"))
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	text, resp := server.service.GetPrometheus(aggregate, window)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	c.Data(http.StatusOK, PrometheusContentType, []byte(text))
+}
+
+func (server *Server) handleGetJob(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetJob(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetRetention(c *gin.Context) {
+	resp := server.service.GetRetention()
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostPurge(c *gin.Context) {
+	resp := server.service.PostPurge()
+	piazza.GinReturnJson(c, resp)
+}
+
+// GET /report/:id?start=...&end=...&dateInterval=1m&valueInterval=10
+func (server *Server) handleGetReport(c *gin.Context) {
+	var req *ReportRequest
+	var err error
+	if c.Request.ContentLength == 0 {
+		req, err = parseReportQuery(c)
+	} else {
+		// the body of a GET is still taken, for older clients
+		req = &ReportRequest{}
+		err = c.BindJSON(req)
+	}
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	server.returnReport(c, req)
+}
+
+func (server *Server) handlePostReport(c *gin.Context) {
 	var req ReportRequest
 	err := c.BindJSON(&req)
 	if err != nil {
 		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
 		piazza.GinReturnJson(c, resp)
+		return
+	}
+	server.returnReport(c, &req)
+}
+
+// returnReport makes the report for the request, and returns it as json or,
+// if asked for, as CSV
+func (server *Server) returnReport(c *gin.Context, req *ReportRequest) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetReport(id, req)
+	if resp.IsError() || !wantsCsv(c) {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := WriteReportCsv(&buf, resp.Data)
+	if err != nil {
+		piazza.GinReturnJson(c, server.service.newInternalErrorResponse(err))
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=\"report-"+id.String()+".csv\"")
+	c.Data(http.StatusOK, CsvContentType, buf.Bytes())
+}
+
+// GET /report/:id/chart.svg?start=...&end=...&dateInterval=1m&valueInterval=10&width=800&theme=dark
+func (server *Server) handleGetReportChart(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+
+	req := &ChartRequest{
+		Theme: ChartTheme(c.Query("theme")),
+		Style: ChartStyle(c.Query("style")),
+		Value: c.Query("value"),
+	}
+	query, err := parseReportQuery(c)
+	if err == nil {
+		req.ReportRequest = *query
+		req.Width, err = strconv.Atoi(c.DefaultQuery("width", "0"))
+	}
+	if err == nil {
+		req.Height, err = strconv.Atoi(c.DefaultQuery("height", "0"))
+	}
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	svg, resp := server.service.GetReportChart(id, req)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	c.Data(http.StatusOK, SvgContentType, []byte(svg))
+}
+
+// GET /compare?metricIds=a,b&start=...&end=...&dateInterval=1m&valueInterval=10
+func (server *Server) handleGetCompare(c *gin.Context) {
+	req := &CompareRequest{}
+	query, err := parseReportQuery(c)
+	if err == nil {
+		req.ReportRequest = *query
+		if ids := c.Query("metricIds"); ids != "" {
+			for _, id := range strings.Split(ids, ",") {
+				req.MetricIDs = append(req.MetricIDs, piazza.Ident(id))
+			}
+		}
+		if selector := c.Query("selector"); selector != "" {
+			req.Selector, err = parseLabelsParam(selector)
+		}
+	}
+	if err == nil {
+		req.AllowMixedUnits, err = strconv.ParseBool(c.DefaultQuery("allowMixedUnits", "false"))
+	}
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.CompareMetrics(req)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostCompare(c *gin.Context) {
+	var req CompareRequest
+	err := c.BindJSON(&req)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.CompareMetrics(&req)
+	piazza.GinReturnJson(c, resp)
+}
+
+// parseReportQuery makes a ReportRequest from the query parameters: start
+// and end as RFC3339, dateInterval, valueInterval, label as
+// "name1:value1,name2:value2", groupBy, tier, and percentiles and
+// percentileRanks as "99,99.9"
+func parseReportQuery(c *gin.Context) (*ReportRequest, error) {
+	req := &ReportRequest{
+		DateInterval:  c.Query("dateInterval"),
+		ValueInterval: c.Query("valueInterval"),
+		GroupBy:       c.Query("groupBy"),
+		Tier:          RollupTier(c.Query("tier")),
+	}
+	var err error
+	req.Start, err = time.Parse(time.RFC3339, c.Query("start"))
+	if err != nil {
+		return nil, err
+	}
+	req.End, err = time.Parse(time.RFC3339, c.Query("end"))
+	if err != nil {
+		return nil, err
+	}
+	if label := c.Query("label"); label != "" {
+		req.Labels, err = parseLabelsParam(label)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Percentiles, err = parseFloatsParam(c.Query("percentiles"))
+	if err != nil {
+		return nil, err
+	}
+	req.PercentileRanks, err = parseFloatsParam(c.Query("percentileRanks"))
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// parseFloatsParam parses numbers given as a query parameter, "1,2.5,3"
+func parseFloatsParam(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	floats := []float64{}
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: \"%s\"", f)
+		}
+		floats = append(floats, v)
+	}
+	return floats, nil
+}
+
+// wantsCsv is true if the request asks for CSV, by format=csv or by the
+// Accept header
+func wantsCsv(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(c.GetHeader("Accept"), "text/csv")
+}
+
+// GET /series/:id?start=...&end=...&step=1m&aggregator=avg&fill=null
+func (server *Server) handleGetSeries(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+
+	req := &SeriesRequest{
+		Step:       c.Query("step"),
+		Aggregator: c.Query("aggregator"),
+		Fill:       SeriesFill(c.Query("fill")),
+		Tier:       RollupTier(c.Query("tier")),
+	}
+	var err error
+	req.Start, err = time.Parse(time.RFC3339, c.Query("start"))
+	if err == nil {
+		req.End, err = time.Parse(time.RFC3339, c.Query("end"))
+	}
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	resp := server.service.GetSeries(id, req)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostAlert(c *gin.Context) {
+	var rule AlertRule
+	err := c.BindJSON(&rule)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostAlert(&rule)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlerts(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAlerts(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlert(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetAlert(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutAlert(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	var rule AlertRule
+	err := c.BindJSON(&rule)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
 	}
-	resp := server.service.GetReport(id, &req)
+	resp := server.service.PutAlert(id, &rule)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteAlert(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteAlert(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlertHistory(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAlertHistory(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostChannel(c *gin.Context) {
+	var channel NotificationChannel
+	err := c.BindJSON(&channel)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostChannel(&channel)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetChannels(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetChannels(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetChannel(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetChannel(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteChannel(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteChannel(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetChannelDeliveries(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetChannelDeliveries(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(dashboardPage))
+}
+
+func (server *Server) handlePostDashboard(c *gin.Context) {
+	var dashboard Dashboard
+	err := c.BindJSON(&dashboard)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostDashboard(&dashboard)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetDashboards(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetDashboards(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetDashboard(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetDashboard(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutDashboard(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	var dashboard Dashboard
+	err := c.BindJSON(&dashboard)
+	if err != nil {
+		resp := &piazza.JsonResponse{StatusCode: http.StatusBadRequest, Message: err.Error()}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutDashboard(id, &dashboard)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteDashboard(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteDashboard(id)
 	piazza.GinReturnJson(c, resp)
 }
 
@@ -110,17 +536,55 @@ func (server *Server) Init(service *Service) {
 	server.Routes = []piazza.RouteData{
 		{Verb: "GET", Path: "/", Handler: server.handleGetRoot},
 		{Verb: "GET", Path: "/version", Handler: server.handleGetVersion},
+		{Verb: "GET", Path: "/ui", Handler: server.handleGetUI},
 
 		{Verb: "GET", Path: "/metric", Handler: server.handleGetMetrics},
 		{Verb: "POST", Path: "/metric", Handler: server.handlePostMetric},
 
 		{Verb: "GET", Path: "/metric/:id", Handler: server.handleGetMetric},
+		{Verb: "PUT", Path: "/metric/:id", Handler: server.handlePutMetric},
+		{Verb: "PATCH", Path: "/metric/:id", Handler: server.handlePatchMetric},
 		{Verb: "DELETE", Path: "/metric/:id", Handler: server.handleDeleteMetric},
+		{Verb: "GET", Path: "/metric/:id/data", Handler: server.handleGetMetricData},
+		{Verb: "GET", Path: "/metricname/:name", Handler: server.handleGetMetricByName},
 
 		{Verb: "POST", Path: "/data", Handler: server.handlePostData},
+		{Verb: "POST", Path: "/data/batch", Handler: server.handlePostDataBatch},
 		{Verb: "GET", Path: "/data/:id", Handler: server.handleGetData},
 		{Verb: "DELETE", Path: "/data/:id", Handler: server.handleDeleteData},
 
 		{Verb: "GET", Path: "/report/:id", Handler: server.handleGetReport},
+		{Verb: "POST", Path: "/report/:id", Handler: server.handlePostReport},
+		{Verb: "GET", Path: "/report/:id/chart.svg", Handler: server.handleGetReportChart},
+		{Verb: "GET", Path: "/series/:id", Handler: server.handleGetSeries},
+
+		{Verb: "GET", Path: "/compare", Handler: server.handleGetCompare},
+		{Verb: "POST", Path: "/compare", Handler: server.handlePostCompare},
+
+		{Verb: "GET", Path: "/alert", Handler: server.handleGetAlerts},
+		{Verb: "POST", Path: "/alert", Handler: server.handlePostAlert},
+		{Verb: "GET", Path: "/alert/:id", Handler: server.handleGetAlert},
+		{Verb: "PUT", Path: "/alert/:id", Handler: server.handlePutAlert},
+		{Verb: "DELETE", Path: "/alert/:id", Handler: server.handleDeleteAlert},
+		{Verb: "GET", Path: "/alert/:id/history", Handler: server.handleGetAlertHistory},
+
+		{Verb: "GET", Path: "/channel", Handler: server.handleGetChannels},
+		{Verb: "POST", Path: "/channel", Handler: server.handlePostChannel},
+		{Verb: "GET", Path: "/channel/:id", Handler: server.handleGetChannel},
+		{Verb: "DELETE", Path: "/channel/:id", Handler: server.handleDeleteChannel},
+		{Verb: "GET", Path: "/channel/:id/deliveries", Handler: server.handleGetChannelDeliveries},
+
+		{Verb: "GET", Path: "/dashboard", Handler: server.handleGetDashboards},
+		{Verb: "POST", Path: "/dashboard", Handler: server.handlePostDashboard},
+		{Verb: "GET", Path: "/dashboard/:id", Handler: server.handleGetDashboard},
+		{Verb: "PUT", Path: "/dashboard/:id", Handler: server.handlePutDashboard},
+		{Verb: "DELETE", Path: "/dashboard/:id", Handler: server.handleDeleteDashboard},
+
+		{Verb: "GET", Path: "/job/:id", Handler: server.handleGetJob},
+
+		{Verb: "GET", Path: "/retention", Handler: server.handleGetRetention},
+		{Verb: "POST", Path: "/retention/purge", Handler: server.handlePostPurge},
+
+		{Verb: "GET", Path: "/prometheus", Handler: server.handleGetPrometheus},
 	}
 }
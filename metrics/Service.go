@@ -16,8 +16,12 @@ package metrics
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/venicegeo/pz-gocommon/elasticsearch"
@@ -29,10 +33,38 @@ const dataSchema = "DataIndex"
 
 type Service struct {
 	origin      string
+	sys         *piazza.SystemConfig
 	metricIndex elasticsearch.IIndex
 	dataIndex   elasticsearch.IIndex
-	metricDB    *MetricDB
-	dataDB      *DataDB
+	metricDB    IMetricDB
+	dataDB      IDataDB
+	alertDB     IAlertDB
+	dashboardDB IDashboardDB
+
+	// if set, Data for a MetricID that doesn't exist yet creates that Metric,
+	// instead of being rejected
+	autoCreateMetrics bool
+
+	// held while creating or renaming a metric, so that two can't be given
+	// the same name at once
+	metricMutex sync.Mutex
+
+	jobs *jobList
+
+	// held while changing an alert rule, so that the evaluator and the REST
+	// calls don't overwrite each other's changes
+	alertMutex sync.Mutex
+	alerts     *alertEvaluator
+
+	webhooks *webhooks
+
+	retention *retentionPurger
+	purges    purgeLog
+
+	// if nil, there are no rollups, and reports are always made from the Data
+	rollupDB IRollupDB
+	rollups  *rollupJob
+	rolledUp rollupMarks
 }
 
 func (service *Service) Init(
@@ -42,6 +74,10 @@ func (service *Service) Init(
 
 	var err error
 
+	service.sys = sys
+	service.jobs = newJobList()
+	service.webhooks = newWebhooks(DefaultWebhookConfig)
+
 	/***
 	err = esIndex.Delete()
 	if err != nil {
@@ -76,11 +112,58 @@ func (service *Service) Init(
 		return err
 	}
 
+	service.alertDB, err = NewAlertDB(service, metricIndex)
+	if err != nil {
+		return err
+	}
+
+	service.dashboardDB, err = NewDashboardDB(service, metricIndex)
+	if err != nil {
+		return err
+	}
+
 	service.origin = string(sys.Name)
 
 	return nil
 }
 
+// InitInMemory is like Init, except that the metrics and data are kept in
+// memory instead of in Elasticsearch. Nothing is persisted: this is for
+// development and testing without an ES cluster.
+func (service *Service) InitInMemory(sys *piazza.SystemConfig) error {
+	service.sys = sys
+	service.jobs = newJobList()
+	service.webhooks = newWebhooks(DefaultWebhookConfig)
+
+	service.metricDB = NewMemMetricDB()
+	service.dataDB = NewMemDataDB()
+	service.alertDB = NewMemAlertDB()
+	service.dashboardDB = NewMemDashboardDB()
+	service.rollupDB = NewMemRollupDB()
+
+	service.origin = string(sys.Name)
+
+	return nil
+}
+
+// InitRollups keeps the rollups in the given index, which is created if
+// need be. Until this is called, there are no rollups.
+func (service *Service) InitRollups(rollupIndex elasticsearch.IIndex) error {
+	rollupDB, err := NewRollupDB(service, rollupIndex)
+	if err != nil {
+		return err
+	}
+	service.rollupDB = rollupDB
+	return nil
+}
+
+// SetAutoCreateMetrics controls what happens to Data whose MetricID is not
+// a known Metric: when off (the default) the Data is rejected; when on, a
+// Metric with that ID is created for it.
+func (service *Service) SetAutoCreateMetrics(on bool) {
+	service.autoCreateMetrics = on
+}
+
 func (service *Service) makeMetricIndex(metricIndex elasticsearch.IIndex) error {
 	ok, err := metricIndex.IndexExists()
 	if err != nil {
@@ -209,6 +292,15 @@ func (service *Service) newStatusCreatedResponse(obj interface{}) *piazza.JsonRe
 	return resp
 }
 
+func (service *Service) newStatusAcceptedResponse(obj interface{}) *piazza.JsonResponse {
+	resp := &piazza.JsonResponse{StatusCode: http.StatusAccepted, Data: obj}
+	err := resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return resp
+}
+
 func (service *Service) newInternalErrorResponse(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusInternalServerError,
@@ -233,6 +325,65 @@ func (service *Service) newNotFoundResponse(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) newConflictResponse(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusConflict,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+// newReportErrorResponse is for when a report couldn't be made: a 400 if it
+// would have been too big, or else a 500
+func (service *Service) newReportErrorResponse(err error) *piazza.JsonResponse {
+	switch err {
+	case errTooManyPoints, errTooManyDateBuckets, errTooManyValueBuckets:
+		return service.newBadRequestResponse(err)
+	}
+	return service.newInternalErrorResponse(err)
+}
+
+// newLookupErrorResponse is for when a Metric wasn't found: a 404 if there
+// is no such Metric, or a 500 if it couldn't be looked up
+func (service *Service) newLookupErrorResponse(err error) *piazza.JsonResponse {
+	if isNotFound(err) {
+		return service.newNotFoundResponse(err)
+	}
+	return service.newInternalErrorResponse(err)
+}
+
+// newCheckErrorResponse is for when a check of a request failed: a 500 if it
+// failed because a Metric couldn't be looked up, or else a 400
+func (service *Service) newCheckErrorResponse(err error) *piazza.JsonResponse {
+	if _, ok := err.(*lookupError); ok {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newBadRequestResponse(err)
+}
+
+// lookupError is returned by a check that couldn't look up a Metric, as
+// opposed to one that found the request bad
+type lookupError struct {
+	err error
+}
+
+func (e *lookupError) Error() string {
+	return e.err.Error()
+}
+
+// metricExists returns true if there is a Metric with the ID, and a
+// lookupError if that couldn't be found out
+func (service *Service) metricExists(id piazza.Ident) (bool, error) {
+	_, found, err := service.metricDB.GetOne(id)
+	if found && err == nil {
+		return true, nil
+	}
+	if !found && isNotFound(err) {
+		return false, nil
+	}
+	return false, &lookupError{err}
+}
+
 func (service *Service) newIdent() (piazza.Ident, error) {
 	s := uuid.New() // TODO
 	//log.Printf("allocated new metric/data id: %s", s)
@@ -259,17 +410,36 @@ func (service *Service) GetRoot() *piazza.JsonResponse {
 
 func (service *Service) PostMetric(metric *Metric) *piazza.JsonResponse {
 
+	metric.Type = metric.TypeOrDefault()
+	err := checkMetric(metric)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
 	id, err := service.newIdent()
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
+	metric.ID = id
+	metric.CreatedOn = time.Now()
+
+	service.metricMutex.Lock()
+	defer service.metricMutex.Unlock()
+
+	err = service.claimMetricName(metric)
+	if isMetricNameError(err) {
+		return service.newConflictResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
 	id2, err := service.metricDB.PostData(metric, id)
 	if err != nil || id != id2 {
+		service.metricDB.ReleaseName(metric.Namespace, metric.Name, id)
 		return service.newInternalErrorResponse(err)
 	}
 
-	metric.ID = id
-
 	resp := &piazza.JsonResponse{
 		StatusCode: http.StatusOK,
 		Data:       metric,
@@ -283,16 +453,138 @@ func (service *Service) PostMetric(metric *Metric) *piazza.JsonResponse {
 	return resp
 }
 
+// claimMetricName gives the metric its name, in its namespace, returning a
+// metricNameError if another Metric already has it. The name is claimed in
+// storage, so that two services sharing it can't both give it out; Metrics
+// from before there was a claim for each name are looked for by name too.
+// The metricMutex must be held.
+func (service *Service) claimMetricName(metric *Metric) error {
+	other, found, err := service.metricDB.GetByName(metric.Namespace, metric.Name)
+	if err != nil {
+		return err
+	}
+	if found && other.ID != metric.ID {
+		return newMetricNameError(metric, other.ID)
+	}
+
+	owner, err := service.metricDB.ClaimName(metric.Namespace, metric.Name, metric.ID)
+	if err != nil {
+		return err
+	}
+	if owner != metric.ID {
+		return newMetricNameError(metric, owner)
+	}
+	return nil
+}
+
+// metricNameError is what claimMetricName returns when the name is taken
+type metricNameError struct {
+	message string
+}
+
+func (e *metricNameError) Error() string {
+	return e.message
+}
+
+func isMetricNameError(err error) bool {
+	_, ok := err.(*metricNameError)
+	return ok
+}
+
+func newMetricNameError(metric *Metric, other piazza.Ident) error {
+	if metric.Namespace == "" {
+		return &metricNameError{fmt.Sprintf("metric name already in use: %s (by %s)", metric.Name, other.String())}
+	}
+	return &metricNameError{fmt.Sprintf("metric name already in use in namespace %s: %s (by %s)",
+		metric.Namespace, metric.Name, other.String())}
+}
+
+// parseMetricQuery reads the query of GET /metric from its parameters:
+// "name", "namespace", "units", "type", "label" (e.g. "team:ops,tier:web")
+// and "text".
+func parseMetricQuery(params *piazza.HttpQueryParams) (*MetricQuery, error) {
+	query := &MetricQuery{}
+
+	// the first error, if any, is kept
+	var err error
+	get := func(key string) string {
+		if err != nil {
+			return ""
+		}
+		var s string
+		s, err = params.GetAsString(key, "")
+		return s
+	}
+	query.Name = get("name")
+	query.Namespace = get("namespace")
+	query.Units = Units(get("units"))
+	query.Type = MetricType(get("type"))
+	labels := get("label")
+	query.Text = get("text")
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Units != "" {
+		err = checkUnits(query.Units)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if query.Type != "" {
+		err = checkMetricType(query.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if labels != "" {
+		query.Labels, err = parseLabelsParam(labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return query, nil
+}
+
+// parseLabelsParam parses labels given as a query parameter,
+// "k1:v1,k2:v2"
+func parseLabelsParam(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, label := range strings.Split(s, ",") {
+		kv := strings.SplitN(label, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label: \"%s\"", label)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	err := checkLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// GetMetrics returns one page of the Metrics matching the query in the
+// parameters, sorted by name or by creation time.
 func (service *Service) GetMetrics(params *piazza.HttpQueryParams) *piazza.JsonResponse {
 	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
 		return service.newBadRequestResponse(err)
 	}
+	if format.SortBy != "" && format.SortBy != "name" && format.SortBy != "createdOn" {
+		return service.newBadRequestResponse(fmt.Errorf("invalid sortBy: \"%s\"", format.SortBy))
+	}
+
+	query, err := parseMetricQuery(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
 
 	var totalHits int64
 	var metrics []Metric
 
-	metrics, totalHits, err = service.metricDB.GetAll(format)
+	metrics, totalHits, err = service.metricDB.Search(query, format)
 	if err != nil {
 		return service.newBadRequestResponse(err)
 	}
@@ -310,92 +602,1166 @@ func (service *Service) GetMetrics(params *piazza.HttpQueryParams) *piazza.JsonR
 	return resp
 }
 
+// GetMetricByName returns the Metric with the name, in the namespace ("" for
+// none).
+func (service *Service) GetMetricByName(namespace string, name string) *piazza.JsonResponse {
+	metric, found, err := service.metricDB.GetByName(namespace, name)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	if !found {
+		return service.newNotFoundResponse(fmt.Errorf("metric not found: %s", name))
+	}
+	return service.newOKResponse(metric)
+}
+
 func (service *Service) GetMetric(id piazza.Ident) *piazza.JsonResponse {
 	metric, found, err := service.metricDB.GetOne(id)
 	if !found {
-		return service.newNotFoundResponse(err)
+		return service.newLookupErrorResponse(err)
 	}
 	if err != nil {
-		return service.newBadRequestResponse(err)
+		return service.newInternalErrorResponse(err)
 	}
 	return service.newOKResponse(metric)
 }
 
-func (service *Service) DeleteMetric(id piazza.Ident) *piazza.JsonResponse {
-	ok, err := service.metricDB.DeleteByID(id)
-	if !ok {
-		return service.newNotFoundResponse(err)
+// checkMetric returns an error if the metric's name, type, units or
+// retention are invalid
+func checkMetric(metric *Metric) error {
+	if metric.Name == "" {
+		return errors.New("metric has no name")
 	}
-	if err != nil {
-		return service.newBadRequestResponse(err)
+	// the name is part of the path of GET /metricname/:name
+	if strings.Contains(metric.Name, "/") {
+		return fmt.Errorf("invalid metric name, has a \"/\": %s", metric.Name)
 	}
 
-	return service.newOKResponse(nil)
+	err := checkMetricType(metric.Type)
+	if err != nil {
+		return err
+	}
+	err = checkLabels(metric.Labels)
+	if err != nil {
+		return err
+	}
+	err = checkUnits(metric.Units)
+	if err != nil {
+		return err
+	}
+	if metric.Retention != "" {
+		_, err = parseRetention(metric.Retention)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-//---------------------------------------------------------------------
-
-func (service *Service) PostData(data *Data) *piazza.JsonResponse {
-
-	id, err := service.newIdent()
+// PutMetric replaces the definition of the Metric, keeping its ID, and so
+// its Data. If the type is not given, it is kept.
+func (service *Service) PutMetric(id piazza.Ident, metric *Metric) *piazza.JsonResponse {
+	old, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return service.newLookupErrorResponse(err)
+	}
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
 
-	_, err = service.dataDB.PostData(data, id)
+	if metric.ID != "" && metric.ID != id {
+		return service.newBadRequestResponse(fmt.Errorf("metric id can't be changed: %s", metric.ID.String()))
+	}
+	if metric.Type == "" {
+		metric.Type = old.TypeOrDefault()
+	}
+	metric.CreatedOn = old.CreatedOn
+
+	return service.updateMetric(old, metric)
+}
+
+// PatchMetric changes just the fields of the Metric set in the patch.
+func (service *Service) PatchMetric(id piazza.Ident, patch *MetricPatch) *piazza.JsonResponse {
+	old, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return service.newLookupErrorResponse(err)
+	}
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
 
-	data.ID = id
+	metric := *old
+	metric.Type = old.TypeOrDefault()
+	if patch.Name != nil {
+		metric.Name = *patch.Name
+	}
+	if patch.Namespace != nil {
+		metric.Namespace = *patch.Namespace
+	}
+	if patch.Description != nil {
+		metric.Description = *patch.Description
+	}
+	if patch.Units != nil {
+		metric.Units = *patch.Units
+	}
+	if patch.Type != nil {
+		metric.Type = *patch.Type
+	}
+	if patch.Retention != nil {
+		metric.Retention = *patch.Retention
+	}
+	if patch.Labels != nil {
+		metric.Labels = patch.Labels
+	}
 
-	resp := &piazza.JsonResponse{
-		StatusCode: http.StatusOK,
-		Data:       data,
+	return service.updateMetric(old, &metric)
+}
+
+// updateMetric stores the new definition of the old Metric. The type of a
+// Metric with Data can't be changed, as the Data would no longer make sense:
+// e.g. a counter's values are running totals, a gauge's are not.
+func (service *Service) updateMetric(old *Metric, metric *Metric) *piazza.JsonResponse {
+	err := checkMetric(metric)
+	if err != nil {
+		return service.newBadRequestResponse(err)
 	}
 
-	err = resp.SetType()
+	if metric.Type != old.TypeOrDefault() {
+		count, err := service.dataDB.CountByMetric(old.ID)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		if count > 0 {
+			return service.newConflictResponse(
+				fmt.Errorf("metric %s has %d data, so its type can't be changed", old.ID.String(), count))
+		}
+	}
+
+	metric.ID = old.ID
+
+	service.metricMutex.Lock()
+	defer service.metricMutex.Unlock()
+
+	err = service.claimMetricName(metric)
+	if isMetricNameError(err) {
+		return service.newConflictResponse(err)
+	}
 	if err != nil {
 		return service.newInternalErrorResponse(err)
 	}
+	renamed := metric.Namespace != old.Namespace || metric.Name != old.Name
 
-	return resp
+	err = service.metricDB.PutData(metric, old.ID)
+	if err != nil {
+		if renamed {
+			service.metricDB.ReleaseName(metric.Namespace, metric.Name, old.ID)
+		}
+		return service.newInternalErrorResponse(err)
+	}
+	if renamed {
+		// the Metric is already renamed, so a failure here, which is logged,
+		// just keeps the old name from being used again
+		service.metricDB.ReleaseName(old.Namespace, old.Name, old.ID)
+	}
+	return service.newOKResponse(metric)
 }
 
-func (service *Service) GetData(id piazza.Ident) *piazza.JsonResponse {
-	//log.Printf("Service.GetData: %s", id.String())
+// cascading deletes of more data points than this are done as a Job
+const deleteJobThreshold = 1000
 
-	metric, found, err := service.dataDB.GetOne(id)
-	if !found {
-		return service.newNotFoundResponse(err)
+// DeleteMetric deletes the Metric. If the metric still has data, the delete
+// is refused unless cascade is set, in which case the data is deleted too.
+// When there is a lot of data, that is done in the background and the
+// response is a 202 with the Job to poll.
+//
+// With cascade set, data left behind by an earlier, failed delete is cleaned
+// up even though the metric itself is gone.
+func (service *Service) DeleteMetric(id piazza.Ident, cascade bool) *piazza.JsonResponse {
+	metric, found, err := service.metricDB.GetOne(id)
+	if !found && (!cascade || !isNotFound(err)) {
+		return service.newLookupErrorResponse(err)
 	}
+
+	count, err := service.dataDB.CountByMetric(id)
 	if err != nil {
-		return service.newBadRequestResponse(err)
+		return service.newInternalErrorResponse(err)
 	}
-	return service.newOKResponse(metric)
-}
 
-func (service *Service) DeleteData(id piazza.Ident) *piazza.JsonResponse {
-	ok, err := service.dataDB.DeleteByID(id)
-	if !ok {
-		return service.newNotFoundResponse(err)
+	if !found && count == 0 {
+		return service.newNotFoundResponse(fmt.Errorf("metric not found: %s", id.String()))
+	}
+	if count > 0 && !cascade {
+		err = fmt.Errorf("metric %s has %d data points: use cascade=true to delete them too",
+			id.String(), count)
+		return service.newConflictResponse(err)
+	}
+
+	// the metric goes first, so that no new data can be added while the
+	// old data is being deleted; its name is let go before it, so that a
+	// failure doesn't leave the name taken by no Metric
+	if found {
+		err = service.metricDB.ReleaseName(metric.Namespace, metric.Name, id)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		_, err = service.metricDB.DeleteByID(id)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
 	}
+
+	err = service.deleteRollups(id)
 	if err != nil {
-		return service.newBadRequestResponse(err)
+		return service.newInternalErrorResponse(err)
 	}
 
-	return service.newOKResponse(nil)
+	if count == 0 {
+		return service.newOKResponse(nil)
+	}
+
+	if count <= deleteJobThreshold {
+		_, err = service.dataDB.DeleteByMetric(id, nil)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		return service.newOKResponse(nil)
+	}
+
+	jobID, err := service.newIdent()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	job := &Job{
+		ID:        jobID,
+		Type:      JobTypeDeleteMetric,
+		Target:    id,
+		Status:    JobStatusRunning,
+		Total:     count,
+		CreatedOn: time.Now(),
+	}
+	service.jobs.add(job)
+
+	go func() {
+		_, err := service.dataDB.DeleteByMetric(id, func(deleted int64) {
+			service.jobs.update(jobID, func(job *Job) { job.Done = deleted })
+		})
+		service.jobs.finish(jobID, err)
+		log.Printf("Job %s (%s %s) finished", jobID.String(), JobTypeDeleteMetric, id.String())
+	}()
+
+	job, _ = service.jobs.get(jobID)
+	return service.newStatusAcceptedResponse(job)
 }
 
 //---------------------------------------------------------------------
 
-func (service *Service) GetReport(id piazza.Ident, req *ReportRequest) *piazza.JsonResponse {
-	//log.Printf("Service.GetReport(%s, %#v)", id, req)
+// checkMetricID returns an error if the Data can't be stored because its
+// MetricID is missing or unknown. Unknown metrics are created instead, if
+// the service has been set up to do that.
+func (service *Service) checkMetricID(id piazza.Ident) error {
+	if id == piazza.NoIdent {
+		return errors.New("data has no metricId")
+	}
 
-	stats, err := service.dataDB.GetStats(id, req)
+	found, err := service.metricExists(id)
 	if err != nil {
-		return service.newInternalErrorResponse(err)
+		return err
+	}
+	if found {
+		return nil
 	}
 
-	return service.newOKResponse(stats)
+	if !service.autoCreateMetrics {
+		return fmt.Errorf("metric not found: %s", id.String())
+	}
+
+	metric := &Metric{
+		ID:          id,
+		Name:        id.String(),
+		Description: "created automatically, for data posted to it",
+		Type:        MetricTypeGauge,
+	}
+	return service.ensureMetric(metric)
+}
+
+// ensureMetric creates the Metric, using the ID it already has, unless a
+// metric with that ID already exists. It is an error if another metric has
+// its name.
+func (service *Service) ensureMetric(metric *Metric) error {
+	id := metric.ID
+
+	found, err := service.metricExists(id)
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+
+	service.metricMutex.Lock()
+	defer service.metricMutex.Unlock()
+
+	err = service.claimMetricName(metric)
+	if err != nil {
+		return err
+	}
+
+	metric.CreatedOn = time.Now()
+	_, err = service.metricDB.PostData(metric, id)
+	if err != nil {
+		// someone else may have just created it
+		if found, _ := service.metricExists(id); found {
+			return nil
+		}
+		service.metricDB.ReleaseName(metric.Namespace, metric.Name, id)
+		return fmt.Errorf("unable to create metric %s: %s", id.String(), err)
+	}
+
+	log.Printf("Created metric: %s", id.String())
+	return nil
+}
+
+func (service *Service) PostData(data *Data) *piazza.JsonResponse {
+
+	err := checkLabels(data.Labels)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	err = service.checkMetricID(data.MetricID)
+	if err != nil {
+		return service.newCheckErrorResponse(err)
+	}
+
+	id, err := service.newIdent()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	data.ID = id
+
+	_, err = service.dataDB.PostData(data, id)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	service.noteWritten(data)
+
+	resp := &piazza.JsonResponse{
+		StatusCode: http.StatusOK,
+		Data:       data,
+	}
+
+	err = resp.SetType()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return resp
+}
+
+func (service *Service) PostDataBatch(datas []Data) *piazza.JsonResponse {
+	if len(datas) == 0 {
+		return service.newBadRequestResponse(errors.New("batch contains no data"))
+	}
+	if len(datas) > MaxDataBatchSize {
+		err := fmt.Errorf("batch contains %d data, limit is %d", len(datas), MaxDataBatchSize)
+		return service.newBadRequestResponse(err)
+	}
+
+	result := &DataBatchResult{Items: make([]DataBatchItem, len(datas))}
+
+	// check each metric only once per batch
+	checked := map[piazza.Ident]error{}
+
+	valid := []Data{}
+	validIndex := []int{}
+	for i := range datas {
+		metricID := datas[i].MetricID
+		err, ok := checked[metricID]
+		if !ok {
+			err = service.checkMetricID(metricID)
+			checked[metricID] = err
+		}
+		if _, ok := err.(*lookupError); ok {
+			// not the data's fault, so the batch can be tried again
+			return service.newInternalErrorResponse(err)
+		}
+		if err == nil {
+			err = checkLabels(datas[i].Labels)
+		}
+		if err != nil {
+			result.Items[i] = DataBatchItem{StatusCode: http.StatusBadRequest, Message: err.Error()}
+			result.Failed++
+			continue
+		}
+
+		id, err := service.newIdent()
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		datas[i].ID = id
+
+		valid = append(valid, datas[i])
+		validIndex = append(validIndex, i)
+	}
+
+	if len(valid) > 0 {
+		errs, err := service.dataDB.PostDataBatch(valid)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+
+		for j, data := range valid {
+			i := validIndex[j]
+			if errs[j] != nil {
+				result.Items[i] = DataBatchItem{
+					StatusCode: http.StatusBadRequest,
+					Message:    errs[j].Error(),
+				}
+				result.Failed++
+				continue
+			}
+			service.noteWritten(&data)
+			result.Items[i] = DataBatchItem{ID: data.ID, StatusCode: http.StatusCreated}
+			result.Created++
+		}
+	}
+
+	return service.newOKResponse(result)
+}
+
+func (service *Service) GetData(id piazza.Ident) *piazza.JsonResponse {
+	//log.Printf("Service.GetData: %s", id.String())
+
+	metric, found, err := service.dataDB.GetOne(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	return service.newOKResponse(metric)
+}
+
+// GetDataRange returns the Data of the metric with timestamps from "start"
+// up to "end", sorted by timestamp and paginated. Either end of the range
+// can be left off.
+func (service *Service) GetDataRange(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	_, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return service.newLookupErrorResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	start, err := params.GetAsTime("start", time.Unix(0, 0))
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	end, err := params.GetAsTime("end", maxDataTime)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	if !start.Before(end) {
+		return service.newBadRequestResponse(errors.New("start must be before end"))
+	}
+
+	datas, total, err := service.dataDB.GetByMetric(id, start, end, format)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := service.newOKResponse(datas)
+	format.Count = int(total)
+	resp.Pagination = format
+	return resp
+}
+
+// the end of a data range when none is given
+var maxDataTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+func (service *Service) DeleteData(id piazza.Ident) *piazza.JsonResponse {
+	ok, err := service.dataDB.DeleteByID(id)
+	if !ok {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	return service.newOKResponse(nil)
+}
+
+//---------------------------------------------------------------------
+
+// allMetrics returns every Metric, reading them a page at a time
+func (service *Service) allMetrics() ([]Metric, error) {
+	const perPage = 1000
+
+	all := []Metric{}
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{
+			Page:    page,
+			PerPage: perPage,
+			SortBy:  "name",
+			Order:   piazza.PaginationOrderAscending,
+		}
+		metrics, _, err := service.metricDB.GetAll(format)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, metrics...)
+		if len(metrics) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// GetPrometheus renders every metric in the Prometheus text format: either
+// its latest value, or an aggregate of its values over the last window. It
+// returns the text, or else an error response.
+func (service *Service) GetPrometheus(
+	aggregate PrometheusAggregate,
+	window time.Duration) (string, *piazza.JsonResponse) {
+
+	if !aggregate.valid() {
+		return "", service.newBadRequestResponse(fmt.Errorf("invalid aggregate: %s", aggregate))
+	}
+	if aggregate != PrometheusLatest && window <= 0 {
+		return "", service.newBadRequestResponse(fmt.Errorf("invalid window: %s", window))
+	}
+
+	metrics, err := service.allMetrics()
+	if err != nil {
+		return "", service.newInternalErrorResponse(err)
+	}
+
+	ids := make([]piazza.Ident, len(metrics))
+	for i := range metrics {
+		ids[i] = metrics[i].ID
+	}
+
+	samples := []prometheusSample{}
+
+	if aggregate == PrometheusLatest {
+		latest, err := service.dataDB.GetLatestOfEach(ids)
+		if err != nil {
+			return "", service.newInternalErrorResponse(err)
+		}
+		for i := range metrics {
+			metric := &metrics[i]
+			if data, found := latest[metric.ID]; found {
+				samples = append(samples, prometheusSample{
+					metric:  metric,
+					value:   data.Value,
+					counter: metric.TypeOrDefault() == MetricTypeCounter,
+				})
+			}
+		}
+		return renderPrometheus(samples), nil
+	}
+
+	end := time.Now()
+	req := &ReportRequest{Start: end.Add(-window), End: end}
+	summaries, err := service.dataDB.GetSummaryOfEach(ids, req)
+	if err != nil {
+		return "", service.newInternalErrorResponse(err)
+	}
+	for i := range metrics {
+		metric := &metrics[i]
+		stats := summaries[metric.ID]
+		if stats.Count > 0 || aggregate == PrometheusCount {
+			samples = append(samples, prometheusSample{metric: metric, value: aggregate.of(stats)})
+		}
+	}
+
+	return renderPrometheus(samples), nil
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) PostAlert(rule *AlertRule) *piazza.JsonResponse {
+	err := checkAlertRule(rule)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	found, err := service.metricExists(rule.MetricID)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	if !found {
+		return service.newBadRequestResponse(fmt.Errorf("metric not found: %s", rule.MetricID.String()))
+	}
+
+	id, err := service.newIdent()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	now := time.Now()
+	rule.ID = id
+	rule.CreatedOn = now
+	rule.State = AlertStateInactive
+	rule.StateSince = now
+	rule.Value = nil
+	rule.EvaluatedOn = time.Time{}
+
+	_, err = service.alertDB.PostData(rule, id)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return service.newStatusCreatedResponse(rule)
+}
+
+func (service *Service) GetAlerts(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	rules, total, err := service.alertDB.GetAll(format)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := service.newOKResponse(rules)
+	format.Count = int(total)
+	resp.Pagination = format
+	return resp
+}
+
+func (service *Service) GetAlert(id piazza.Ident) *piazza.JsonResponse {
+	rule, found, err := service.alertDB.GetOne(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(rule)
+}
+
+// PutAlert replaces the definition of the rule. Its state is kept, and
+// catches up with the new definition at the next evaluation.
+func (service *Service) PutAlert(id piazza.Ident, rule *AlertRule) *piazza.JsonResponse {
+	service.alertMutex.Lock()
+	defer service.alertMutex.Unlock()
+
+	old, found, err := service.alertDB.GetOne(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	err = checkAlertRule(rule)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	found, err = service.metricExists(rule.MetricID)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	if !found {
+		return service.newBadRequestResponse(fmt.Errorf("metric not found: %s", rule.MetricID.String()))
+	}
+
+	rule.ID = id
+	rule.CreatedOn = old.CreatedOn
+	rule.State = old.State
+	rule.StateSince = old.StateSince
+	rule.Value = old.Value
+	rule.EvaluatedOn = old.EvaluatedOn
+
+	err = service.alertDB.PutData(rule, id)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(rule)
+}
+
+// DeleteAlert deletes the rule. Its history is kept.
+func (service *Service) DeleteAlert(id piazza.Ident) *piazza.JsonResponse {
+	service.alertMutex.Lock()
+	defer service.alertMutex.Unlock()
+
+	ok, err := service.alertDB.DeleteByID(id)
+	if !ok {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(nil)
+}
+
+// GetAlertHistory returns the state changes of the rule, which are kept
+// even after the rule is deleted.
+func (service *Service) GetAlertHistory(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	events, total, err := service.alertDB.GetEvents(id, format)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := service.newOKResponse(events)
+	format.Count = int(total)
+	resp.Pagination = format
+	return resp
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) PostChannel(channel *NotificationChannel) *piazza.JsonResponse {
+	err := checkNotificationChannel(channel)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	id, err := service.newIdent()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	channel.ID = id
+	channel.CreatedOn = time.Now()
+
+	err = service.alertDB.PostChannel(channel)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return service.newStatusCreatedResponse(channel)
+}
+
+func (service *Service) GetChannels(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	channels, total, err := service.alertDB.GetChannels(format)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := service.newOKResponse(channels)
+	format.Count = int(total)
+	resp.Pagination = format
+	return resp
+}
+
+func (service *Service) GetChannel(id piazza.Ident) *piazza.JsonResponse {
+	channel, found, err := service.alertDB.GetChannel(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(channel)
+}
+
+func (service *Service) DeleteChannel(id piazza.Ident) *piazza.JsonResponse {
+	ok, err := service.alertDB.DeleteChannel(id)
+	if !ok {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(nil)
+}
+
+// GetChannelDeliveries returns the deliveries to the channel, newest first.
+func (service *Service) GetChannelDeliveries(id piazza.Ident) *piazza.JsonResponse {
+	_, found, err := service.alertDB.GetChannel(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	return service.newOKResponse(service.webhooks.log.forChannel(id))
+}
+
+//---------------------------------------------------------------------
+
+// checkDashboardMetrics returns an error if a panel of the dashboard is of
+// a metric that doesn't exist
+func (service *Service) checkDashboardMetrics(dashboard *Dashboard) error {
+	for _, panel := range dashboard.Panels {
+		found, err := service.metricExists(panel.MetricID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("metric not found: %s", panel.MetricID.String())
+		}
+	}
+	return nil
+}
+
+func (service *Service) PostDashboard(dashboard *Dashboard) *piazza.JsonResponse {
+	err := checkDashboard(dashboard)
+	if err == nil {
+		err = service.checkDashboardMetrics(dashboard)
+	}
+	if err != nil {
+		return service.newCheckErrorResponse(err)
+	}
+
+	id, err := service.newIdent()
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	dashboard.ID = id
+	dashboard.CreatedOn = time.Now()
+
+	_, err = service.dashboardDB.PostData(dashboard, id)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	return service.newStatusCreatedResponse(dashboard)
+}
+
+func (service *Service) GetDashboards(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	dashboards, total, err := service.dashboardDB.GetAll(format)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	resp := service.newOKResponse(dashboards)
+	format.Count = int(total)
+	resp.Pagination = format
+	return resp
+}
+
+func (service *Service) GetDashboard(id piazza.Ident) *piazza.JsonResponse {
+	dashboard, found, err := service.dashboardDB.GetOne(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(dashboard)
+}
+
+// PutDashboard replaces the dashboard's layout.
+func (service *Service) PutDashboard(id piazza.Ident, dashboard *Dashboard) *piazza.JsonResponse {
+	old, found, err := service.dashboardDB.GetOne(id)
+	if !found {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	err = checkDashboard(dashboard)
+	if err == nil {
+		err = service.checkDashboardMetrics(dashboard)
+	}
+	if err != nil {
+		return service.newCheckErrorResponse(err)
+	}
+	dashboard.ID = id
+	dashboard.CreatedOn = old.CreatedOn
+
+	err = service.dashboardDB.PutData(dashboard, id)
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(dashboard)
+}
+
+func (service *Service) DeleteDashboard(id piazza.Ident) *piazza.JsonResponse {
+	ok, err := service.dashboardDB.DeleteByID(id)
+	if !ok {
+		return service.newNotFoundResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+	return service.newOKResponse(nil)
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) GetJob(id piazza.Ident) *piazza.JsonResponse {
+	job, ok := service.jobs.get(id)
+	if !ok {
+		return service.newNotFoundResponse(fmt.Errorf("job not found: %s", id.String()))
+	}
+	return service.newOKResponse(job)
+}
+
+//---------------------------------------------------------------------
+
+func (service *Service) GetReport(id piazza.Ident, req *ReportRequest) *piazza.JsonResponse {
+	//log.Printf("Service.GetReport(%s, %#v)", id, req)
+
+	metric, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return service.newLookupErrorResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	err = checkReportRequest(req)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	tier, err := service.reportTier(id, metric, req)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	if req.GroupBy != "" {
+		grouped, err := service.dataDB.GetGroupedStats(id, req)
+		if err != nil {
+			return service.newReportErrorResponse(err)
+		}
+		// rollups have no labels, so a grouped report is always raw
+		grouped.Tier = tier
+		reports := map[string]*FullReport{}
+		for i := range grouped.Groups {
+			grouped.Groups[i].Report.Tier = tier
+			reports[grouped.Groups[i].Value] = &grouped.Groups[i].Report
+		}
+		err = service.typeReports(id, metric, req, reports)
+		if err != nil {
+			return service.newReportErrorResponse(err)
+		}
+		return service.newOKResponse(grouped)
+	}
+
+	var stats *FullReport
+	if tier == RollupTierRaw {
+		stats, err = service.dataDB.GetStats(id, req)
+	} else {
+		// the interval was checked in picking the tier
+		interval, _ := parseDateInterval(req.DateInterval)
+		var rollups []Rollup
+		rollups, err = service.getRollups(id, tier, req.Start, req.End)
+		if err == nil {
+			stats = newRollupReport(rollups, interval)
+		}
+	}
+	if err != nil {
+		return service.newReportErrorResponse(err)
+	}
+	stats.Tier = tier
+	err = service.typeReports(id, metric, req, map[string]*FullReport{"": stats})
+	if err != nil {
+		return service.newReportErrorResponse(err)
+	}
+
+	return service.newOKResponse(stats)
+}
+
+func (service *Service) GetSeries(id piazza.Ident, req *SeriesRequest) *piazza.JsonResponse {
+	_, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return service.newLookupErrorResponse(err)
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	step, agg, err := checkSeriesRequest(req)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	tier, err := service.seriesTier(id, req, step, agg)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	var values map[int64]float64
+	if tier == RollupTierRaw {
+		values, err = service.dataDB.GetSeries(id, req)
+	} else {
+		var rollups []Rollup
+		rollups, err = service.getRollups(id, tier, req.Start, req.End)
+		if err == nil {
+			values = newRollupSeriesValues(rollups, step, agg)
+		}
+	}
+	if err != nil {
+		return service.newInternalErrorResponse(err)
+	}
+
+	series := newSeries(id, req, step, agg, values)
+	series.Tier = tier
+	return service.newOKResponse(series)
+}
+
+// GetReportChart returns the report on the metric, drawn as an SVG chart.
+// A report grouped by a label can't be drawn.
+func (service *Service) GetReportChart(id piazza.Ident, req *ChartRequest) (string, *piazza.JsonResponse) {
+	metric, found, err := service.metricDB.GetOne(id)
+	if !found {
+		return "", service.newLookupErrorResponse(err)
+	}
+	if err != nil {
+		return "", service.newInternalErrorResponse(err)
+	}
+
+	err = checkChartRequest(req)
+	if err != nil {
+		return "", service.newBadRequestResponse(err)
+	}
+	req.GroupBy = ""
+
+	resp := service.GetReport(id, &req.ReportRequest)
+	if resp.IsError() {
+		return "", resp
+	}
+
+	return renderChart(metric, resp.Data.(*FullReport), req), nil
+}
+
+// CompareMetrics returns a Comparison of the metrics of the request.
+func (service *Service) CompareMetrics(req *CompareRequest) *piazza.JsonResponse {
+	err := checkCompareRequest(req)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+
+	var metrics []Metric
+	if len(req.Selector) > 0 {
+		err = checkLabels(req.Selector)
+		if err != nil {
+			return service.newBadRequestResponse(err)
+		}
+		format := &piazza.JsonPagination{
+			PerPage: maxCompareMetrics,
+			SortBy:  "name",
+			Order:   piazza.PaginationOrderAscending,
+		}
+		var totalHits int64
+		metrics, totalHits, err = service.metricDB.Search(&MetricQuery{Labels: req.Selector}, format)
+		if err != nil {
+			return service.newInternalErrorResponse(err)
+		}
+		if len(metrics) == 0 {
+			return service.newNotFoundResponse(errors.New("no metrics match the selector"))
+		}
+		if totalHits > maxCompareMetrics {
+			return service.newBadRequestResponse(
+				fmt.Errorf("too many metrics match the selector: more than %d", maxCompareMetrics))
+		}
+	} else {
+		for _, id := range req.MetricIDs {
+			metric, found, err := service.metricDB.GetOne(id)
+			if !found {
+				return service.newLookupErrorResponse(err)
+			}
+			if err != nil {
+				return service.newInternalErrorResponse(err)
+			}
+			metrics = append(metrics, *metric)
+		}
+	}
+
+	if !req.AllowMixedUnits {
+		for _, metric := range metrics[1:] {
+			if metric.Units != metrics[0].Units {
+				return service.newBadRequestResponse(fmt.Errorf("metrics have different units: %s and %s",
+					metrics[0].Units, metric.Units))
+			}
+		}
+	}
+
+	comparison := &Comparison{
+		Start:        req.Start,
+		End:          req.End,
+		DateInterval: req.DateInterval,
+		Timestamps:   compareTimestamps(&req.ReportRequest),
+		Metrics:      []ComparedMetric{},
+	}
+	tier, err := service.compareTier(metrics, &req.ReportRequest)
+	if err != nil {
+		return service.newBadRequestResponse(err)
+	}
+	for _, metric := range metrics {
+		reportReq := req.ReportRequest
+		reportReq.Tier = tier
+		resp := service.GetReport(metric.ID, &reportReq)
+		if resp.IsError() {
+			return resp
+		}
+		report := resp.Data.(*FullReport)
+		comparison.Metrics = append(comparison.Metrics, ComparedMetric{
+			MetricID:    metric.ID,
+			Name:        metric.Name,
+			Units:       metric.Units,
+			Type:        report.Type,
+			Tier:        report.Tier,
+			RateReport:  report.RateReport,
+			StatsReport: report.StatsReport,
+			PercsReport: report.PercsReport,
+			Buckets:     alignBuckets(report, comparison.Timestamps),
+		})
+	}
+
+	return service.newOKResponse(comparison)
+}
+
+// typeReports adds to the reports what the type of the metric calls for: for
+// counters, the rates, computed from the data in time order. The reports are
+// keyed by the value of the request's GroupBy label, or by "" if it has none,
+// and the data are read once for all of them.
+func (service *Service) typeReports(id piazza.Ident, metric *Metric, req *ReportRequest,
+	reports map[string]*FullReport) error {
+
+	typ := metric.TypeOrDefault()
+	for _, report := range reports {
+		report.Type = typ
+	}
+	if typ != MetricTypeCounter || len(reports) == 0 {
+		return nil
+	}
+
+	datas, err := service.dataDB.GetPoints(id, req, maxReportPoints)
+	if err != nil {
+		return err
+	}
+	points := map[string][]memPoint{}
+	for i := range datas {
+		key := ""
+		if req.GroupBy != "" {
+			key = datas[i].Labels[req.GroupBy]
+		}
+		if _, ok := reports[key]; !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, datas[i].Timestamp)
+		if err != nil {
+			continue
+		}
+		points[key] = append(points[key], memPoint{timestamp: t, value: datas[i].Value})
+	}
+
+	for key, report := range reports {
+		err = addCounterRates(report, points[key], req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,427 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// StatsdListener accepts the StatsD protocol over UDP, e.g.
+//
+//	api.requests:1|c|@0.1
+//	api.latency:320|ms
+//	queue.depth:+3|g
+//	users.seen:alice|s
+//	api.requests:1|c|#host:a,region:east
+//
+// and turns it into Metrics and Data. Within each flush interval, counters
+// are summed (scaled up by their sample rate), gauges keep their last value
+// and sets count their unique values, and each of those is stored as one
+// Data. Timer values are stored one Data per value, so that reports can
+// still compute percentiles over them. DogStatsD-style "#" tags become
+// labels on the Data.
+//
+// Each StatsD name and type gets its own Metric, created when first seen,
+// with an ID like "statsd:counter:api.requests".
+type StatsdListener struct {
+	service *Service
+	conn    net.PacketConn
+
+	mutex    sync.Mutex
+	counters map[string]*statsdValue
+	gauges   map[string]*statsdValue
+	sets     map[string]*statsdSet
+	timers   []Data
+	updated  map[string]bool // which gauges were set since the last flush
+	metrics  map[piazza.Ident]bool
+	badLines int64
+
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// statsdKind describes a StatsD type. StatsD counters are stored as the
+// count for each flush interval, not a running total, so their metrics are
+// gauges.
+type statsdKind struct {
+	name       string
+	units      Units
+	metricType MetricType
+}
+
+var statsdKinds = map[string]statsdKind{
+	"c":  {"counter", UnitCount, MetricTypeGauge},
+	"g":  {"gauge", "", MetricTypeGauge},
+	"ms": {"timer", UnitMilliseconds, MetricTypeTimer},
+	"h":  {"timer", UnitMilliseconds, MetricTypeTimer},
+	"s":  {"set", UnitCount, MetricTypeGauge},
+}
+
+type statsdValue struct {
+	metricID piazza.Ident
+	labels   map[string]string
+	value    float64
+}
+
+type statsdSet struct {
+	metricID piazza.Ident
+	labels   map[string]string
+	values   map[string]bool
+}
+
+const statsdMaxPacket = 65535
+
+// NewStatsdListener starts listening for StatsD packets on the UDP address,
+// e.g. ":8125", and starts writing what it gets every flushInterval.
+func NewStatsdListener(service *Service, address string, flushInterval time.Duration) (*StatsdListener, error) {
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("NewStatsdListener: invalid flush interval: %s", flushInterval)
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &StatsdListener{
+		service:  service,
+		conn:     conn,
+		counters: map[string]*statsdValue{},
+		gauges:   map[string]*statsdValue{},
+		sets:     map[string]*statsdSet{},
+		timers:   []Data{},
+		updated:  map[string]bool{},
+		metrics:  map[piazza.Ident]bool{},
+		done:     make(chan struct{}),
+	}
+
+	l.stopped.Add(2)
+	go l.read()
+	go l.flushEvery(flushInterval)
+
+	log.Printf("StatsD listener on %s", conn.LocalAddr().String())
+	return l, nil
+}
+
+// Address returns the address the listener is bound to.
+func (l *StatsdListener) Address() string {
+	return l.conn.LocalAddr().String()
+}
+
+// BadLines returns how many lines could not be parsed, since the start.
+func (l *StatsdListener) BadLines() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.badLines
+}
+
+// Close stops listening, and writes whatever was received since the last
+// flush.
+func (l *StatsdListener) Close() error {
+	close(l.done)
+	err := l.conn.Close()
+	l.stopped.Wait()
+
+	ferr := l.Flush()
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+//---------------------------------------------------------------------
+
+func (l *StatsdListener) read() {
+	defer l.stopped.Done()
+
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			log.Printf("StatsdListener: %s", err.Error())
+			continue
+		}
+
+		now := time.Now()
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			err = l.handleLine(line, now)
+			if err != nil {
+				l.mutex.Lock()
+				l.badLines++
+				l.mutex.Unlock()
+				log.Printf("StatsdListener: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (l *StatsdListener) flushEvery(interval time.Duration) {
+	defer l.stopped.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := l.Flush()
+			if err != nil {
+				log.Printf("StatsdListener: %s", err.Error())
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+
+func statsdMetricID(kind string, name string) piazza.Ident {
+	return piazza.Ident(fmt.Sprintf("statsd:%s:%s", kind, name))
+}
+
+// statsdKey identifies one series: the metric plus its labels
+func statsdKey(metricID piazza.Ident, labels map[string]string) string {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := metricID.String()
+	for _, k := range keys {
+		s += "|" + k + "=" + labels[k]
+	}
+	return s
+}
+
+// parseStatsdTags reads "k1:v1,k2:v2"; a tag with no value gets value "true"
+func parseStatsdTags(s string) map[string]string {
+	labels := map[string]string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) == 1 {
+			labels[parts[0]] = "true"
+			continue
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels
+}
+
+// handleLine parses "name:value|type[|@rate][|#tags]" and adds it in
+func (l *StatsdListener) handleLine(line string, now time.Time) error {
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return fmt.Errorf("invalid line: \"%s\"", line)
+	}
+	colon := strings.Index(line[:pipe], ":")
+	if colon <= 0 {
+		return fmt.Errorf("invalid line: \"%s\"", line)
+	}
+
+	name := line[:colon]
+	valueString := line[colon+1 : pipe]
+	fields := strings.Split(line[pipe+1:], "|")
+	typ := fields[0]
+
+	kind, ok := statsdKinds[typ]
+	if !ok {
+		return fmt.Errorf("invalid type in line: \"%s\"", line)
+	}
+
+	rate := 1.0
+	var labels map[string]string
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0.0 || r > 1.0 {
+				return fmt.Errorf("invalid sample rate in line: \"%s\"", line)
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			labels = parseStatsdTags(field[1:])
+		default:
+			return fmt.Errorf("invalid field in line: \"%s\"", line)
+		}
+	}
+
+	var value float64
+	if kind.name != "set" {
+		var err error
+		value, err = strconv.ParseFloat(valueString, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value in line: \"%s\"", line)
+		}
+	}
+
+	metricID := statsdMetricID(kind.name, name)
+	err := l.registerMetric(metricID, name, kind)
+	if err != nil {
+		return err
+	}
+	key := statsdKey(metricID, labels)
+
+	if kind.name == "set" {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		set, ok := l.sets[key]
+		if !ok {
+			set = &statsdSet{metricID: metricID, labels: labels, values: map[string]bool{}}
+			l.sets[key] = set
+		}
+		set.values[valueString] = true
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch kind.name {
+	case "counter":
+		counter, ok := l.counters[key]
+		if !ok {
+			counter = &statsdValue{metricID: metricID, labels: labels}
+			l.counters[key] = counter
+		}
+		counter.value += value / rate
+
+	case "gauge":
+		gauge, ok := l.gauges[key]
+		if !ok {
+			gauge = &statsdValue{metricID: metricID, labels: labels}
+			l.gauges[key] = gauge
+		}
+		// an explicit sign means change the gauge, not set it
+		if strings.HasPrefix(valueString, "+") || strings.HasPrefix(valueString, "-") {
+			gauge.value += value
+		} else {
+			gauge.value = value
+		}
+		l.updated[key] = true
+
+	case "timer":
+		l.timers = append(l.timers, Data{
+			MetricID:  metricID,
+			Timestamp: now.Format(time.RFC3339Nano),
+			Value:     value,
+			Labels:    labels,
+		})
+	}
+
+	return nil
+}
+
+// registerMetric makes sure there is a Metric for the StatsD name and type
+func (l *StatsdListener) registerMetric(metricID piazza.Ident, name string, kind statsdKind) error {
+	l.mutex.Lock()
+	known := l.metrics[metricID]
+	l.mutex.Unlock()
+	if known {
+		return nil
+	}
+
+	metric := &Metric{
+		ID:          metricID,
+		Name:        name,
+		Namespace:   "statsd." + kind.name,
+		Description: "StatsD " + kind.name,
+		Units:       kind.units,
+		Type:        kind.metricType,
+	}
+	err := l.service.ensureMetric(metric)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.metrics[metricID] = true
+	l.mutex.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------
+
+// Flush writes out everything received since the last flush.
+func (l *StatsdListener) Flush() error {
+	now := time.Now().Format(time.RFC3339Nano)
+
+	l.mutex.Lock()
+	datas := l.timers
+	for _, counter := range l.counters {
+		datas = append(datas, Data{
+			MetricID: counter.metricID, Timestamp: now, Value: counter.value, Labels: counter.labels,
+		})
+	}
+	for key := range l.updated {
+		gauge := l.gauges[key]
+		datas = append(datas, Data{
+			MetricID: gauge.metricID, Timestamp: now, Value: gauge.value, Labels: gauge.labels,
+		})
+	}
+	for _, set := range l.sets {
+		datas = append(datas, Data{
+			MetricID: set.metricID, Timestamp: now, Value: float64(len(set.values)), Labels: set.labels,
+		})
+	}
+	l.timers = []Data{}
+	l.counters = map[string]*statsdValue{}
+	l.sets = map[string]*statsdSet{}
+	l.updated = map[string]bool{}
+	l.mutex.Unlock()
+
+	failed := 0
+	for len(datas) > 0 {
+		n := len(datas)
+		if n > MaxDataBatchSize {
+			n = MaxDataBatchSize
+		}
+
+		resp := l.service.PostDataBatch(datas[:n])
+		if resp.IsError() {
+			return fmt.Errorf("StatsdListener.Flush failed: %s", resp.Message)
+		}
+		failed += resp.Data.(*DataBatchResult).Failed
+
+		datas = datas[n:]
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("StatsdListener.Flush: %d data points not stored", failed)
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/pz-gocommon/gocommon"
+)
+
+// NotificationChannel is a URL that is sent a WebhookPayload, by POST,
+// whenever an alert fires or resolves.
+type NotificationChannel struct {
+	ID        piazza.Ident   `json:"id"`
+	Name      string         `json:"name"`
+	URL       string         `json:"url"`
+	AlertIDs  []piazza.Ident `json:"alertIds,omitempty"` // if empty, every alert
+	CreatedOn time.Time      `json:"createdOn"`
+}
+
+// WebhookPayload is what a NotificationChannel is sent.
+type WebhookPayload struct {
+	State  AlertState `json:"state"` // firing or resolved
+	Alert  AlertRule  `json:"alert"`
+	Metric Metric     `json:"metric"`
+	Value  *float64   `json:"value,omitempty"`
+	Time   time.Time  `json:"time"`
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "Pending"
+	WebhookDeliverySucceeded WebhookDeliveryStatus = "Succeeded"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "Failed"
+)
+
+// WebhookAttempt is one try at sending a payload: either the response's
+// status code, or why there was no response.
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WebhookDelivery is the sending of one payload to one channel. Like Jobs,
+// deliveries are only kept in memory.
+type WebhookDelivery struct {
+	ID        piazza.Ident          `json:"id"`
+	ChannelID piazza.Ident          `json:"channelId"`
+	AlertID   piazza.Ident          `json:"alertId"`
+	State     AlertState            `json:"state"`
+	Status    WebhookDeliveryStatus `json:"status"`
+	Attempts  []WebhookAttempt      `json:"attempts"`
+	CreatedOn time.Time             `json:"createdOn"`
+}
+
+type WebhookConfig struct {
+	// a payload is sent at most this many times, waiting InitialBackoff
+	// after the first failure and twice as long after each next one, up
+	// to MaxBackoff
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// how long to wait for the receiver to respond
+	Timeout time.Duration
+}
+
+var DefaultWebhookConfig = WebhookConfig{
+	MaxAttempts:    5,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     1 * time.Minute,
+	Timeout:        10 * time.Second,
+}
+
+// the most deliveries kept in the log; the oldest are forgotten first
+const maxWebhookDeliveries = 10000
+
+func checkNotificationChannel(channel *NotificationChannel) error {
+	if channel.Name == "" {
+		return errors.New("channel has no name")
+	}
+	u, err := url.Parse(channel.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: \"%s\"", channel.URL)
+	}
+	return nil
+}
+
+func (channel *NotificationChannel) wants(alertID piazza.Ident) bool {
+	if len(channel.AlertIDs) == 0 {
+		return true
+	}
+	for _, id := range channel.AlertIDs {
+		if id == alertID {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------
+
+// webhookLog holds the deliveries, oldest first
+type webhookLog struct {
+	sync.Mutex
+	deliveries []*WebhookDelivery
+}
+
+func (l *webhookLog) add(delivery *WebhookDelivery) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.deliveries = append(l.deliveries, delivery)
+	if over := len(l.deliveries) - maxWebhookDeliveries; over > 0 {
+		l.deliveries = l.deliveries[over:]
+	}
+}
+
+func (l *webhookLog) update(delivery *WebhookDelivery, f func(*WebhookDelivery)) {
+	l.Lock()
+	defer l.Unlock()
+	f(delivery)
+}
+
+// forChannel returns copies of the channel's deliveries, newest first
+func (l *webhookLog) forChannel(id piazza.Ident) []WebhookDelivery {
+	l.Lock()
+	defer l.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for i := len(l.deliveries) - 1; i >= 0; i-- {
+		delivery := l.deliveries[i]
+		if delivery.ChannelID != id {
+			continue
+		}
+		cpy := *delivery
+		cpy.Attempts = append([]WebhookAttempt{}, delivery.Attempts...)
+		deliveries = append(deliveries, cpy)
+	}
+	return deliveries
+}
+
+// webhooks sends payloads in the background
+type webhooks struct {
+	mutex   sync.Mutex // guards config and client, which can be set while sending
+	config  WebhookConfig
+	client  *http.Client
+	log     webhookLog
+	sending sync.WaitGroup
+}
+
+func newWebhooks(config WebhookConfig) *webhooks {
+	w := &webhooks{}
+	w.setConfig(config)
+	return w
+}
+
+func (w *webhooks) setConfig(config WebhookConfig) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.config = config
+	w.client = &http.Client{Timeout: config.Timeout}
+}
+
+func (w *webhooks) settings() (WebhookConfig, *http.Client) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.config, w.client
+}
+
+// SetWebhookConfig changes how webhooks are sent, from DefaultWebhookConfig.
+// Deliveries already underway keep the config they started with.
+func (service *Service) SetWebhookConfig(config WebhookConfig) error {
+	if config.MaxAttempts < 1 {
+		return errors.New("SetWebhookConfig: max attempts must be at least 1")
+	}
+	service.webhooks.setConfig(config)
+	return nil
+}
+
+// notify sends the payload for the event to every channel that wants it.
+// The sending is done in the background; this only fails if the channels
+// can't be looked up.
+func (service *Service) notify(rule *AlertRule, event *AlertEvent) error {
+	if event.To != AlertStateFiring && event.To != AlertStateResolved {
+		return nil
+	}
+
+	channels, err := service.allChannels()
+	if err != nil {
+		return err
+	}
+
+	payload := &WebhookPayload{
+		State: event.To,
+		Alert: *rule,
+		Value: event.Value,
+		Time:  event.CreatedOn,
+	}
+	payload.Alert.State = event.To
+	payload.Alert.StateSince = event.CreatedOn
+	metric, found, _ := service.metricDB.GetOne(rule.MetricID)
+	if found {
+		payload.Metric = *metric
+	} else {
+		payload.Metric = Metric{ID: rule.MetricID}
+	}
+
+	for i := range channels {
+		channel := channels[i]
+		if !channel.wants(rule.ID) {
+			continue
+		}
+
+		id, err := service.newIdent()
+		if err != nil {
+			return err
+		}
+		delivery := &WebhookDelivery{
+			ID:        id,
+			ChannelID: channel.ID,
+			AlertID:   rule.ID,
+			State:     event.To,
+			Status:    WebhookDeliveryPending,
+			Attempts:  []WebhookAttempt{},
+			CreatedOn: time.Now(),
+		}
+		service.webhooks.log.add(delivery)
+
+		service.webhooks.sending.Add(1)
+		go service.webhooks.deliver(&channel, delivery, payload)
+	}
+
+	return nil
+}
+
+func (w *webhooks) deliver(channel *NotificationChannel, delivery *WebhookDelivery, payload *WebhookPayload) {
+	defer w.sending.Done()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		w.log.update(delivery, func(d *WebhookDelivery) {
+			d.Status = WebhookDeliveryFailed
+			d.Attempts = append(d.Attempts, WebhookAttempt{Time: time.Now(), Error: err.Error()})
+		})
+		return
+	}
+
+	config, client := w.settings()
+	backoff := config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		result := sendWebhook(client, channel.URL, body)
+		ok := result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300
+
+		w.log.update(delivery, func(d *WebhookDelivery) {
+			d.Attempts = append(d.Attempts, result)
+			if ok {
+				d.Status = WebhookDeliverySucceeded
+			} else if attempt >= config.MaxAttempts {
+				d.Status = WebhookDeliveryFailed
+			}
+		})
+		if ok {
+			return
+		}
+		if attempt >= config.MaxAttempts {
+			log.Printf("Webhook to %s failed after %d attempts", channel.URL, attempt)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+}
+
+// wait waits for all the deliveries underway to finish
+func (w *webhooks) wait() {
+	w.sending.Wait()
+}
+
+func sendWebhook(client *http.Client, url string, body []byte) WebhookAttempt {
+	attempt := WebhookAttempt{Time: time.Now()}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
+
+// allChannels returns every NotificationChannel, reading them a page at a
+// time
+func (service *Service) allChannels() ([]NotificationChannel, error) {
+	const perPage = 1000
+
+	all := []NotificationChannel{}
+	for page := 0; ; page++ {
+		format := &piazza.JsonPagination{
+			Page:    page,
+			PerPage: perPage,
+			SortBy:  "createdOn",
+			Order:   piazza.PaginationOrderAscending,
+		}
+		channels, _, err := service.alertDB.GetChannels(format)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, channels...)
+		if len(channels) < perPage {
+			return all, nil
+		}
+	}
+}
@@ -18,6 +18,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	piazza "github.com/venicegeo/pz-gocommon/gocommon"
@@ -35,20 +39,104 @@ const (
 	UnitStrings      Units = "Strings"
 )
 
+// checkUnits returns an error if the units are not one of the above. No
+// units at all is allowed.
+func checkUnits(u Units) error {
+	switch u {
+	case "", UnitSeconds, UnitMilliseconds, UnitCount, UnitBytes, UnitSquareYards, UnitBooleans, UnitStrings:
+		return nil
+	}
+	return fmt.Errorf("invalid units: \"%s\"", u)
+}
+
+// MetricType says what the values of a metric are, which decides how they
+// are reported on.
+type MetricType string
+
+const (
+	// an ever-increasing count, e.g. requests served since startup; reports
+	// include the rate of increase, allowing for the count being reset
+	MetricTypeCounter MetricType = "counter"
+
+	// a reading that can go up or down, e.g. queue length
+	MetricTypeGauge MetricType = "gauge"
+
+	// a distribution of observed values, e.g. response sizes
+	MetricTypeHistogram MetricType = "histogram"
+
+	// a distribution of durations, e.g. request latencies
+	MetricTypeTimer MetricType = "timer"
+)
+
+// checkMetricType returns an error if the type is not one of the above
+func checkMetricType(t MetricType) error {
+	switch t {
+	case MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeTimer:
+		return nil
+	}
+	return fmt.Errorf("invalid metric type: \"%s\"", t)
+}
+
 type Metric struct {
-	ID          piazza.Ident `json:"id"`
-	Name        string       `json:"name"`
-	Description string       `json:"description"`
-	Units       Units        `json:"units"`
+	ID          piazza.Ident      `json:"id"`
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"` // names are unique within it
+	Description string            `json:"description"`
+	Units       Units             `json:"units"`
+	Type        MetricType        `json:"type"`
+	Retention   string            `json:"retention,omitempty"` // e.g. "30d"; if not set, the service's default
+	Labels      map[string]string `json:"labels,omitempty"`    // for finding the metric, e.g. "team"
+	CreatedOn   time.Time         `json:"createdOn"`
+}
+
+// MetricPatch is the body of PATCH /metric/:id. Only the fields that are
+// set are changed.
+type MetricPatch struct {
+	Name        *string           `json:"name,omitempty"`
+	Namespace   *string           `json:"namespace,omitempty"`
+	Description *string           `json:"description,omitempty"`
+	Units       *Units            `json:"units,omitempty"`
+	Type        *MetricType       `json:"type,omitempty"`
+	Retention   *string           `json:"retention,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"` // replaces all the labels
+}
+
+// TypeOrDefault returns the metric's type; metrics created before there
+// were types are gauges.
+func (metric *Metric) TypeOrDefault() MetricType {
+	if metric.Type == "" {
+		return MetricTypeGauge
+	}
+	return metric.Type
 }
 
 type Data struct {
-	ID        piazza.Ident `json:"id"`
-	MetricID  piazza.Ident `json:"metricId"`
-	Timestamp string       `json:"timestamp"`
-	Value     float64      `json:"value"`
+	ID        piazza.Ident      `json:"id"`
+	MetricID  piazza.Ident      `json:"metricId"`
+	Timestamp string            `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
 }
 
+// DataBatchItem is the outcome of storing one of the Data in a batch: on
+// success, the new ID; on failure, the reason.
+type DataBatchItem struct {
+	ID         piazza.Ident `json:"id,omitempty"`
+	StatusCode int          `json:"statusCode"`
+	Message    string       `json:"message,omitempty"`
+}
+
+// DataBatchResult is returned from POST /data/batch. The items are in the
+// same order as the Data that were posted.
+type DataBatchResult struct {
+	Created int             `json:"created"`
+	Failed  int             `json:"failed"`
+	Items   []DataBatchItem `json:"items"`
+}
+
+// MaxDataBatchSize is the largest number of Data allowed in one batch.
+const MaxDataBatchSize = 10000
+
 type ReportRequest struct {
 	Start time.Time `json:"start"`
 	End   time.Time `json:"end"`
@@ -58,6 +146,127 @@ type ReportRequest struct {
 	DateInterval string `json:"dateInterval"`
 
 	ValueInterval string `json:"valueInterval"`
+
+	// only report on data having all of these labels
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// if set, make a separate report for each value of this label
+	GroupBy string `json:"groupBy,omitempty"`
+
+	// raw, hour or day, or auto to have it picked from the range and the
+	// DateInterval; if not set, raw
+	Tier RollupTier `json:"tier,omitempty"`
+
+	// the percentiles to report, e.g. 50, 99 and 99.9; if not set, 1, 5,
+	// 25, 50, 75, 95 and 99
+	Percentiles []float64 `json:"percentiles,omitempty"`
+
+	// values to report the percentile ranks of: the percent of the data at
+	// or below each, e.g. 300 for "the percent of requests under 300ms"
+	PercentileRanks []float64 `json:"percentileRanks,omitempty"`
+}
+
+// the most percentiles, or percentile ranks, a report may ask for
+const maxReportPercentiles = 100
+
+// checkPercentiles returns an error if the percentiles or ranks of the
+// request can't be reported
+func checkPercentiles(req *ReportRequest) error {
+	if len(req.Percentiles) > maxReportPercentiles {
+		return fmt.Errorf("too many percentiles: more than %d", maxReportPercentiles)
+	}
+	for _, p := range req.Percentiles {
+		if !(p >= 0 && p <= 100) {
+			return fmt.Errorf("invalid percentile: %v", p)
+		}
+	}
+	if len(req.PercentileRanks) > maxReportPercentiles {
+		return fmt.Errorf("too many percentile ranks: more than %d", maxReportPercentiles)
+	}
+	for _, v := range req.PercentileRanks {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("invalid percentile rank: %v", v)
+		}
+	}
+	return nil
+}
+
+// the most buckets a report's date or value histogram may have. The date
+// buckets are counted when the request is checked, but the value buckets
+// can only be once the values are known; only those with values in them
+// are made, and counted.
+const (
+	maxReportDateBuckets  = 10000
+	maxReportValueBuckets = 10000
+)
+
+var (
+	errTooManyDateBuckets  = fmt.Errorf("too many date buckets: more than %d", maxReportDateBuckets)
+	errTooManyValueBuckets = fmt.Errorf("too many value buckets: more than %d", maxReportValueBuckets)
+)
+
+// the most Data a report may read one by one, e.g. for a counter's rates
+const maxReportPoints = 100000
+
+var errTooManyPoints = fmt.Errorf("too many data points to report on: more than %d", maxReportPoints)
+
+// checkReportRequest returns an error if the report can't be made: the
+// range must run forward, and the intervals must parse
+func checkReportRequest(req *ReportRequest) error {
+	if req.Start.IsZero() || req.End.IsZero() {
+		return fmt.Errorf("start and end are required")
+	}
+	if !req.Start.Before(req.End) {
+		return fmt.Errorf("start must be before end")
+	}
+	if req.DateInterval == "" {
+		return fmt.Errorf("dateInterval is required")
+	}
+	interval, err := parseDateInterval(req.DateInterval)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for t := interval.floor(req.Start); t.Before(req.End); t = interval.next(t) {
+		n++
+		if n > maxReportDateBuckets {
+			return errTooManyDateBuckets
+		}
+	}
+	if req.ValueInterval == "" {
+		return fmt.Errorf("valueInterval is required")
+	}
+	v, err := strconv.ParseFloat(req.ValueInterval, 64)
+	if err != nil || !(v > 0) || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid value interval: \"%s\"", req.ValueInterval)
+	}
+
+	err = checkLabels(req.Labels)
+	if err != nil {
+		return err
+	}
+	if req.GroupBy != "" {
+		err = checkLabels(map[string]string{req.GroupBy: ""})
+		if err != nil {
+			return err
+		}
+	}
+	err = checkRollupTier(req.Tier)
+	if err != nil {
+		return err
+	}
+	return checkPercentiles(req)
+}
+
+// checkLabels returns an error if the labels can't be stored: ES does not
+// allow empty field names, or dots in them
+func checkLabels(labels map[string]string) error {
+	for k := range labels {
+		if k == "" || strings.Contains(k, ".") {
+			return fmt.Errorf("invalid label name: \"%s\"", k)
+		}
+	}
+	return nil
 }
 
 //---------------------------------------------------------------------------
@@ -70,6 +279,21 @@ func LoggedError(mssg string, args ...interface{}) error {
 
 //---------------------------------------------------------------------------
 
+// InMemoryStorage is true when the service is to be run without Elasticsearch,
+// which is requested by setting $PZ_METRICS_STORAGE to "memory".
+func InMemoryStorage() bool {
+	return os.Getenv("PZ_METRICS_STORAGE") == "memory"
+}
+
+// AutoCreateMetrics is true when Data for unknown metrics should create those
+// metrics rather than be rejected, which is requested by setting
+// $PZ_METRICS_AUTOCREATE to "true".
+func AutoCreateMetrics() bool {
+	return os.Getenv("PZ_METRICS_AUTOCREATE") == "true"
+}
+
+//---------------------------------------------------------------------------
+
 func init() {
 	piazza.JsonResponseDataTypes["metrics.Metric"] = "metricsmetric"
 	piazza.JsonResponseDataTypes["*metrics.Metric"] = "metricsmetric"
@@ -77,6 +301,29 @@ func init() {
 	piazza.JsonResponseDataTypes["metrics.Data"] = "metricsdata"
 	piazza.JsonResponseDataTypes["*metrics.Data"] = "metricsdata"
 	piazza.JsonResponseDataTypes["[]metrics.Data"] = "metricsdata-list"
+	piazza.JsonResponseDataTypes["metrics.DataBatchResult"] = "metricsdatabatch"
+	piazza.JsonResponseDataTypes["*metrics.DataBatchResult"] = "metricsdatabatch"
+	piazza.JsonResponseDataTypes["metrics.Job"] = "metricsjob"
+	piazza.JsonResponseDataTypes["*metrics.Job"] = "metricsjob"
 	piazza.JsonResponseDataTypes["metrics.FullReport"] = "metricsreport"
 	piazza.JsonResponseDataTypes["*metrics.FullReport"] = "metricsreport"
+	piazza.JsonResponseDataTypes["metrics.GroupedReport"] = "metricsgroupedreport"
+	piazza.JsonResponseDataTypes["*metrics.GroupedReport"] = "metricsgroupedreport"
+	piazza.JsonResponseDataTypes["metrics.AlertRule"] = "metricsalert"
+	piazza.JsonResponseDataTypes["*metrics.AlertRule"] = "metricsalert"
+	piazza.JsonResponseDataTypes["[]metrics.AlertRule"] = "metricsalert-list"
+	piazza.JsonResponseDataTypes["[]metrics.AlertEvent"] = "metricsalertevent-list"
+	piazza.JsonResponseDataTypes["metrics.NotificationChannel"] = "metricschannel"
+	piazza.JsonResponseDataTypes["*metrics.NotificationChannel"] = "metricschannel"
+	piazza.JsonResponseDataTypes["[]metrics.NotificationChannel"] = "metricschannel-list"
+	piazza.JsonResponseDataTypes["[]metrics.WebhookDelivery"] = "metricsdelivery-list"
+	piazza.JsonResponseDataTypes["metrics.Series"] = "metricsseries"
+	piazza.JsonResponseDataTypes["*metrics.Series"] = "metricsseries"
+	piazza.JsonResponseDataTypes["*metrics.RetentionStatus"] = "metricsretention"
+	piazza.JsonResponseDataTypes["*metrics.RetentionRun"] = "metricsretentionrun"
+	piazza.JsonResponseDataTypes["metrics.Dashboard"] = "metricsdashboard"
+	piazza.JsonResponseDataTypes["*metrics.Dashboard"] = "metricsdashboard"
+	piazza.JsonResponseDataTypes["[]metrics.Dashboard"] = "metricsdashboard-list"
+	piazza.JsonResponseDataTypes["metrics.Comparison"] = "metricscomparison"
+	piazza.JsonResponseDataTypes["*metrics.Comparison"] = "metricscomparison"
 }
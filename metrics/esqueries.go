@@ -28,8 +28,8 @@ func newExtendedStatsAggsQuery(fieldName string) map[string]interface{} {
 func newRangeQuery(fieldName string, start time.Time, stop time.Time) map[string]interface{} {
 	m := map[string]interface{}{
 		fieldName: map[string]interface{}{
-			"gte": start.Format(time.RFC3339),
-			"lt":  stop.Format(time.RFC3339),
+			"gte": start.Format(time.RFC3339Nano),
+			"lt":  stop.Format(time.RFC3339Nano),
 		},
 	}
 	return m
@@ -42,10 +42,26 @@ func newTermQuery(fieldName string, value interface{}) map[string]interface{} {
 	return m
 }
 
-func newPercentilesAggsQuery(field string, value string) map[string]interface{} {
+// newPercentilesAggsQuery asks for the percents, or, if there are none,
+// the ones ES gives by default
+func newPercentilesAggsQuery(field string, value string, percents []float64) map[string]interface{} {
+	percentiles := map[string]interface{}{
+		field: value,
+	}
+	if len(percents) > 0 {
+		percentiles["percents"] = percents
+	}
+	m := map[string]interface{}{
+		"percentiles": percentiles,
+	}
+	return m
+}
+
+func newPercentileRanksAggsQuery(fieldName string, values []float64) map[string]interface{} {
 	m := map[string]interface{}{
-		"percentiles": map[string]interface{}{
-			field: value,
+		"percentile_ranks": map[string]interface{}{
+			"field":  fieldName,
+			"values": values,
 		},
 	}
 	return m
@@ -88,6 +104,17 @@ func newHistogramAggsQuery(fieldName string, interval string) map[string]interfa
 	return m
 }
 
+func newTermsAggsQuery(fieldName string, size int, aggs map[string]interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"terms": map[string]interface{}{
+			"field": fieldName,
+			"size":  size,
+		},
+		"aggs": aggs,
+	}
+	return m
+}
+
 // {k1:v1, k2:v2, ...} ==> [{k1:v1},{k2:v2}]
 func newAndFilter(items map[string]interface{}) []interface{} {
 	m := []interface{}{}